@@ -8,8 +8,10 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
+	Server      ServerConfig
+	Database    DatabaseConfig
+	LastFM      LastFMConfig
+	MusicBrainz MusicBrainzConfig
 }
 
 type ServerConfig struct {
@@ -24,6 +26,17 @@ type DatabaseConfig struct {
 	Name     string
 }
 
+// Used for looking up tags; tag imports from Last.fm are off without it
+type LastFMConfig struct {
+	ApiKey string `toml:"api_key"`
+}
+
+// MusicBrainz asks clients to give a way to contact them, a URL or an
+// email address, in the User-Agent
+type MusicBrainzConfig struct {
+	Contact string
+}
+
 var cfg *Config
 
 func LoadConfig() (*Config, error) {
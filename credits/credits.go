@@ -0,0 +1,187 @@
+package credits
+
+// Splits the artist credit of a scrobble into the artists it names. Credits
+// are split on commas, semicolons, "&", "x", "vs." and "feat.", and
+// featured artists in the title like "Song (feat. X)" are credited too.
+// Names on the exception list are never split.
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Artists whose names contain a separator, known to every parser
+var DefaultExceptions = []string{
+	"Above & Beyond",
+	"Belle & Sebastian",
+	"Blood, Sweat & Tears",
+	"Brooks & Dunn",
+	"Chase & Status",
+	"Crosby, Stills & Nash",
+	"Crosby, Stills, Nash & Young",
+	"Daryl Hall & John Oates",
+	"Earth, Wind & Fire",
+	"Emerson, Lake & Palmer",
+	"Hall & Oates",
+	"Iron & Wine",
+	"Mumford & Sons",
+	"Peter, Paul and Mary",
+	"Sam & Dave",
+	"Simon & Garfunkel",
+	"Tyler, The Creator",
+	"Years & Years",
+}
+
+// "x" only separates in lowercase, so names like "Malcolm X" are kept
+const separatorPattern = `\s*(?:[,;]|\s&\s|\s(?i:feat\.?|ft\.?|featuring|vs\.?)\s|\sx\s)\s*`
+
+var (
+	separator = regexp.MustCompile(separatorPattern)
+	// An exception is only protected where it is a whole name, between
+	// separators or the ends of the credit
+	separatorBefore = regexp.MustCompile(`(?:` + separatorPattern + `)$`)
+	separatorAfter  = regexp.MustCompile(`^(?:` + separatorPattern + `)`)
+	// Featured artists in brackets, or after the title without them
+	featuredBracket = regexp.MustCompile(`(?i)[(\[](?:feat\.?|ft\.?|featuring|with)\s+([^)\]]+)[)\]]`)
+	featuredTrail   = regexp.MustCompile(`(?i)\s(?:feat\.?|ft\.?|featuring)\s+([^(\[]+?)\s*(?:[(\[].*)?$`)
+)
+
+type Parser struct {
+	// Case insensitive matches of the exceptions, longest first so a name
+	// containing another is protected whole
+	exceptions []*regexp.Regexp
+}
+
+// Returns a parser that never splits the default exceptions or the given
+// names
+func NewParser(exceptions []string) *Parser {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string{}, DefaultExceptions...), exceptions...) {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	p := &Parser{}
+	for _, name := range names {
+		p.exceptions = append(p.exceptions, regexp.MustCompile("(?i)"+regexp.QuoteMeta(name)))
+	}
+	return p
+}
+
+// Returns the artists named in an artist credit, in order
+func (p *Parser) SplitArtists(artist string) []string {
+	artist = strings.TrimSpace(artist)
+	if artist == "" {
+		return nil
+	}
+
+	// Exceptions are swapped for placeholders while splitting and put back
+	// as they were written in the credit
+	var protected []string
+	for _, re := range p.exceptions {
+		var b strings.Builder
+		last := 0
+		for _, m := range re.FindAllStringIndex(artist, -1) {
+			if !wholeName(artist[:m[0]], artist[m[1]:]) {
+				continue
+			}
+			protected = append(protected, artist[m[0]:m[1]])
+			b.WriteString(artist[last:m[0]])
+			b.WriteString(placeholder(len(protected) - 1))
+			last = m[1]
+		}
+		b.WriteString(artist[last:])
+		artist = b.String()
+	}
+
+	var names []string
+	start := 0
+	for _, m := range separator.FindAllStringIndex(artist, -1) {
+		if keepsName(artist[m[0]:m[1]], artist[m[1]:]) {
+			continue
+		}
+		names = appendName(names, artist[start:m[0]])
+		start = m[1]
+	}
+	names = appendName(names, artist[start:])
+
+	for i, name := range names {
+		for j, original := range protected {
+			name = strings.ReplaceAll(name, placeholder(j), original)
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// Reports whether a match with the given text around it stands alone, so
+// "Sam & Dave" is not protected inside "Sam & Daveed Diggs"
+func wholeName(before, after string) bool {
+	return (before == "" || separatorBefore.MatchString(before)) &&
+		(after == "" || separatorAfter.MatchString(after))
+}
+
+func placeholder(i int) string {
+	return "\x00" + strconv.Itoa(i) + "\x00"
+}
+
+// A comma or "&" before "the" is part of a band name, as in "Tyler, the
+// Creator" or "Nick Cave & The Bad Seeds". Only "& The" is taken that way
+// with a capital, since "Drake, The Weeknd" names two artists; capitalized
+// names like "Tyler, The Creator" are on the exception list instead.
+func keepsName(sep, rest string) bool {
+	sep = strings.TrimSpace(sep)
+	if sep == "&" {
+		return len(rest) > 4 && strings.EqualFold(rest[:4], "the ")
+	}
+	return sep == "," && strings.HasPrefix(rest, "the ")
+}
+
+func appendName(names []string, name string) []string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return names
+	}
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+// Returns the artists featured in a track title
+func (p *Parser) FeaturedArtists(title string) []string {
+	var names []string
+	for _, m := range featuredBracket.FindAllStringSubmatch(title, -1) {
+		for _, name := range p.SplitArtists(m[1]) {
+			names = appendName(names, name)
+		}
+	}
+	if m := featuredTrail.FindStringSubmatch(title); m != nil {
+		for _, name := range p.SplitArtists(m[1]) {
+			names = appendName(names, name)
+		}
+	}
+	return names
+}
+
+// Returns every artist credited on a scrobble, the ones in the artist credit
+// first and then the ones featured in the title
+func (p *Parser) Credits(artist, title string) []string {
+	names := p.SplitArtists(artist)
+	for _, name := range p.FeaturedArtists(title) {
+		names = appendName(names, name)
+	}
+	return names
+}
@@ -0,0 +1,66 @@
+package credits
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitArtists(t *testing.T) {
+	p := NewParser([]string{"Sly & Robbie"})
+	tests := []struct {
+		credit string
+		want   []string
+	}{
+		{"", nil},
+		{"Radiohead", []string{"Radiohead"}},
+		{"Drake, Future", []string{"Drake", "Future"}},
+		{"Drake; Future", []string{"Drake", "Future"}},
+		{"Drake & Future", []string{"Drake", "Future"}},
+		{"Drake feat. Future", []string{"Drake", "Future"}},
+		{"Drake Ft Future", []string{"Drake", "Future"}},
+		{"Drake featuring Future", []string{"Drake", "Future"}},
+		{"Drake vs. Future", []string{"Drake", "Future"}},
+		{"Drake x Future", []string{"Drake", "Future"}},
+		{"Drake, drake", []string{"Drake"}},
+		{"Malcolm X", []string{"Malcolm X"}},
+		{"Drake, The Weeknd", []string{"Drake", "The Weeknd"}},
+		{"Tyler, the Creator", []string{"Tyler, the Creator"}},
+		{"Tyler, The Creator", []string{"Tyler, The Creator"}},
+		{"Tyler, The Creator, Kali Uchis", []string{"Tyler, The Creator", "Kali Uchis"}},
+		{"Nick Cave & The Bad Seeds", []string{"Nick Cave & The Bad Seeds"}},
+		{"Simon & Garfunkel", []string{"Simon & Garfunkel"}},
+		{"simon & garfunkel", []string{"simon & garfunkel"}},
+		{"Earth, Wind & Fire feat. The Emotions", []string{"Earth, Wind & Fire", "The Emotions"}},
+		{"Crosby, Stills, Nash & Young", []string{"Crosby, Stills, Nash & Young"}},
+		{"Sam & Dave", []string{"Sam & Dave"}},
+		{"Sam & Daveed Diggs", []string{"Sam", "Daveed Diggs"}},
+		{"Sam & Dave x Sly & Robbie", []string{"Sam & Dave", "Sly & Robbie"}},
+		{"Big Sam & Dave", []string{"Big Sam", "Dave"}},
+	}
+	for _, tt := range tests {
+		if got := p.SplitArtists(tt.credit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitArtists(%q) = %q, want %q", tt.credit, got, tt.want)
+		}
+	}
+}
+
+func TestCredits(t *testing.T) {
+	p := NewParser(nil)
+	tests := []struct {
+		artist, title string
+		want          []string
+	}{
+		{"Drake", "Song", []string{"Drake"}},
+		{"Drake", "Song (feat. Future)", []string{"Drake", "Future"}},
+		{"Drake", "Song [ft. Future & Rihanna]", []string{"Drake", "Future", "Rihanna"}},
+		{"Drake", "Song (with Future) [Remix]", []string{"Drake", "Future"}},
+		{"Drake", "Song feat. Future (Remix)", []string{"Drake", "Future"}},
+		{"Drake & Future", "Song (feat. Future)", []string{"Drake", "Future"}},
+		{"Drake", "Song (feat. Simon & Garfunkel)", []string{"Drake", "Simon & Garfunkel"}},
+	}
+	for _, tt := range tests {
+		if got := p.Credits(tt.artist, tt.title); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Credits(%q, %q) = %q, want %q", tt.artist, tt.title, got, tt.want)
+		}
+	}
+}
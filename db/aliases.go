@@ -0,0 +1,242 @@
+package db
+
+// Alternate names of artists, albums and songs. A scrobble naming an alias
+// is counted for the entity it belongs to, so spellings like "Beyonce" and
+// "Beyoncé" stay one artist, and artist aliases in its credit are written as
+// the artist's name. Album and song aliases only apply to scrobbles
+// of the same artist. Aliases match regardless of case.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"muzi/credits"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Alias struct {
+	Id   int
+	Name string
+}
+
+// Table and name column of each entity type
+var entityTables = map[string][2]string{
+	EntityArtist: {"artists", "name"},
+	EntityAlbum:  {"albums", "title"},
+	EntitySong:   {"songs", "title"},
+}
+
+func CreateAliasesTable() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS entity_aliases (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			entity_type TEXT NOT NULL,
+			entity_id INTEGER NOT NULL,
+			name TEXT NOT NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_entity_aliases_name ON entity_aliases(entity_type, entity_id, lower(name));
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_entity_aliases_artist ON entity_aliases(user_id, lower(name)) WHERE entity_type = 'artist';
+		CREATE INDEX IF NOT EXISTS idx_entity_aliases_lookup ON entity_aliases(user_id, entity_type, lower(name));
+		CREATE INDEX IF NOT EXISTS idx_entity_aliases_trgm ON entity_aliases USING gin(name gin_trgm_ops);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating entity_aliases table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Returns the artist with the alias, if any
+func getArtistIdByAlias(q querier, userId int, name string) (int, error) {
+	var id int
+	err := q.QueryRow(context.Background(),
+		`SELECT entity_id FROM entity_aliases
+		WHERE user_id = $1 AND entity_type = 'artist' AND lower(name) = lower($2)`,
+		userId, name).Scan(&id)
+	return id, err
+}
+
+// Returns the album or song of the artist with the alias, if any
+func getIdByAlias(q querier, userId int, entityType, name string, artistId int) (int, error) {
+	var id int
+	err := q.QueryRow(context.Background(),
+		fmt.Sprintf(`SELECT a.entity_id FROM entity_aliases a
+		JOIN %s e ON e.id = a.entity_id
+		WHERE a.user_id = $1 AND a.entity_type = $2 AND lower(a.name) = lower($3)
+			AND e.artist_id IS NOT DISTINCT FROM NULLIF($4, 0)
+		ORDER BY a.id LIMIT 1`, entityTables[entityType][0]),
+		userId, entityType, name, artistId).Scan(&id)
+	return id, err
+}
+
+// Returns the artist an alias belongs to
+func GetArtistByAlias(userId int, name string) (Artist, error) {
+	id, err := getArtistIdByAlias(Pool, userId, name)
+	if err != nil {
+		return Artist{}, err
+	}
+	return GetArtistById(id)
+}
+
+// Names of the artists of a user by their lowercased aliases
+type ArtistAliases map[string]string
+
+func GetArtistAliases(userId int) (ArtistAliases, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT e.name, a.name FROM entity_aliases e
+		JOIN artists a ON a.id = e.entity_id
+		WHERE e.user_id = $1 AND e.entity_type = 'artist'`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := make(ArtistAliases)
+	for rows.Next() {
+		var alias, name string
+		if err := rows.Scan(&alias, &name); err != nil {
+			return nil, err
+		}
+		aliases[strings.ToLower(alias)] = name
+	}
+	return aliases, rows.Err()
+}
+
+// Rewrites the artists of a credit that are aliases to the names of the
+// artists they belong to, so a new scrobble is stored and checked for
+// duplicates the way a merge would have left it
+func (a ArtistAliases) Canonical(p *credits.Parser, credit string) string {
+	if len(a) == 0 {
+		return credit
+	}
+	for _, name := range p.SplitArtists(credit) {
+		if to, ok := a[strings.ToLower(name)]; ok && to != name {
+			credit = replaceCredit(p, credit, name, to)
+		}
+	}
+	return credit
+}
+
+func GetAliases(entityType string, entityId int) ([]Alias, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, name FROM entity_aliases
+		WHERE entity_type = $1 AND entity_id = $2 ORDER BY lower(name)`,
+		entityType, entityId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[Alias])
+}
+
+// Adds an alias to the entity. An existing artist, album or song already
+// named like the alias would never be matched by it, so it is merged into
+// the entity first.
+func AddAlias(userId int, entityType string, entityId int, name string) (MergeResult, error) {
+	return runMerge(userId, true, func(m *merger) error {
+		table, column := entityTables[entityType][0], entityTables[entityType][1]
+		var own string
+		err := m.tx.QueryRow(m.ctx,
+			fmt.Sprintf(`SELECT %s FROM %s WHERE id = $1 AND user_id = $2`, column, table),
+			entityId, m.userId).Scan(&own)
+		if err != nil {
+			return err
+		}
+		if own == name {
+			return nil
+		}
+
+		sameArtist := ""
+		if entityType != EntityArtist {
+			sameArtist = fmt.Sprintf(" AND artist_id IS NOT DISTINCT FROM (SELECT artist_id FROM %s WHERE id = $3)", table)
+		}
+		rows, err := m.tx.Query(m.ctx,
+			fmt.Sprintf(`SELECT id FROM %s WHERE user_id = $1 AND lower(%s) = lower($2) AND id != $3%s`,
+				table, column, sameArtist),
+			m.userId, name, entityId)
+		if err != nil {
+			return err
+		}
+		named, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return err
+		}
+		for _, id := range named {
+			if err := m.merge(entityType, id, entityId); err != nil {
+				return err
+			}
+		}
+		return m.storeAlias(entityType, entityId, name)
+	})
+}
+
+func DeleteAlias(userId, id int) error {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM entity_aliases WHERE user_id = $1 AND id = $2`,
+		userId, id)
+	return err
+}
+
+// Stores an alias, taking it from any other entity of the same kind it
+// could be confused with
+func (m *merger) storeAlias(entityType string, entityId int, name string) error {
+	sameArtist := ""
+	if entityType != EntityArtist {
+		sameArtist = fmt.Sprintf(` AND entity_id IN (SELECT id FROM %[1]s
+			WHERE artist_id IS NOT DISTINCT FROM (SELECT artist_id FROM %[1]s WHERE id = $3))`,
+			entityTables[entityType][0])
+	}
+	_, err := m.tx.Exec(m.ctx,
+		`DELETE FROM entity_aliases WHERE user_id = $1 AND entity_type = $2
+			AND lower(name) = lower($4) AND entity_id != $3`+sameArtist,
+		m.userId, entityType, entityId, name)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`INSERT INTO entity_aliases (user_id, entity_type, entity_id, name)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`,
+		m.userId, entityType, entityId, name)
+	return err
+}
+
+// Moves the aliases of a merged entity to the one it is merged into, and
+// keeps the merged entity's name as an alias too
+func (m *merger) moveAliases(entityType string, fromId, toId int, from, to string) error {
+	_, err := m.tx.Exec(m.ctx,
+		`DELETE FROM entity_aliases f WHERE entity_type = $1 AND entity_id = $2
+			AND EXISTS (
+				SELECT 1 FROM entity_aliases t
+				WHERE t.entity_type = $1 AND t.entity_id = $3 AND lower(t.name) = lower(f.name)
+			)`,
+		entityType, fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE entity_aliases SET entity_id = $3 WHERE entity_type = $1 AND entity_id = $2`,
+		entityType, fromId, toId)
+	if err != nil || from == to {
+		return err
+	}
+	return m.storeAlias(entityType, toId, from)
+}
+
+// Condition matching the entities with id column idColumn whose aliases
+// match the search $2, or the pattern $3
+func aliasMatch(entityType, idColumn string) string {
+	return fmt.Sprintf(`%s IN (SELECT entity_id FROM entity_aliases
+		WHERE user_id = $1 AND entity_type = '%s' AND (similarity(name, $2) > 0.1 OR LOWER(name) LIKE LOWER($3)))`,
+		idColumn, entityType)
+}
+
+// Best similarity of the search $2 to the aliases of the entity with id
+// column idColumn, 0 without aliases
+func aliasSimilarity(entityType, idColumn string) string {
+	return fmt.Sprintf(`COALESCE((SELECT MAX(similarity(name, $2)) FROM entity_aliases
+		WHERE entity_type = '%s' AND entity_id = %s), 0)`,
+		entityType, idColumn)
+}
@@ -0,0 +1,284 @@
+package db
+
+// Rewriting the artist, title or album of a selection of history rows. The
+// rows are re-linked to the artist, album and song entities of their new
+// names and the daily rollups are rebuilt in the same transaction.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Returned when an edited row would end up the same as another scrobble
+// played at the same time
+var ErrEditConflict = errors.New("the edit would duplicate an existing scrobble")
+
+// New values for the edited rows, empty fields are left as they are
+type HistoryEdit struct {
+	Artist   string
+	SongName string
+	Album    string
+}
+
+func (e HistoryEdit) IsEmpty() bool {
+	return e.Artist == "" && e.SongName == "" && e.Album == ""
+}
+
+// A row the edit changes, with its values before and after
+type HistoryEditChange struct {
+	Id        int
+	Timestamp time.Time
+	OldArtist string
+	OldSong   string
+	OldAlbum  string
+	NewArtist string
+	NewSong   string
+	NewAlbum  string
+}
+
+// Returns the ids of every play matching the filter, ignoring its limit and
+// offset
+func GetHistoryIds(f Filter) ([]int, error) {
+	q := &queryArgs{}
+	rows, err := Pool.Query(context.Background(),
+		`SELECT h.id FROM history h WHERE `+f.historyWhere(q)+` ORDER BY `+f.historyOrder(),
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+type editedRow struct {
+	HistoryEditChange
+	artistId    int
+	artistIds   []int
+	albumArtist string
+}
+
+func changesOf(rows []editedRow) []HistoryEditChange {
+	changes := make([]HistoryEditChange, len(rows))
+	for i, r := range rows {
+		changes[i] = r.HistoryEditChange
+	}
+	return changes
+}
+
+// Returns the new artist, title and album of a history row
+type historyRewrite func(id int, artist, song, album string) (string, string, string)
+
+// Returns a rewrite going by the names of the rows alone
+func byNames(rewrite func(artist, song, album string) (string, string, string)) historyRewrite {
+	return func(_ int, artist, song, album string) (string, string, string) {
+		return rewrite(artist, song, album)
+	}
+}
+
+// Returns the rows among ids, or all of the user's rows when ids is nil,
+// that rewrite changes
+func selectEditedRows(ctx context.Context, q querier, userId int, ids []int,
+	rewrite historyRewrite, lock bool,
+) ([]editedRow, error) {
+	sql := `SELECT id, timestamp, artist, song_name, COALESCE(album_name, ''),
+			COALESCE(artist_id, 0), COALESCE(artist_ids, '{}'), COALESCE(album_artist, '')
+		FROM history WHERE user_id = $1 AND deleted_at IS NULL AND ($2::int[] IS NULL OR id = ANY($2))
+		ORDER BY timestamp DESC, id DESC`
+	if lock {
+		sql += " FOR UPDATE"
+	}
+	rows, err := q.Query(ctx, sql, userId, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changed []editedRow
+	for rows.Next() {
+		var r editedRow
+		err := rows.Scan(&r.Id, &r.Timestamp, &r.OldArtist, &r.OldSong, &r.OldAlbum, &r.artistId, &r.artistIds, &r.albumArtist)
+		if err != nil {
+			return nil, err
+		}
+		r.NewArtist, r.NewSong, r.NewAlbum = rewrite(r.Id, r.OldArtist, r.OldSong, r.OldAlbum)
+		if r.NewArtist != r.OldArtist || r.NewSong != r.OldSong || r.NewAlbum != r.OldAlbum {
+			changed = append(changed, r)
+		}
+	}
+	return changed, rows.Err()
+}
+
+// Returns a rewrite setting the fields of the edit that aren't empty
+func (e HistoryEdit) rewrite(artist, song, album string) (string, string, string) {
+	if e.Artist != "" {
+		artist = e.Artist
+	}
+	if e.SongName != "" {
+		song = e.SongName
+	}
+	if e.Album != "" {
+		album = e.Album
+	}
+	return artist, song, album
+}
+
+// Describes the edit for the change log
+func (e HistoryEdit) String() string {
+	var set []string
+	if e.Artist != "" {
+		set = append(set, "artist to "+e.Artist)
+	}
+	if e.SongName != "" {
+		set = append(set, "title to "+e.SongName)
+	}
+	if e.Album != "" {
+		set = append(set, "album to "+e.Album)
+	}
+	return "Set " + strings.Join(set, ", ")
+}
+
+// Returns the rows among ids that the edit would change
+func PreviewHistoryEdit(userId int, ids []int, edit HistoryEdit) ([]HistoryEditChange, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rows, err := selectEditedRows(context.Background(), Pool, userId, ids, byNames(edit.rewrite), false)
+	if err != nil {
+		return nil, err
+	}
+	return changesOf(rows), nil
+}
+
+// Applies the edit to the rows among ids in one transaction and returns how
+// many were changed
+func ApplyHistoryEdit(userId int, ids []int, edit HistoryEdit) (int, error) {
+	if edit.IsEmpty() || len(ids) == 0 {
+		return 0, nil
+	}
+	return applyHistoryRewrite(userId, ids, byNames(edit.rewrite), edit.String())
+}
+
+// Rewrites the rows among ids, or all of the user's rows when ids is nil,
+// in one transaction, logs the change with its summary and returns how
+// many rows changed
+func applyHistoryRewrite(userId int, ids []int, rewrite historyRewrite, summary string) (int, error) {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := rewriteHistory(ctx, tx, userId, ids, rewrite)
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	if err := logHistoryEdit(ctx, tx, userId, summary, rows, 0); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// Rewrites the rows among ids, or all of the user's rows when ids is nil,
+// and links them to the entities of their new names. Rows keep their
+// artists unless the artist or title changes, in which case they are
+// credited again. Returns the rows changed.
+func rewriteHistory(ctx context.Context, tx pgx.Tx, userId int, ids []int, rewrite historyRewrite) ([]editedRow, error) {
+	parser, err := GetCreditParser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := selectEditedRows(ctx, tx, userId, ids, rewrite, true)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+
+	// Rows ending up with the same names share their artists, album and
+	// song, so they are only resolved once
+	type target struct {
+		artists     string
+		song        string
+		album       string
+		albumArtist string
+	}
+	artistIds := make(map[string][]int)
+	songIds := make(map[target]int)
+	minTs, maxTs := rows[0].Timestamp, rows[0].Timestamp
+	for _, r := range rows {
+		credited, primary := r.artistIds, r.artistId
+		if r.NewArtist != r.OldArtist || r.NewSong != r.OldSong {
+			credit := r.NewArtist + "\x00" + r.NewSong
+			ids, ok := artistIds[credit]
+			if !ok {
+				for _, name := range parser.Credits(r.NewArtist, r.NewSong) {
+					id, _, err := getOrCreateArtist(tx, userId, name)
+					if err != nil {
+						return nil, err
+					}
+					ids = append(ids, id)
+				}
+				artistIds[credit] = ids
+			}
+			credited, primary = ids, 0
+			if len(ids) > 0 {
+				primary = ids[0]
+			}
+		}
+
+		key := target{fmt.Sprint(credited), r.NewSong, r.NewAlbum, r.albumArtist}
+		songId, ok := songIds[key]
+		if !ok {
+			albumArtistId, err := getAlbumArtistId(tx, userId, parser, r.albumArtist, r.NewArtist, primary)
+			if err != nil {
+				return nil, err
+			}
+			albumId, _, err := getOrCreateAlbum(tx, userId, r.NewAlbum, albumArtistId)
+			if err != nil {
+				return nil, err
+			}
+			songId, _, err = getOrCreateSong(tx, userId, r.NewSong, primary, albumId)
+			if err != nil {
+				return nil, err
+			}
+			songIds[key] = songId
+		}
+
+		_, err := tx.Exec(ctx,
+			`UPDATE history SET artist = $1, song_name = $2, album_name = NULLIF($3, ''),
+				artist_id = NULLIF($4, 0), song_id = NULLIF($5, 0), artist_ids = $6
+			WHERE id = $7`,
+			r.NewArtist, r.NewSong, r.NewAlbum, primary, songId, credited, r.Id)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return nil, fmt.Errorf("%w: %s - %s at %s", ErrEditConflict,
+					r.NewArtist, r.NewSong, r.Timestamp.Format(time.DateTime))
+			}
+			return nil, err
+		}
+
+		if r.Timestamp.Before(minTs) {
+			minTs = r.Timestamp
+		}
+		if r.Timestamp.After(maxTs) {
+			maxTs = r.Timestamp
+		}
+	}
+
+	if err := refreshDailyRollups(tx, userId, minTs, maxTs); err != nil {
+		return nil, err
+	}
+	if err := invalidateChartWeeks(tx, userId, minTs, maxTs); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
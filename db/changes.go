@@ -0,0 +1,377 @@
+package db
+
+// An append-only log of the edits users make to their artists, albums, songs
+// and scrobbles, and of the scrobbles they delete. Each change keeps the
+// values before and after it as JSON so it can be undone, and undoing a
+// change is logged as a change of its own.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// An artist, album or song row, before and after
+	ChangeEntityEdit = "entity_edit"
+	// A list of scrobbles with their names, before and after
+	ChangeHistoryEdit = "history_edit"
+	// The history rows deleted, and restored when undone
+	ChangeHistoryDelete = "history_delete"
+)
+
+// Changes listed on the changes page
+const changeLogLimit = 100
+
+var (
+	ErrChangeUndone = errors.New("the change was already undone")
+	ErrChangedSince = errors.New("the values were changed again since")
+)
+
+type ChangedField struct {
+	Name   string
+	Before string
+	After  string
+}
+
+type Change struct {
+	Id         int
+	CreatedAt  time.Time
+	Kind       string
+	EntityType string
+	EntityId   int
+	// Name of the edited entity, or what a history edit set
+	Summary string
+	// Scrobbles edited, deleted or restored
+	Scrobbles int
+	// Fields an entity edit changed
+	Fields []ChangedField
+	// Id of the change this one undid
+	Undoes int
+	Undone bool
+}
+
+func CreateChangeLogTable() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS change_log (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			kind TEXT NOT NULL,
+			entity_type TEXT NOT NULL DEFAULT '',
+			entity_id INTEGER NOT NULL DEFAULT 0,
+			summary TEXT NOT NULL DEFAULT '',
+			before JSONB NOT NULL,
+			after JSONB NOT NULL,
+			undoes INTEGER REFERENCES change_log(id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_change_log_user ON change_log(user_id, id DESC);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_change_log_undoes ON change_log(undoes);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating change_log table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// A scrobble as a history edit logs it
+type loggedScrobble struct {
+	Id       int    `json:"id"`
+	Artist   string `json:"artist"`
+	SongName string `json:"song_name"`
+	Album    string `json:"album_name"`
+}
+
+func logChange(ctx context.Context, q querier, userId int, kind, summary string, before, after any, undoes int) error {
+	_, err := q.Exec(ctx,
+		`INSERT INTO change_log (user_id, kind, summary, before, after, undoes)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))`,
+		userId, kind, summary, before, after, undoes)
+	return err
+}
+
+// Logs the rows a history rewrite changed
+func logHistoryEdit(ctx context.Context, q querier, userId int, summary string, rows []editedRow, undoes int) error {
+	before := make([]loggedScrobble, len(rows))
+	after := make([]loggedScrobble, len(rows))
+	for i, r := range rows {
+		before[i] = loggedScrobble{r.Id, r.OldArtist, r.OldSong, r.OldAlbum}
+		after[i] = loggedScrobble{r.Id, r.NewArtist, r.NewSong, r.NewAlbum}
+	}
+	return logChange(ctx, q, userId, ChangeHistoryEdit, summary, before, after, undoes)
+}
+
+// Updates one artist, album or song with a SET clause and logs the change
+// when it changed anything. The SET clause takes its values from $6 on.
+func updateEntity(q querier, userId int, entityType string, id, undoes int, set string, args ...any) error {
+	table := entityTables[entityType][0]
+	var renamed bool
+	err := q.QueryRow(context.Background(),
+		fmt.Sprintf(`WITH old AS (
+			SELECT to_jsonb(e) AS row FROM %[1]s e WHERE e.id = $1
+		),
+		updated AS (
+			UPDATE %[1]s SET %[2]s WHERE id = $1 RETURNING to_jsonb(%[1]s) AS row
+		)
+		INSERT INTO change_log (user_id, kind, entity_type, entity_id, summary, before, after, undoes)
+		SELECT $2::int, $3::text, $4::text, $1, COALESCE(updated.row->>'name', updated.row->>'title', ''), old.row, updated.row, NULLIF($5, 0)
+		FROM old, updated
+		WHERE old.row != updated.row
+		RETURNING before->>'name' IS DISTINCT FROM after->>'name'`, table, set),
+		append([]any{id, userId, ChangeEntityEdit, entityType, undoes}, args...)...).Scan(&renamed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil || !renamed {
+		return err
+	}
+	// Artist charts store the artist's name
+	return invalidateArtistChartWeeks(q, userId, id)
+}
+
+// Returns the fields that differ between two rows logged as JSON, by name
+func changedFields(before, after map[string]any) []string {
+	var names []string
+	for name, value := range after {
+		if !reflect.DeepEqual(before[name], value) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fieldString(value any) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// Returns the user's latest changes, newest first
+func GetChanges(userId int) ([]Change, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT c.id, c.created_at, c.kind, c.entity_type, c.entity_id, c.summary,
+			CASE WHEN c.kind = $2 THEN 0
+				ELSE GREATEST(jsonb_array_length(c.before), jsonb_array_length(c.after)) END,
+			CASE WHEN c.kind = $2 THEN c.before END,
+			CASE WHEN c.kind = $2 THEN c.after END,
+			COALESCE(c.undoes, 0),
+			EXISTS (SELECT 1 FROM change_log u WHERE u.undoes = c.id)
+		FROM change_log c
+		WHERE c.user_id = $1
+		ORDER BY c.id DESC
+		LIMIT $3`,
+		userId, ChangeEntityEdit, changeLogLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var c Change
+		var before, after map[string]any
+		err := rows.Scan(&c.Id, &c.CreatedAt, &c.Kind, &c.EntityType, &c.EntityId, &c.Summary,
+			&c.Scrobbles, &before, &after, &c.Undoes, &c.Undone)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range changedFields(before, after) {
+			c.Fields = append(c.Fields, ChangedField{
+				Name:   strings.ReplaceAll(name, "_", " "),
+				Before: fieldString(before[name]),
+				After:  fieldString(after[name]),
+			})
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// Puts back the values a change replaced and the scrobbles it deleted. An
+// entity edit is only undone when the fields it changed still hold its
+// values, and a history edit leaves out scrobbles edited or deleted since.
+func UndoChange(userId, id int) error {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var kind, entityType string
+	var entityId, undoes int
+	var undone bool
+	err = tx.QueryRow(ctx,
+		`SELECT kind, entity_type, entity_id, COALESCE(undoes, 0),
+			EXISTS (SELECT 1 FROM change_log u WHERE u.undoes = c.id)
+		FROM change_log c WHERE id = $1 AND user_id = $2
+		FOR UPDATE`,
+		id, userId).Scan(&kind, &entityType, &entityId, &undoes, &undone)
+	if err != nil {
+		return err
+	}
+	if undone || undoes != 0 {
+		return ErrChangeUndone
+	}
+
+	switch kind {
+	case ChangeEntityEdit:
+		err = undoEntityEdit(ctx, tx, userId, id, entityType, entityId)
+	case ChangeHistoryEdit:
+		err = undoHistoryEdit(ctx, tx, userId, id)
+	case ChangeHistoryDelete:
+		err = undoHistoryDelete(ctx, tx, userId, id)
+	default:
+		err = fmt.Errorf("unknown change kind: %s", kind)
+	}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrEditConflict
+		}
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func undoEntityEdit(ctx context.Context, tx pgx.Tx, userId, id int, entityType string, entityId int) error {
+	table, ok := entityTables[entityType]
+	if !ok {
+		return fmt.Errorf("unknown entity type: %s", entityType)
+	}
+
+	var before, after, current map[string]any
+	err := tx.QueryRow(ctx, `SELECT before, after FROM change_log WHERE id = $1`, id).Scan(&before, &after)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(ctx,
+		fmt.Sprintf(`SELECT to_jsonb(e) FROM %s e WHERE id = $1 AND user_id = $2 FOR UPDATE`, table[0]),
+		entityId, userId).Scan(&current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrChangedSince
+	}
+	if err != nil {
+		return err
+	}
+
+	names := changedFields(before, after)
+	columns := make([]string, len(names))
+	for i, name := range names {
+		if !reflect.DeepEqual(current[name], after[name]) {
+			return ErrChangedSince
+		}
+		columns[i] = pgx.Identifier{name}.Sanitize()
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	list := strings.Join(columns, ", ")
+	err = updateEntity(tx, userId, entityType, entityId, id,
+		fmt.Sprintf("(%s) = (SELECT %s FROM jsonb_populate_record(NULL::%s, $6) r)",
+			list, "r."+strings.Join(columns, ", r."), table[0]),
+		before)
+	if err != nil {
+		return err
+	}
+	if entityType == EntitySong {
+		return syncSongTitle(tx, entityId)
+	}
+	return nil
+}
+
+func undoHistoryEdit(ctx context.Context, tx pgx.Tx, userId, id int) error {
+	var before, after []loggedScrobble
+	err := tx.QueryRow(ctx, `SELECT before, after FROM change_log WHERE id = $1`, id).Scan(&before, &after)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, len(after))
+	restore := make(map[int][2]loggedScrobble, len(after))
+	for i, a := range after {
+		ids[i] = a.Id
+		restore[a.Id] = [2]loggedScrobble{a, before[i]}
+	}
+	rows, err := rewriteHistory(ctx, tx, userId, ids, func(id int, artist, song, album string) (string, string, string) {
+		r := restore[id]
+		if artist != r[0].Artist || song != r[0].SongName || album != r[0].Album {
+			return artist, song, album
+		}
+		return r[1].Artist, r[1].SongName, r[1].Album
+	})
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return ErrChangedSince
+	}
+	return logHistoryEdit(ctx, tx, userId, "", rows, id)
+}
+
+// Returns the columns of a history row kept as JSON by to_jsonb, given the
+// expression of the JSON, to insert it again. Links to artists and songs
+// merged or deleted since are left out.
+func restoredHistory(row string) string {
+	return fmt.Sprintf(`(jsonb_populate_record(NULL::history, %[1]s || jsonb_build_object(
+		'artist_id', CASE WHEN EXISTS (SELECT 1 FROM artists WHERE id = (%[1]s->>'artist_id')::int) THEN %[1]s->'artist_id' END,
+		'song_id', CASE WHEN EXISTS (SELECT 1 FROM songs WHERE id = (%[1]s->>'song_id')::int) THEN %[1]s->'song_id' END,
+		'artist_ids', (
+			SELECT COALESCE(jsonb_agg(a.id ORDER BY a.n), '[]')
+			FROM jsonb_array_elements(COALESCE(%[1]s->'artist_ids', '[]')) WITH ORDINALITY AS a(id, n)
+			WHERE EXISTS (SELECT 1 FROM artists WHERE id = a.id::text::int)
+		)
+	))).*`, row)
+}
+
+func undoHistoryDelete(ctx context.Context, tx pgx.Tx, userId, id int) error {
+	// Scrobbles still in the trash are taken out of it, and the ones purged
+	// since are inserted again
+	var n int
+	var first, last *time.Time
+	err := tx.QueryRow(ctx,
+		`WITH deleted AS (
+			SELECT r.row FROM change_log c CROSS JOIN jsonb_array_elements(c.before) AS r(row)
+			WHERE c.id = $1
+		),
+		untrashed AS (
+			UPDATE history h SET deleted_at = NULL FROM deleted d
+			WHERE h.user_id = $2 AND h.id = (d.row->>'id')::int AND h.deleted_at IS NOT NULL
+			RETURNING h.*
+		),
+		reinserted AS (
+			INSERT INTO history
+			SELECT `+restoredHistory("(d.row - 'deleted_at')")+`
+			FROM deleted d
+			WHERE NOT EXISTS (SELECT 1 FROM history h WHERE h.id = (d.row->>'id')::int)
+			ON CONFLICT DO NOTHING
+			RETURNING *
+		),
+		restored AS (
+			SELECT * FROM untrashed UNION ALL SELECT * FROM reinserted
+		),
+		logged AS (
+			INSERT INTO change_log (user_id, kind, summary, before, after, undoes)
+			SELECT $2::int, $3::text, '', '[]', COALESCE(jsonb_agg(to_jsonb(restored)), '[]'), $1 FROM restored
+		)
+		SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM restored`,
+		id, userId, ChangeHistoryDelete).Scan(&n, &first, &last)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrChangedSince
+	}
+	return refreshDailyRollups(tx, userId, *first, *last)
+}
@@ -0,0 +1,317 @@
+package db
+
+// Weekly chart snapshots. Every Sunday to Saturday week of a user's history
+// is ranked once and stored, so chart runs and rank movement can be read
+// without re-counting history.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	ChartArtist = "artist"
+	ChartAlbum  = "album"
+	ChartTrack  = "track"
+)
+
+// Number of entries stored per chart per week
+const chartSize = 50
+
+// How often the background job looks for weeks that need a new snapshot
+const chartUpdateInterval = time.Hour
+
+// Start of the Sunday based week containing the timestamp. date_trunc
+// weeks start on Monday, so shift by a day on the way in and out.
+const chartWeekExpr = "(date_trunc('week', %s + interval '1 day') - interval '1 day')::date"
+
+type ChartRun struct {
+	Weeks        int       `json:"weeks"`
+	PeakRank     int       `json:"peak_rank"`
+	PeakWeek     time.Time `json:"peak_week"`
+	WeeksAtOne   int       `json:"weeks_at_one"`
+	WeeksInTop10 int       `json:"weeks_in_top_10"`
+	FirstWeek    time.Time `json:"first_week"`
+	LastWeek     time.Time `json:"last_week"`
+}
+
+type ChartMovement struct {
+	Rank     int
+	PrevRank int
+	Status   string
+}
+
+// Movement of every entry on the latest weekly chart, keyed by name and artist
+type ChartMovements map[string]ChartMovement
+
+func chartKey(name, artist string) string {
+	return name + "\x00" + artist
+}
+
+// Returns the movement for an entry, or an empty movement if it did not
+// chart last week
+func (m ChartMovements) Get(name, artist string) ChartMovement {
+	return m[chartKey(name, artist)]
+}
+
+func CreateWeeklyChartsTable() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS weekly_charts (
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			week_start DATE NOT NULL,
+			kind TEXT NOT NULL,
+			rank INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			artist TEXT NOT NULL DEFAULT '',
+			listen_count INTEGER NOT NULL,
+			PRIMARY KEY (user_id, week_start, kind, rank)
+		);
+		CREATE INDEX IF NOT EXISTS idx_weekly_charts_entry ON weekly_charts(user_id, kind, name, artist);
+		CREATE TABLE IF NOT EXISTS weekly_chart_weeks (
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			week_start DATE NOT NULL,
+			scrobbles INTEGER NOT NULL,
+			generated_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (user_id, week_start)
+		);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating weekly_charts table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Ranks one week of history and replaces any stored snapshot for it
+func GenerateWeeklyChart(userId int, weekStart time.Time) error {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		"DELETE FROM weekly_charts WHERE user_id = $1 AND week_start = $2::date",
+		userId, weekStart)
+	if err != nil {
+		return err
+	}
+
+	queries := []string{
+		`INSERT INTO weekly_charts (user_id, week_start, kind, rank, name, artist, listen_count)
+		SELECT $1, $2::date, 'artist', ROW_NUMBER() OVER (ORDER BY COUNT(*) DESC, ar.name), ar.name, '', COUNT(*)
+		FROM history h
+		JOIN artists ar ON ar.id = ANY(h.artist_ids)
+		WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND h.timestamp >= $2::date AND h.timestamp < $2::date + 7
+		GROUP BY ar.name
+		ORDER BY 4
+		LIMIT $3`,
+		`INSERT INTO weekly_charts (user_id, week_start, kind, rank, name, artist, listen_count)
+		SELECT $1, $2::date, 'album', ROW_NUMBER() OVER (ORDER BY COUNT(*) DESC, h.album_name, ` + albumArtistColumn + `), h.album_name, ` + albumArtistColumn + `, COUNT(*)
+		FROM history h
+		WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND h.timestamp >= $2::date AND h.timestamp < $2::date + 7
+			AND h.album_name IS NOT NULL AND h.album_name != ''
+		GROUP BY h.album_name, ` + albumArtistColumn + `
+		ORDER BY 4
+		LIMIT $3`,
+		`INSERT INTO weekly_charts (user_id, week_start, kind, rank, name, artist, listen_count)
+		SELECT $1, $2::date, 'track', ROW_NUMBER() OVER (ORDER BY COUNT(*) DESC, song_name, artist), song_name, artist, COUNT(*)
+		FROM history
+		WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL AND timestamp >= $2::date AND timestamp < $2::date + 7
+		GROUP BY song_name, artist
+		ORDER BY 4
+		LIMIT $3`,
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(ctx, q, userId, weekStart, chartSize); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO weekly_chart_weeks (user_id, week_start, scrobbles, generated_at)
+		SELECT $1, $2::date, COUNT(*), NOW()
+		FROM history
+		WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL AND timestamp >= $2::date AND timestamp < $2::date + 7
+		ON CONFLICT (user_id, week_start) DO UPDATE
+		SET scrobbles = EXCLUDED.scrobbles, generated_at = EXCLUDED.generated_at`,
+		userId, weekStart)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Drops the snapshots of the weeks between start and end so they are
+// generated again. Charts store names, which edits change without changing
+// the scrobble counts of the weeks.
+func invalidateChartWeeks(q querier, userId int, start, end time.Time) error {
+	_, err := q.Exec(context.Background(),
+		fmt.Sprintf(`DELETE FROM weekly_chart_weeks
+		WHERE user_id = $1 AND week_start >= %s AND week_start <= %s`,
+			fmt.Sprintf(chartWeekExpr, "$2::timestamptz"), fmt.Sprintf(chartWeekExpr, "$3::timestamptz")),
+		userId, start, end)
+	return err
+}
+
+// Drops the snapshots of the weeks the artist was played in, whose artist
+// charts name it
+func invalidateArtistChartWeeks(q querier, userId, artistId int) error {
+	_, err := q.Exec(context.Background(),
+		fmt.Sprintf(`DELETE FROM weekly_chart_weeks
+		WHERE user_id = $1 AND week_start IN (
+			SELECT DISTINCT %s FROM history h WHERE h.user_id = $1 AND $2 = ANY(h.artist_ids)
+		)`, fmt.Sprintf(chartWeekExpr, "h.timestamp")),
+		userId, artistId)
+	return err
+}
+
+// Generates snapshots for every finished week that has none yet, or whose
+// scrobble count changed since it was generated (imports, deletes). Edits
+// that keep the counts drop the snapshots of the weeks they touch instead.
+// The first run for a user backfills their whole history.
+func UpdateWeeklyCharts(userId int) error {
+	rows, err := Pool.Query(context.Background(),
+		fmt.Sprintf(`SELECT w.week_start FROM (
+			SELECT %s AS week_start, COUNT(*) AS scrobbles
+			FROM history
+			WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL
+			GROUP BY 1
+		) w
+		LEFT JOIN weekly_chart_weeks c ON c.user_id = $1 AND c.week_start = w.week_start
+		WHERE w.week_start < %s
+			AND (c.week_start IS NULL OR c.scrobbles != w.scrobbles)
+		UNION
+		SELECT c.week_start FROM weekly_chart_weeks c
+		WHERE c.user_id = $1 AND c.scrobbles > 0 AND NOT EXISTS (
+			SELECT 1 FROM history h
+			WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND h.timestamp >= c.week_start AND h.timestamp < c.week_start + 7
+		)
+		ORDER BY 1`, fmt.Sprintf(chartWeekExpr, "timestamp"), fmt.Sprintf(chartWeekExpr, "NOW()")),
+		userId)
+	if err != nil {
+		return err
+	}
+	weeks, err := pgx.CollectRows(rows, pgx.RowTo[time.Time])
+	if err != nil {
+		return err
+	}
+
+	for _, week := range weeks {
+		if err := GenerateWeeklyChart(userId, week); err != nil {
+			return fmt.Errorf("week of %s: %w", week.Format("2006-01-02"), err)
+		}
+	}
+	return nil
+}
+
+// Brings every user's weekly charts up to date now and then periodically
+func StartChartUpdater() {
+	ticker := time.NewTicker(chartUpdateInterval)
+	go func() {
+		for {
+			updateAllWeeklyCharts()
+			<-ticker.C
+		}
+	}()
+}
+
+func updateAllWeeklyCharts() {
+	rows, err := Pool.Query(context.Background(), "SELECT pk FROM users")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting users for weekly charts: %v\n", err)
+		return
+	}
+	users, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting users for weekly charts: %v\n", err)
+		return
+	}
+
+	for _, userId := range users {
+		if err := UpdateWeeklyCharts(userId); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating weekly charts for user %d: %v\n", userId, err)
+		}
+	}
+}
+
+// Returns the chart history of one artist, album or track. For artists the
+// artist argument is empty.
+func GetChartRun(userId int, kind, name, artist string) (ChartRun, error) {
+	var run ChartRun
+	var peakRank *int
+	var peakWeek, firstWeek, lastWeek *time.Time
+	err := Pool.QueryRow(context.Background(),
+		`SELECT COUNT(*),
+			MIN(rank),
+			(array_agg(week_start ORDER BY rank, week_start))[1],
+			COUNT(*) FILTER (WHERE rank = 1),
+			COUNT(*) FILTER (WHERE rank <= 10),
+			MIN(week_start),
+			MAX(week_start)
+		FROM weekly_charts
+		WHERE user_id = $1 AND kind = $2 AND name = $3 AND artist = $4`,
+		userId, kind, name, artist).Scan(&run.Weeks, &peakRank, &peakWeek,
+		&run.WeeksAtOne, &run.WeeksInTop10, &firstWeek, &lastWeek)
+	if err != nil {
+		return run, err
+	}
+	if peakRank != nil {
+		run.PeakRank = *peakRank
+	}
+	if peakWeek != nil {
+		run.PeakWeek = *peakWeek
+	}
+	if firstWeek != nil {
+		run.FirstWeek = *firstWeek
+	}
+	if lastWeek != nil {
+		run.LastWeek = *lastWeek
+	}
+	return run, nil
+}
+
+// Compares the latest weekly chart of a kind to the week before it
+func GetChartMovements(userId int, kind string) (ChartMovements, error) {
+	rows, err := Pool.Query(context.Background(),
+		`WITH latest AS (
+			SELECT MAX(week_start) AS week_start FROM weekly_charts WHERE user_id = $1 AND kind = $2
+		)
+		SELECT c.name, c.artist, c.rank, COALESCE(p.rank, 0)
+		FROM weekly_charts c
+		JOIN latest l ON c.week_start = l.week_start
+		LEFT JOIN weekly_charts p ON p.user_id = c.user_id AND p.kind = c.kind
+			AND p.week_start = l.week_start - 7 AND p.name = c.name AND p.artist = c.artist
+		WHERE c.user_id = $1 AND c.kind = $2`,
+		userId, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movements := make(ChartMovements)
+	for rows.Next() {
+		var name, artist string
+		var m ChartMovement
+		if err := rows.Scan(&name, &artist, &m.Rank, &m.PrevRank); err != nil {
+			return nil, err
+		}
+		switch {
+		case m.PrevRank == 0:
+			m.Status = "new"
+		case m.Rank < m.PrevRank:
+			m.Status = "up"
+		case m.Rank > m.PrevRank:
+			m.Status = "down"
+		default:
+			m.Status = "same"
+		}
+		movements[chartKey(name, artist)] = m
+	}
+	return movements, rows.Err()
+}
@@ -0,0 +1,294 @@
+package db
+
+// Finding the same play scrobbled by two platforms, like a Spotify export
+// and a Last.fm import of the same listen, and removing the copies. Removed
+// scrobbles go to the trash and the removal is logged like any delete, so a
+// cleanup can be undone until its scrobbles are purged from the trash.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type ScrobbleCleanupOptions struct {
+	// Longest time between two scrobbles of the same play. Some platforms
+	// record when a track started and others when it ended, so this is
+	// usually about a track long.
+	Window time.Duration
+	// Trigram similarity from which titles match, titles equal once folded
+	// always match
+	Similarity float64
+	// Platform whose scrobbles are kept. Between two other platforms, or
+	// when empty, the longer play is kept.
+	Preferred string
+}
+
+// A scrobble kept and the copy of it from another platform that is removed
+type ScrobbleConflict struct {
+	Kept    ScrobbleEntry
+	Removed ScrobbleEntry
+}
+
+type ScrobbleCleanup struct {
+	Id        int
+	CreatedAt time.Time
+	Preferred string
+	Scrobbles int
+}
+
+func CreateScrobbleCleanupTables() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS scrobble_cleanups (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			preferred TEXT NOT NULL DEFAULT '',
+			window_seconds INTEGER NOT NULL,
+			similarity REAL NOT NULL,
+			change_id INTEGER NOT NULL REFERENCES change_log(id) ON DELETE CASCADE
+		);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating scrobble_cleanups table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+type conflictIds struct {
+	Kept    int
+	Removed int
+}
+
+// Returns the ids of the kept and removed scrobble of every conflict, in
+// order of time. A scrobble conflicting with several others is only listed
+// once.
+func findScrobbleConflicts(q querier, userId int, o ScrobbleCleanupOptions) ([]conflictIds, error) {
+	rows, err := q.Query(context.Background(),
+		`WITH pairs AS (
+			SELECT a.id AS a, b.id AS b, a.timestamp,
+				CASE
+					WHEN COALESCE(a.platform, '') = $4 THEN TRUE
+					WHEN COALESCE(b.platform, '') = $4 THEN FALSE
+					ELSE COALESCE(a.ms_played, 0) >= COALESCE(b.ms_played, 0)
+				END AS keep_a
+			FROM history a
+			JOIN history b ON b.user_id = a.user_id
+				AND b.timestamp BETWEEN a.timestamp - $2::interval AND a.timestamp + $2::interval
+				AND COALESCE(b.platform, '') != COALESCE(a.platform, '')
+				AND b.id > a.id
+			WHERE a.user_id = $1 AND a.deleted_at IS NULL AND b.deleted_at IS NULL
+				AND (a.artist_ids && b.artist_ids OR fold_name(a.artist) = fold_name(b.artist))
+				AND (fold_name(a.song_name) = fold_name(b.song_name) OR similarity(a.song_name, b.song_name) >= $3)
+		),
+		decided AS (
+			SELECT CASE WHEN keep_a THEN a ELSE b END AS kept, CASE WHEN keep_a THEN b ELSE a END AS removed, timestamp
+			FROM pairs
+		)
+		SELECT kept, removed FROM (
+			SELECT DISTINCT ON (removed) kept, removed, timestamp FROM decided ORDER BY removed, kept
+		) d
+		ORDER BY timestamp, removed`,
+		userId, o.Window, o.Similarity, o.Preferred)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[conflictIds])
+}
+
+// Returns the scrobbles that would be removed with the options, and the
+// ones kept in their place
+func FindScrobbleConflicts(userId int, o ScrobbleCleanupOptions) ([]ScrobbleConflict, error) {
+	pairs, err := findScrobbleConflicts(Pool, userId, o)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+
+	var ids []int
+	for _, p := range pairs {
+		ids = append(ids, p.Kept, p.Removed)
+	}
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, timestamp, song_name, artist, COALESCE(album_name, ''), COALESCE(ms_played, 0),
+			COALESCE(platform, ''), COALESCE(client, '')
+		FROM history WHERE user_id = $1 AND id = ANY($2)`,
+		userId, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[int]ScrobbleEntry)
+	for rows.Next() {
+		var e ScrobbleEntry
+		err := rows.Scan(&e.Id, &e.Timestamp, &e.SongName, &e.ArtistName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.Client)
+		if err != nil {
+			return nil, err
+		}
+		entries[e.Id] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	conflicts := make([]ScrobbleConflict, len(pairs))
+	for i, p := range pairs {
+		conflicts[i] = ScrobbleConflict{Kept: entries[p.Kept], Removed: entries[p.Removed]}
+	}
+	return conflicts, nil
+}
+
+// Removes the scrobbles the options find as copies in one cleanup and
+// returns how many were removed
+func RemoveScrobbleConflicts(userId int, o ScrobbleCleanupOptions) (int, error) {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	pairs, err := findScrobbleConflicts(tx, userId, o)
+	if err != nil || len(pairs) == 0 {
+		return 0, err
+	}
+	var ids []int
+	for _, p := range pairs {
+		ids = append(ids, p.Removed)
+	}
+
+	var changeId *int
+	var n int
+	var first, last *time.Time
+	err = tx.QueryRow(ctx,
+		`WITH removed AS (
+			UPDATE history SET deleted_at = NOW()
+			WHERE user_id = $1 AND id = ANY($2) AND deleted_at IS NULL
+			RETURNING *
+		),
+		logged AS (
+			INSERT INTO change_log (user_id, kind, summary, before, after)
+			SELECT $1, $3::text, $4::text, jsonb_agg(to_jsonb(removed)), '[]' FROM removed
+			HAVING COUNT(*) > 0
+			RETURNING id
+		)
+		SELECT (SELECT id FROM logged), COUNT(*), MIN(timestamp), MAX(timestamp) FROM removed`,
+		userId, ids, ChangeHistoryDelete, "copies removed by a cleanup").Scan(&changeId, &n, &first, &last)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO scrobble_cleanups (user_id, preferred, window_seconds, similarity, change_id)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userId, o.Preferred, int(o.Window.Seconds()), o.Similarity, *changeId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := refreshDailyRollups(tx, userId, *first, *last); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Returns the user's cleanups that can still be undone, newest first.
+// Cleanups undone from the changes page are left out.
+func GetScrobbleCleanups(userId int) ([]ScrobbleCleanup, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT c.id, c.created_at, c.preferred,
+			(SELECT jsonb_array_length(l.before) FROM change_log l WHERE l.id = c.change_id)
+		FROM scrobble_cleanups c
+		WHERE c.user_id = $1 AND NOT EXISTS (SELECT 1 FROM change_log u WHERE u.undoes = c.change_id)
+		ORDER BY c.created_at DESC`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[ScrobbleCleanup])
+}
+
+// Puts the scrobbles a cleanup removed back in the history and returns how
+// many were restored. Scrobbles recorded again since are left as they are.
+func UndoScrobbleCleanup(userId, id int) (int, error) {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var changeId int
+	var undone bool
+	err = tx.QueryRow(ctx,
+		`SELECT change_id, EXISTS (SELECT 1 FROM change_log u WHERE u.undoes = c.change_id)
+		FROM scrobble_cleanups c WHERE id = $1 AND user_id = $2
+		FOR UPDATE`,
+		id, userId).Scan(&changeId, &undone)
+	if err != nil {
+		return 0, err
+	}
+	if undone {
+		return 0, ErrChangeUndone
+	}
+
+	// Undone like the delete it was logged as
+	if err := undoHistoryDelete(ctx, tx, userId, changeId); err != nil {
+		return 0, err
+	}
+	var n int
+	err = tx.QueryRow(ctx,
+		`SELECT jsonb_array_length(after) FROM change_log WHERE undoes = $1`,
+		changeId).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM scrobble_cleanups WHERE id = $1 AND user_id = $2`, id, userId)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Purges the scrobbles a cleanup removed from the trash, and drops the
+// cleanup
+func PurgeScrobbleCleanup(userId, id int) error {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var ids []int
+	err = tx.QueryRow(ctx,
+		`SELECT ARRAY(
+			SELECT (r.row->>'id')::int FROM change_log l, jsonb_array_elements(l.before) AS r(row)
+			WHERE l.id = c.change_id
+		)
+		FROM scrobble_cleanups c WHERE c.id = $1 AND c.user_id = $2`,
+		id, userId).Scan(&ids)
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		if _, err := purgeTrash(tx, userId, ids); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM scrobble_cleanups WHERE id = $1 AND user_id = $2`, id, userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
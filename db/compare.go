@@ -0,0 +1,195 @@
+package db
+
+// Taste comparison between two users, counted from the daily rollups.
+// Artists and songs are stored per user, so entities are matched by
+// MusicBrainz id where there is one and by normalized name otherwise.
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+type CompareArtist struct {
+	Name   string `json:"name"`
+	CountA int    `json:"count_a"`
+	CountB int    `json:"count_b"`
+}
+
+type CompareTrack struct {
+	SongName string `json:"song_name"`
+	Artist   string `json:"artist"`
+	CountA   int    `json:"count_a"`
+	CountB   int    `json:"count_b"`
+}
+
+type Comparison struct {
+	// Cosine similarity of the two users' artist play counts, 0 to 100
+	Score             int             `json:"score"`
+	SharedArtistCount int             `json:"shared_artist_count"`
+	SharedArtists     []CompareArtist `json:"shared_artists"`
+	OnlyAArtists      []CompareArtist `json:"only_a_artists"`
+	OnlyBArtists      []CompareArtist `json:"only_b_artists"`
+	SharedTracks      []CompareTrack  `json:"shared_tracks"`
+	OnlyATracks       []CompareTrack  `json:"only_a_tracks"`
+	OnlyBTracks       []CompareTrack  `json:"only_b_tracks"`
+}
+
+// Play counts of both users side by side in pairs(name, artist, pa, pb),
+// formatted with a query for the counts(user_id, key, name, artist, plays)
+// of the users' artists or tracks. Entities with the same key are counted
+// together under their most played name. $1 and $2 are the two users.
+const comparePairs = `
+	WITH counts AS (%s),
+	keyed AS (
+		SELECT user_id, key, (array_agg(name ORDER BY plays DESC))[1] AS name,
+			(array_agg(artist ORDER BY plays DESC))[1] AS artist, SUM(plays)::int AS plays
+		FROM counts
+		GROUP BY user_id, key
+	),
+	pairs AS (
+		SELECT COALESCE(a.name, b.name) AS name, COALESCE(a.artist, b.artist) AS artist,
+			COALESCE(a.plays, 0) AS pa, COALESCE(b.plays, 0) AS pb
+		FROM (SELECT * FROM keyed WHERE user_id = $1) a
+		FULL JOIN (SELECT * FROM keyed WHERE user_id = $2) b ON a.key = b.key
+	)`
+
+// Artists are matched by MusicBrainz id, also when only one of the users'
+// artists of the same name has one, and by normalized name otherwise
+func compareArtistCounts(days string) string {
+	return `WITH mbids AS (
+			SELECT normalize_name(name) AS norm, MIN(musicbrainz_id) AS mbid
+			FROM artists WHERE user_id IN ($1, $2) AND musicbrainz_id != ''
+			GROUP BY 1
+		)
+		SELECT r.user_id, ARRAY[COALESCE(NULLIF(a.musicbrainz_id, ''), m.mbid, normalize_name(a.name))] AS key,
+			a.name, '' AS artist, SUM(r.listen_count) AS plays
+		FROM artist_daily r
+		JOIN artists a ON a.id = r.artist_id
+		LEFT JOIN mbids m ON m.norm = normalize_name(a.name)
+		WHERE r.user_id IN ($1, $2)` + days + `
+		GROUP BY r.user_id, a.id, m.mbid`
+}
+
+func compareTrackCounts(days string) string {
+	return `SELECT r.user_id, ARRAY[normalize_name(r.artist), normalize_name(r.song_name)] AS key,
+			r.song_name AS name, r.artist, SUM(r.listen_count) AS plays
+		FROM song_daily r
+		WHERE r.user_id IN ($1, $2)` + days + `
+		GROUP BY r.user_id, r.artist, r.song_name`
+}
+
+type comparedPair struct {
+	name, artist   string
+	countA, countB int
+}
+
+type compareTotals struct {
+	totalA, totalB int
+	// Sums of the products of the counts, for the cosine similarity
+	dot, normA, normB float64
+	shared            int
+}
+
+// Returns the totals over all pairs, and up to limit shared pairs, ranked
+// by how much of both users' listening they make up so one both play a
+// lot comes before one only A loves, and pairs only one user played
+func compareLists(counts string, q *queryArgs, limit int) (compareTotals, []comparedPair, []comparedPair, []comparedPair, error) {
+	ctx := context.Background()
+	pairs := fmt.Sprintf(comparePairs, counts)
+
+	var t compareTotals
+	err := Pool.QueryRow(ctx, pairs+`
+		SELECT COALESCE(SUM(pa), 0)::int, COALESCE(SUM(pb), 0)::int, COALESCE(SUM(pa::float8 * pb), 0),
+			COALESCE(SUM(pa::float8 * pa), 0), COALESCE(SUM(pb::float8 * pb), 0),
+			COUNT(*) FILTER (WHERE pa > 0 AND pb > 0)::int
+		FROM pairs`,
+		q.args...).Scan(&t.totalA, &t.totalB, &t.dot, &t.normA, &t.normB, &t.shared)
+	if err != nil || t.totalA == 0 && t.totalB == 0 {
+		return t, nil, nil, nil, err
+	}
+
+	n := q.add(limit)
+	rows, err := Pool.Query(ctx, pairs+`
+		(SELECT 'shared', name, artist, pa, pb FROM pairs WHERE pa > 0 AND pb > 0
+			ORDER BY LEAST(pa::float8 / `+q.add(float64(t.totalA))+`, pb::float8 / `+q.add(float64(t.totalB))+`) DESC, name LIMIT `+n+`)
+		UNION ALL
+		(SELECT 'a', name, artist, pa, pb FROM pairs WHERE pb = 0 ORDER BY pa DESC, name LIMIT `+n+`)
+		UNION ALL
+		(SELECT 'b', name, artist, pa, pb FROM pairs WHERE pa = 0 ORDER BY pb DESC, name LIMIT `+n+`)`,
+		q.args...)
+	if err != nil {
+		return t, nil, nil, nil, err
+	}
+	defer rows.Close()
+
+	var shared, onlyA, onlyB []comparedPair
+	for rows.Next() {
+		var kind string
+		var p comparedPair
+		if err := rows.Scan(&kind, &p.name, &p.artist, &p.countA, &p.countB); err != nil {
+			return t, nil, nil, nil, err
+		}
+		switch kind {
+		case "shared":
+			shared = append(shared, p)
+		case "a":
+			onlyA = append(onlyA, p)
+		default:
+			onlyB = append(onlyB, p)
+		}
+	}
+	return t, shared, onlyA, onlyB, rows.Err()
+}
+
+// Compares two users over the whole days of the period in f. Only f.Start
+// and f.End are used, and limit caps every returned list.
+func CompareUsers(userA, userB int, f Filter, limit int) (Comparison, error) {
+	var c Comparison
+
+	newArgs := func() (*queryArgs, string) {
+		q := &queryArgs{}
+		q.add(userA)
+		q.add(userB)
+		var days string
+		for _, cond := range f.rollupDays(q) {
+			days += " AND " + cond
+		}
+		return q, days
+	}
+
+	q, days := newArgs()
+	t, shared, onlyA, onlyB, err := compareLists(compareArtistCounts(days), q, limit)
+	if err != nil {
+		return c, err
+	}
+	if t.normA > 0 && t.normB > 0 {
+		c.Score = int(math.Round(100 * t.dot / (math.Sqrt(t.normA) * math.Sqrt(t.normB))))
+	}
+	c.SharedArtistCount = t.shared
+	for _, p := range shared {
+		c.SharedArtists = append(c.SharedArtists, CompareArtist{Name: p.name, CountA: p.countA, CountB: p.countB})
+	}
+	for _, p := range onlyA {
+		c.OnlyAArtists = append(c.OnlyAArtists, CompareArtist{Name: p.name, CountA: p.countA})
+	}
+	for _, p := range onlyB {
+		c.OnlyBArtists = append(c.OnlyBArtists, CompareArtist{Name: p.name, CountB: p.countB})
+	}
+
+	q, days = newArgs()
+	_, shared, onlyA, onlyB, err = compareLists(compareTrackCounts(days), q, limit)
+	if err != nil {
+		return c, err
+	}
+	for _, p := range shared {
+		c.SharedTracks = append(c.SharedTracks, CompareTrack{SongName: p.name, Artist: p.artist, CountA: p.countA, CountB: p.countB})
+	}
+	for _, p := range onlyA {
+		c.OnlyATracks = append(c.OnlyATracks, CompareTrack{SongName: p.name, Artist: p.artist, CountA: p.countA})
+	}
+	for _, p := range onlyB {
+		c.OnlyBTracks = append(c.OnlyBTracks, CompareTrack{SongName: p.name, Artist: p.artist, CountB: p.countB})
+	}
+	return c, nil
+}
@@ -0,0 +1,291 @@
+package db
+
+// Artist names a user never wants split into several credits, and
+// re-parsing the credits of the existing history when the parser or the
+// exceptions change
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"muzi/credits"
+)
+
+type CreditException struct {
+	Id   int
+	Name string
+}
+
+// A scrobbled artist and title whose credited artists change on re-parsing
+type CreditChange struct {
+	Artist    string
+	SongName  string
+	Old       []string
+	New       []string
+	Scrobbles int
+	artistIds []int
+}
+
+var (
+	creditParserCache   = make(map[int]*credits.Parser)
+	creditParserCacheMu sync.Mutex
+)
+
+func CreateCreditExceptionsTable() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS credit_exceptions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			UNIQUE (user_id, name)
+		);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating credit_exceptions table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+func GetCreditExceptions(userId int) ([]CreditException, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, name FROM credit_exceptions WHERE user_id = $1 ORDER BY lower(name)`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exceptions []CreditException
+	for rows.Next() {
+		var e CreditException
+		if err := rows.Scan(&e.Id, &e.Name); err != nil {
+			return nil, err
+		}
+		exceptions = append(exceptions, e)
+	}
+	return exceptions, rows.Err()
+}
+
+func AddCreditException(userId int, name string) error {
+	_, err := Pool.Exec(context.Background(),
+		`INSERT INTO credit_exceptions (user_id, name) VALUES ($1, $2)
+		ON CONFLICT (user_id, name) DO NOTHING`,
+		userId, name)
+	forgetCreditParser(userId)
+	return err
+}
+
+func DeleteCreditException(userId, id int) error {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM credit_exceptions WHERE user_id = $1 AND id = $2`,
+		userId, id)
+	forgetCreditParser(userId)
+	return err
+}
+
+// Returns the credit parser with the user's exceptions. It is cached until
+// the user changes their exceptions.
+func GetCreditParser(userId int) (*credits.Parser, error) {
+	creditParserCacheMu.Lock()
+	p, ok := creditParserCache[userId]
+	creditParserCacheMu.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	exceptions, err := GetCreditExceptions(userId)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(exceptions))
+	for i, e := range exceptions {
+		names[i] = e.Name
+	}
+	p = credits.NewParser(names)
+
+	creditParserCacheMu.Lock()
+	creditParserCache[userId] = p
+	creditParserCacheMu.Unlock()
+	return p, nil
+}
+
+func forgetCreditParser(userId int) {
+	creditParserCacheMu.Lock()
+	delete(creditParserCache, userId)
+	creditParserCacheMu.Unlock()
+}
+
+// Returns the artists and titles in the user's history that are credited
+// differently by the current parser, most played first
+func PreviewCreditReparse(userId int) ([]CreditChange, error) {
+	p, err := GetCreditParser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int]string)
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, name FROM artists WHERE user_id = $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names[id] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = Pool.Query(context.Background(),
+		`SELECT artist, song_name, COALESCE(artist_ids, '{}'), COUNT(*)
+		FROM history WHERE user_id = $1
+		GROUP BY 1, 2, 3
+		ORDER BY 4 DESC, 1, 2`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []CreditChange
+	for rows.Next() {
+		var c CreditChange
+		if err := rows.Scan(&c.Artist, &c.SongName, &c.artistIds, &c.Scrobbles); err != nil {
+			return nil, err
+		}
+		for _, id := range c.artistIds {
+			c.Old = append(c.Old, names[id])
+		}
+		c.New = p.Credits(c.Artist, c.SongName)
+		if !slices.Equal(c.Old, c.New) {
+			changes = append(changes, c)
+		}
+	}
+	return changes, rows.Err()
+}
+
+// Credits the user's history again with the current parser in one
+// transaction and returns how many scrobbles changed. Scrobbles whose first
+// artist changes are also moved to the album and song of that artist.
+func ApplyCreditReparse(userId int) (int, error) {
+	changes, err := PreviewCreditReparse(userId)
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+	parser, err := GetCreditParser(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var updated int
+	var minTs, maxTs time.Time
+	for _, c := range changes {
+		var artistIds []int
+		for _, name := range c.New {
+			id, _, err := getOrCreateArtist(tx, userId, name)
+			if err != nil {
+				return 0, err
+			}
+			artistIds = append(artistIds, id)
+		}
+		primary := 0
+		if len(artistIds) > 0 {
+			primary = artistIds[0]
+		}
+
+		// The rows are matched on their old credits too, so rows changed
+		// since the preview are left alone
+		rows, err := tx.Query(ctx,
+			`SELECT DISTINCT COALESCE(album_name, ''), COALESCE(album_artist, '') FROM history
+			WHERE user_id = $1 AND artist = $2 AND song_name = $3 AND COALESCE(artist_ids, '{}') = $4`,
+			userId, c.Artist, c.SongName, c.artistIds)
+		if err != nil {
+			return 0, err
+		}
+		var albums [][2]string
+		for rows.Next() {
+			var album, albumArtist string
+			if err := rows.Scan(&album, &albumArtist); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			albums = append(albums, [2]string{album, albumArtist})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for _, a := range albums {
+			album, albumArtist := a[0], a[1]
+			albumArtistId, err := getAlbumArtistId(tx, userId, parser, albumArtist, c.Artist, primary)
+			if err != nil {
+				return 0, err
+			}
+			albumId, _, err := getOrCreateAlbum(tx, userId, album, albumArtistId)
+			if err != nil {
+				return 0, err
+			}
+			songId, _, err := getOrCreateSong(tx, userId, c.SongName, primary, albumId)
+			if err != nil {
+				return 0, err
+			}
+
+			var n int
+			var first, last *time.Time
+			err = tx.QueryRow(ctx,
+				`WITH changed AS (
+					UPDATE history SET artist_id = NULLIF($5, 0), artist_ids = $6, song_id = NULLIF($7, 0)
+					WHERE user_id = $1 AND artist = $2 AND song_name = $3 AND COALESCE(artist_ids, '{}') = $4
+						AND COALESCE(album_name, '') = $8 AND COALESCE(album_artist, '') = $9
+					RETURNING timestamp
+				)
+				SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM changed`,
+				userId, c.Artist, c.SongName, c.artistIds, primary, artistIds, songId, album, albumArtist).Scan(&n, &first, &last)
+			if err != nil {
+				return 0, err
+			}
+			if n == 0 {
+				continue
+			}
+			if updated == 0 || first.Before(minTs) {
+				minTs = *first
+			}
+			if updated == 0 || last.After(maxTs) {
+				maxTs = *last
+			}
+			updated += n
+		}
+	}
+
+	if updated > 0 {
+		if err := refreshDailyRollups(tx, userId, minTs, maxTs); err != nil {
+			return 0, err
+		}
+		if err := invalidateChartWeeks(tx, userId, minTs, maxTs); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
@@ -41,14 +41,63 @@ func CreateAllTables() error {
 	if err := AddHistoryEntityColumns(); err != nil {
 		return err
 	}
+	if err := AddHistoryClientColumn(); err != nil {
+		return err
+	}
+	if err := AddHistorySkipColumns(); err != nil {
+		return err
+	}
+	if err := AddHistoryDeletedColumn(); err != nil {
+		return err
+	}
+	if err := AddAlbumArtistColumns(); err != nil {
+		return err
+	}
+	if err := CreateWeeklyChartsTable(); err != nil {
+		return err
+	}
+	if err := CreateDailyRollupTables(); err != nil {
+		return err
+	}
+	if err := AddUserPrivacyColumns(); err != nil {
+		return err
+	}
+	if err := CreateNormalizeNameFunction(); err != nil {
+		return err
+	}
+	if err := CreateAlbumTracksTable(); err != nil {
+		return err
+	}
+	if err := CreateTagTables(); err != nil {
+		return err
+	}
+	if err := CreateRewriteRulesTable(); err != nil {
+		return err
+	}
+	if err := CreateCreditExceptionsTable(); err != nil {
+		return err
+	}
+	if err := CreateAliasesTable(); err != nil {
+		return err
+	}
+	if err := CreateDuplicateTables(); err != nil {
+		return err
+	}
+	if err := CreateChangeLogTable(); err != nil {
+		return err
+	}
+	if err := CreateScrobbleCleanupTables(); err != nil {
+		return err
+	}
 	return nil
 }
 
 func CreateExtensions() error {
 	_, err := Pool.Exec(context.Background(),
-		"CREATE EXTENSION IF NOT EXISTS pg_trgm;")
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm;
+		CREATE EXTENSION IF NOT EXISTS unaccent;`)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating pg_trgm extension: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error creating extensions: %v\n", err)
 		return err
 	}
 	return nil
@@ -102,6 +151,7 @@ func CreateHistoryTable() error {
 			UNIQUE (user_id, song_name, artist, timestamp)
 		);
 		CREATE INDEX IF NOT EXISTS idx_history_user_timestamp ON history(user_id, timestamp DESC);
+		CREATE INDEX IF NOT EXISTS idx_history_user_timestamp_id ON history(user_id, timestamp DESC, id DESC);
 		CREATE INDEX IF NOT EXISTS idx_history_user_artist ON history(user_id, artist);
 		CREATE INDEX IF NOT EXISTS idx_history_user_song ON history(user_id, song_name);`)
 	if err != nil {
@@ -137,6 +187,19 @@ func CreateUsersTable() error {
 	return nil
 }
 
+// Both default to off, so nothing a user listens to shows up outside their
+// own profile until they opt in
+func AddUserPrivacyColumns() error {
+	_, err := Pool.Exec(context.Background(),
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS share_global BOOLEAN DEFAULT FALSE;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS share_now_playing BOOLEAN DEFAULT FALSE;`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding user privacy columns: %v\n", err)
+		return err
+	}
+	return nil
+}
+
 func CreateSessionsTable() error {
 	_, err := Pool.Exec(context.Background(),
 		`CREATE TABLE IF NOT EXISTS sessions (
@@ -238,6 +301,7 @@ func CreateSongsTable() error {
 			UNIQUE (user_id, title, artist_id)
 		);
 		CREATE INDEX IF NOT EXISTS idx_songs_user_title ON songs(user_id, title);
+		CREATE INDEX IF NOT EXISTS idx_songs_album_id ON songs(album_id);
 		CREATE INDEX IF NOT EXISTS idx_songs_user_title_trgm ON songs USING gin(title gin_trgm_ops);`)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating songs table: %v\n", err)
@@ -260,3 +324,62 @@ func AddHistoryEntityColumns() error {
 	}
 	return nil
 }
+
+// Client is the app or device a scrobble came from, as reported by the
+// scrobbler. Platform only records which API or import was used.
+func AddHistoryClientColumn() error {
+	_, err := Pool.Exec(context.Background(),
+		`ALTER TABLE history ADD COLUMN IF NOT EXISTS client TEXT;
+		CREATE INDEX IF NOT EXISTS idx_history_user_platform ON history(user_id, platform);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding history client column: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Skipped plays stay in history but are left out of stats by default.
+// skip_flagged records Spotify's own skipped flag, which only counts
+// towards skip rates since Spotify sets it on plays of any length.
+// reason_end is Spotify's reason the play stopped, e.g. "fwdbtn" or
+// "trackdone".
+func AddHistorySkipColumns() error {
+	_, err := Pool.Exec(context.Background(),
+		`ALTER TABLE history ADD COLUMN IF NOT EXISTS skipped BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE history ADD COLUMN IF NOT EXISTS skip_flagged BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE history ADD COLUMN IF NOT EXISTS reason_end TEXT;`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding history skip columns: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Deleted plays stay in history, left out of everything but the trash,
+// until they are purged. Users' trash is purged of plays deleted more than
+// trash_days ago, never when it is 0.
+func AddHistoryDeletedColumn() error {
+	_, err := Pool.Exec(context.Background(),
+		`ALTER TABLE history ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+		CREATE INDEX IF NOT EXISTS idx_history_deleted ON history(user_id, deleted_at DESC) WHERE deleted_at IS NOT NULL;
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS trash_days INTEGER NOT NULL DEFAULT 30;`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding history deleted column: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// The album artist is who the album of a scrobble is credited to, e.g.
+// "Various Artists" for a compilation, when the source reported one. Albums
+// are grouped under it, falling back to the track artist.
+func AddAlbumArtistColumns() error {
+	_, err := Pool.Exec(context.Background(),
+		`ALTER TABLE history ADD COLUMN IF NOT EXISTS album_artist TEXT;
+		ALTER TABLE spotify_last_track ADD COLUMN IF NOT EXISTS album_artist TEXT;`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding album artist columns: %v\n", err)
+		return err
+	}
+	return nil
+}
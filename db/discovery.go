@@ -0,0 +1,238 @@
+package db
+
+// Discovery stats: when entities entered a user's library, how quickly new
+// music is found over time, and what was played on this date in past years
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type ListenRange struct {
+	First time.Time
+	Last  time.Time
+}
+
+type DiscoveredArtist struct {
+	Artist      Artist
+	FirstListen time.Time
+	ListenCount int
+}
+
+type DiscoveredTrack struct {
+	SongName    string
+	Artist      string
+	FirstListen time.Time
+	ListenCount int
+}
+
+type DiscoveryPoint struct {
+	Period     time.Time `json:"period"`
+	Scrobbles  int       `json:"scrobbles"`
+	NewArtists int       `json:"new_artists"`
+	NewTracks  int       `json:"new_tracks"`
+}
+
+type OnThisDay struct {
+	Year    int
+	Count   int
+	Entries []ScrobbleEntry
+}
+
+// Max entries kept per past year in the "On this day" list
+const onThisDayLimit = 10
+
+func scanListenRange(first, last *time.Time) ListenRange {
+	var lr ListenRange
+	if first != nil {
+		lr.First = *first
+	}
+	if last != nil {
+		lr.Last = *last
+	}
+	return lr
+}
+
+func GetArtistListenRange(userId, artistId int) (ListenRange, error) {
+	var first, last *time.Time
+	err := Pool.QueryRow(context.Background(),
+		"SELECT MIN(timestamp), MAX(timestamp) FROM history WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL AND $2 = ANY(artist_ids)",
+		userId, artistId).Scan(&first, &last)
+	return scanListenRange(first, last), err
+}
+
+func GetSongsListenRange(userId int, songIds []int) (ListenRange, error) {
+	if len(songIds) == 0 {
+		return ListenRange{}, nil
+	}
+	var first, last *time.Time
+	err := Pool.QueryRow(context.Background(),
+		"SELECT MIN(timestamp), MAX(timestamp) FROM history WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL AND song_id = ANY($2)",
+		userId, songIds).Scan(&first, &last)
+	return scanListenRange(first, last), err
+}
+
+func GetAlbumListenRange(userId, albumId int) (ListenRange, error) {
+	var first, last *time.Time
+	err := Pool.QueryRow(context.Background(),
+		`SELECT MIN(h.timestamp), MAX(h.timestamp) FROM history h
+		JOIN songs s ON h.song_id = s.id
+		WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND s.album_id = $2`,
+		userId, albumId).Scan(&first, &last)
+	return scanListenRange(first, last), err
+}
+
+// Returns artists whose first listen falls within the period, most played first
+func GetNewArtists(userId int, limit int, startDate, endDate *time.Time) ([]DiscoveredArtist, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT ar.id, ar.user_id, ar.name, COALESCE(ar.image_url, ''), f.first_listen, f.listen_count
+		FROM (
+			SELECT a.artist_id, MIN(h.timestamp) AS first_listen, COUNT(*) AS listen_count
+			FROM history h, unnest(h.artist_ids) AS a(artist_id)
+			WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL
+			GROUP BY a.artist_id
+		) f
+		JOIN artists ar ON ar.id = f.artist_id
+		WHERE ($2::timestamptz IS NULL OR f.first_listen >= $2)
+			AND ($3::timestamptz IS NULL OR f.first_listen < $3)
+		ORDER BY f.listen_count DESC, f.first_listen
+		LIMIT $4`,
+		userId, startDate, endDate, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var artists []DiscoveredArtist
+	for rows.Next() {
+		var d DiscoveredArtist
+		err := rows.Scan(&d.Artist.Id, &d.Artist.UserId, &d.Artist.Name, &d.Artist.ImageUrl,
+			&d.FirstListen, &d.ListenCount)
+		if err != nil {
+			return nil, err
+		}
+		artists = append(artists, d)
+	}
+	return artists, rows.Err()
+}
+
+// Returns tracks whose first listen falls within the period, most played first
+func GetNewTracks(userId int, limit int, startDate, endDate *time.Time) ([]DiscoveredTrack, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT song_name, artist, first_listen, listen_count FROM (
+			SELECT song_name, artist, MIN(timestamp) AS first_listen, COUNT(*) AS listen_count
+			FROM history
+			WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL
+			GROUP BY song_name, artist
+		) f
+		WHERE ($2::timestamptz IS NULL OR first_listen >= $2)
+			AND ($3::timestamptz IS NULL OR first_listen < $3)
+		ORDER BY listen_count DESC, first_listen
+		LIMIT $4`,
+		userId, startDate, endDate, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tracks []DiscoveredTrack
+	for rows.Next() {
+		var d DiscoveredTrack
+		if err := rows.Scan(&d.SongName, &d.Artist, &d.FirstListen, &d.ListenCount); err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, d)
+	}
+	return tracks, rows.Err()
+}
+
+// Returns the number of scrobbles, newly discovered artists and newly
+// discovered tracks for every week, month or year of a user's history
+func GetDiscoveryRate(userId int, interval string) ([]DiscoveryPoint, error) {
+	switch interval {
+	case "week", "month", "year":
+	default:
+		return nil, fmt.Errorf("unknown interval: %s", interval)
+	}
+
+	rows, err := Pool.Query(context.Background(),
+		`WITH artist_firsts AS (
+			SELECT MIN(h.timestamp) AS first_listen
+			FROM history h, unnest(h.artist_ids) AS a(artist_id)
+			WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL
+			GROUP BY a.artist_id
+		), track_firsts AS (
+			SELECT MIN(timestamp) AS first_listen
+			FROM history
+			WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL
+			GROUP BY song_name, artist
+		), periods AS (
+			SELECT date_trunc($2, timestamp) AS period, COUNT(*) AS scrobbles
+			FROM history
+			WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL
+			GROUP BY 1
+		)
+		SELECT p.period, p.scrobbles, COALESCE(a.n, 0), COALESCE(t.n, 0)
+		FROM periods p
+		LEFT JOIN (SELECT date_trunc($2, first_listen) AS period, COUNT(*) AS n FROM artist_firsts GROUP BY 1) a
+			ON a.period = p.period
+		LEFT JOIN (SELECT date_trunc($2, first_listen) AS period, COUNT(*) AS n FROM track_firsts GROUP BY 1) t
+			ON t.period = p.period
+		ORDER BY p.period`,
+		userId, interval)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []DiscoveryPoint
+	for rows.Next() {
+		var p DiscoveryPoint
+		if err := rows.Scan(&p.Period, &p.Scrobbles, &p.NewArtists, &p.NewTracks); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// Returns what was played on the same month and day as date in every
+// previous year, newest year first
+func GetOnThisDay(userId int, date time.Time) ([]OnThisDay, error) {
+	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	rows, err := Pool.Query(context.Background(),
+		`SELECT h.id, h.timestamp, h.song_name, h.album_name, h.ms_played, h.platform,
+			(SELECT name FROM artists WHERE id = h.artist_id) as artist_name,
+			h.artist_ids
+		FROM history h
+		WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL
+			AND EXTRACT(MONTH FROM h.timestamp) = $2
+			AND EXTRACT(DAY FROM h.timestamp) = $3
+			AND h.timestamp < $4
+		ORDER BY h.timestamp DESC`,
+		userId, int(date.Month()), date.Day(), startOfDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []OnThisDay
+	for rows.Next() {
+		var e ScrobbleEntry
+		err := rows.Scan(&e.Id, &e.Timestamp, &e.SongName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.ArtistName, &e.ArtistIds)
+		if err != nil {
+			return nil, err
+		}
+		year := e.Timestamp.Year()
+		if len(days) == 0 || days[len(days)-1].Year != year {
+			days = append(days, OnThisDay{Year: year})
+		}
+		day := &days[len(days)-1]
+		day.Count++
+		if len(day.Entries) < onThisDayLimit {
+			day.Entries = append(day.Entries, e)
+		}
+	}
+	return days, rows.Err()
+}
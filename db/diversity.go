@@ -0,0 +1,165 @@
+package db
+
+// Listening diversity. Artist metrics are computed over artist credits, so
+// a play of a song with two artists counts for both of them.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type Diversity struct {
+	// Start of the week, month or year, zero for a single period
+	Period        time.Time `json:"period,omitzero"`
+	Scrobbles     int       `json:"scrobbles"`
+	UniqueArtists int       `json:"unique_artists"`
+	UniqueTracks  int       `json:"unique_tracks"`
+	// Unique artists per 100 scrobbles
+	ArtistsPer100 float64 `json:"artists_per_100"`
+	// Shannon entropy of the artist distribution in bits. Listening spread
+	// evenly over 2^n artists has an entropy of n.
+	Entropy float64 `json:"entropy"`
+	// Gini coefficient of the artist distribution, from 0 when every artist
+	// is played equally towards 1 when one artist gets every play
+	Gini float64 `json:"gini"`
+	// Percentage of artist plays going to the 10 most played artists
+	Top10Share int `json:"top10_share"`
+	// The largest n such that n artists (or tracks) were each played at
+	// least n times
+	ArtistEddington int `json:"artist_eddington"`
+	TrackEddington  int `json:"track_eddington"`
+}
+
+// Returns the diversity of the plays matching the filter as a whole
+func GetDiversity(f Filter) (Diversity, error) {
+	points, err := getDiversity(f, "")
+	if err != nil || len(points) == 0 {
+		return Diversity{}, err
+	}
+	d := points[0]
+	d.Period = time.Time{}
+	return d, nil
+}
+
+// Returns the diversity of every week, month or year with plays matching
+// the filter, oldest first
+func GetDiversityTrend(f Filter, interval string) ([]Diversity, error) {
+	switch interval {
+	case "week", "month", "year":
+	default:
+		return nil, fmt.Errorf("unknown interval: %s", interval)
+	}
+	return getDiversity(f, interval)
+}
+
+func getDiversity(f Filter, interval string) ([]Diversity, error) {
+	q := &queryArgs{}
+	period := "TIMESTAMPTZ 'epoch'"
+	if interval != "" {
+		period = "date_trunc(" + q.add(interval) + ", h.timestamp)"
+	}
+	where := f.historyWhere(q)
+
+	// Counts are ranked from most to least played, so the Eddington number
+	// is the number of ranks whose count is at least the rank, and the Gini
+	// coefficient uses the ascending rank n - rn + 1
+	rows, err := Pool.Query(context.Background(),
+		`WITH plays AS (
+			SELECT `+period+` AS period, h.song_name, h.artist, h.artist_ids
+			FROM history h
+			WHERE `+where+`
+		), scrobbles AS (
+			SELECT period, COUNT(*) AS n FROM plays GROUP BY period
+		), artist_counts AS (
+			SELECT period, c,
+				ROW_NUMBER() OVER (PARTITION BY period ORDER BY c DESC) AS rn,
+				COUNT(*) OVER (PARTITION BY period) AS n,
+				SUM(c) OVER (PARTITION BY period)::bigint AS total
+			FROM (
+				SELECT p.period, COUNT(*) AS c
+				FROM plays p, unnest(p.artist_ids) AS a(artist_id)
+				GROUP BY p.period, a.artist_id
+			) c
+		), artists AS (
+			SELECT period, MAX(n) AS unique_artists,
+				-SUM(c::float8 / total * ln(c::float8 / total)) / ln(2) AS entropy,
+				2 * SUM((n - rn + 1) * c)::float8 / (MAX(n) * MAX(total)) - (MAX(n) + 1)::float8 / MAX(n) AS gini,
+				SUM(c) FILTER (WHERE rn <= 10)::bigint * 100 / MAX(total) AS top10_share,
+				COUNT(*) FILTER (WHERE c >= rn) AS eddington
+			FROM artist_counts
+			GROUP BY period
+		), tracks AS (
+			SELECT period, COUNT(*) AS unique_tracks, COUNT(*) FILTER (WHERE c >= rn) AS eddington
+			FROM (
+				SELECT period, COUNT(*) AS c,
+					ROW_NUMBER() OVER (PARTITION BY period ORDER BY COUNT(*) DESC) AS rn
+				FROM plays
+				GROUP BY period, song_name, artist
+			) t
+			GROUP BY period
+		)
+		SELECT s.period, s.n, COALESCE(a.unique_artists, 0), t.unique_tracks,
+			COALESCE(a.entropy, 0), COALESCE(a.gini, 0), COALESCE(a.top10_share, 0),
+			COALESCE(a.eddington, 0), t.eddington
+		FROM scrobbles s
+		JOIN tracks t ON t.period = s.period
+		LEFT JOIN artists a ON a.period = s.period
+		ORDER BY s.period`,
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Diversity
+	for rows.Next() {
+		var d Diversity
+		err := rows.Scan(&d.Period, &d.Scrobbles, &d.UniqueArtists, &d.UniqueTracks,
+			&d.Entropy, &d.Gini, &d.Top10Share, &d.ArtistEddington, &d.TrackEddington)
+		if err != nil {
+			return nil, err
+		}
+		if d.Scrobbles > 0 {
+			d.ArtistsPer100 = float64(d.UniqueArtists) * 100 / float64(d.Scrobbles)
+		}
+		points = append(points, d)
+	}
+	return points, rows.Err()
+}
+
+// Returns the percentage of the user's artist plays matching the filter
+// that went to the 100 most played artists across the users sharing their
+// listening in the same period, and how many users that chart is built
+// from. Only the period of f applies to the chart.
+func GetMainstreamShare(f Filter) (int, int, error) {
+	global, err := GetGlobalTopArtists(Filter{Start: f.Start, End: f.End, Limit: 100})
+	if err != nil {
+		return 0, 0, err
+	}
+	users, err := GetGlobalUserCount()
+	if err != nil {
+		return 0, 0, err
+	}
+	top := make(map[string]bool, len(global))
+	for _, a := range global {
+		top[NormalizeName(a.Name)] = true
+	}
+
+	f.Limit, f.Offset = 0, 0
+	artists, err := GetTopArtists(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	var total, mainstream int
+	for _, a := range artists {
+		total += a.ListenCount
+		if top[NormalizeName(a.Artist.Name)] {
+			mainstream += a.ListenCount
+		}
+	}
+	if total == 0 {
+		return 0, users, nil
+	}
+	return mainstream * 100 / total, users, nil
+}
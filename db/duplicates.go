@@ -0,0 +1,157 @@
+package db
+
+// Finding artists, albums and songs of a user that are likely the same one
+// under different names. Names are compared once folded, ignoring case,
+// accents, punctuation and a leading "The", and by trigram similarity.
+// Albums and songs are only compared with those of the same artist.
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Trigram similarity from which two names are listed as likely the same
+const duplicateSimilarity = 0.6
+
+type DuplicateEntity struct {
+	Id        int
+	Name      string
+	Artist    string
+	Scrobbles int
+}
+
+type DuplicatePair struct {
+	EntityType string
+	A          DuplicateEntity
+	B          DuplicateEntity
+	// Percent similarity of the names, 100 when they only differ in case,
+	// accents or punctuation
+	Similarity int
+}
+
+func CreateDuplicateTables() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE OR REPLACE FUNCTION fold_name(name TEXT) RETURNS TEXT AS $$
+			SELECT regexp_replace(normalize_name(unaccent(name)), '[^[:alnum:]]+', '', 'g')
+		$$ LANGUAGE sql STABLE;
+		CREATE TABLE IF NOT EXISTS duplicate_dismissals (
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			entity_type TEXT NOT NULL,
+			id_a INTEGER NOT NULL,
+			id_b INTEGER NOT NULL,
+			PRIMARY KEY (user_id, entity_type, id_a, id_b)
+		);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating duplicate tables: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// How many scrobbles of the user count for an entity, given the id column
+var duplicateScrobbles = map[string]string{
+	EntityArtist: "(SELECT COUNT(*) FROM history h WHERE h.user_id = $1 AND h.artist_ids @> ARRAY[%s] AND h.deleted_at IS NULL)",
+	EntityAlbum:  "(SELECT COUNT(*) FROM history h WHERE h.user_id = $1 AND h.song_id IN (SELECT id FROM songs WHERE album_id = %s) AND h.deleted_at IS NULL)",
+	EntitySong:   "(SELECT COUNT(*) FROM history h WHERE h.user_id = $1 AND h.song_id = %s AND h.deleted_at IS NULL)",
+}
+
+// Returns up to limit likely duplicates among the user's entities of a type,
+// most similar first, leaving out pairs dismissed as not duplicates
+func GetDuplicates(userId int, entityType string, limit int) ([]DuplicatePair, error) {
+	table, column := entityTables[entityType][0], entityTables[entityType][1]
+	artistId, sameArtist, artistName := "0", "", "''"
+	if entityType != EntityArtist {
+		artistId = "COALESCE(artist_id, 0)"
+		sameArtist = "AND b.artist_id IS NOT DISTINCT FROM a.artist_id"
+		artistName = "COALESCE((SELECT name FROM artists WHERE id = e.artist_id), '')"
+	}
+	scrobbles := fmt.Sprintf(duplicateScrobbles[entityType], "e.id")
+
+	// The self join on the similarity operator uses the trigram index of
+	// the names
+	rows, err := Pool.Query(context.Background(),
+		fmt.Sprintf(`WITH folded AS (
+			SELECT id, %[3]s AS artist_id, fold_name(%[2]s) AS name FROM %[1]s WHERE user_id = $1
+		),
+		pairs AS (
+			SELECT a.id AS a, b.id AS b, 1.0::float8 AS score
+			FROM folded a JOIN folded b ON b.name = a.name AND b.artist_id = a.artist_id AND b.id > a.id
+			WHERE a.name != ''
+			UNION ALL
+			SELECT a.id, b.id, similarity(a.%[2]s, b.%[2]s)::float8
+			FROM %[1]s a JOIN %[1]s b ON b.user_id = a.user_id AND b.%[2]s %% a.%[2]s AND b.id > a.id %[4]s
+			WHERE a.user_id = $1 AND similarity(a.%[2]s, b.%[2]s) >= $2
+		),
+		top AS (
+			SELECT a, b, MAX(score) AS score FROM pairs p
+			WHERE NOT EXISTS (
+				SELECT 1 FROM duplicate_dismissals d
+				WHERE d.user_id = $1 AND d.entity_type = $3 AND d.id_a = p.a AND d.id_b = p.b
+			)
+			GROUP BY a, b
+			ORDER BY 3 DESC, 1, 2
+			LIMIT $4
+		)
+		SELECT t.a, x.name, x.artist, x.scrobbles, t.b, y.name, y.artist, y.scrobbles, round(t.score * 100)::int
+		FROM top t
+		CROSS JOIN LATERAL (SELECT e.%[2]s AS name, %[5]s AS artist, %[6]s AS scrobbles FROM %[1]s e WHERE e.id = t.a) x
+		CROSS JOIN LATERAL (SELECT e.%[2]s AS name, %[5]s AS artist, %[6]s AS scrobbles FROM %[1]s e WHERE e.id = t.b) y
+		ORDER BY t.score DESC, t.a, t.b`,
+			table, column, artistId, sameArtist, artistName, scrobbles),
+		userId, duplicateSimilarity, entityType, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs []DuplicatePair
+	for rows.Next() {
+		p := DuplicatePair{EntityType: entityType}
+		err := rows.Scan(&p.A.Id, &p.A.Name, &p.A.Artist, &p.A.Scrobbles,
+			&p.B.Id, &p.B.Name, &p.B.Artist, &p.B.Scrobbles, &p.Similarity)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs, rows.Err()
+}
+
+// Keeps a pair from being listed as duplicates again
+func DismissDuplicate(userId int, entityType string, idA, idB int) error {
+	if idA > idB {
+		idA, idB = idB, idA
+	}
+	_, err := Pool.Exec(context.Background(),
+		`INSERT INTO duplicate_dismissals (user_id, entity_type, id_a, id_b)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT DO NOTHING`,
+		userId, entityType, idA, idB)
+	return err
+}
+
+func GetDismissedDuplicateCount(userId int) (int, error) {
+	var count int
+	err := Pool.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM duplicate_dismissals WHERE user_id = $1`,
+		userId).Scan(&count)
+	return count, err
+}
+
+// Forgets the dismissed pairs of a merged entity
+func (m *merger) dropDismissals(entityType string, id int) error {
+	_, err := m.tx.Exec(m.ctx,
+		`DELETE FROM duplicate_dismissals
+		WHERE user_id = $1 AND entity_type = $2 AND (id_a = $3 OR id_b = $3)`,
+		m.userId, entityType, id)
+	return err
+}
+
+// Lists every dismissed pair as a likely duplicate again
+func ClearDuplicateDismissals(userId int) error {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM duplicate_dismissals WHERE user_id = $1`,
+		userId)
+	return err
+}
@@ -6,10 +6,21 @@ import (
 	"os"
 	"time"
 
+	"muzi/credits"
+
 	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
+// Either the pool or a transaction, for queries that run on their own as
+// well as part of a larger change
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
 type Artist struct {
 	Id            int
 	UserId        int
@@ -42,19 +53,26 @@ type Song struct {
 }
 
 func GetOrCreateArtist(userId int, name string) (int, bool, error) {
+	return getOrCreateArtist(Pool, userId, name)
+}
+
+func getOrCreateArtist(q querier, userId int, name string) (int, bool, error) {
 	if name == "" {
 		return 0, false, nil
 	}
 
 	var id int
-	err := Pool.QueryRow(context.Background(),
+	err := q.QueryRow(context.Background(),
 		"SELECT id FROM artists WHERE user_id = $1 AND name = $2",
 		userId, name).Scan(&id)
 	if err == nil {
 		return id, false, nil
 	}
+	if id, err := getArtistIdByAlias(q, userId, name); err == nil {
+		return id, false, nil
+	}
 
-	err = Pool.QueryRow(context.Background(),
+	err = q.QueryRow(context.Background(),
 		`INSERT INTO artists (user_id, name) VALUES ($1, $2) 
 		ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
 		RETURNING id`,
@@ -114,19 +132,20 @@ func GetArtistByName(userId int, name string) (Artist, error) {
 	return artist, nil
 }
 
-func UpdateArtist(id int, name, imageUrl, bio, spotifyId, musicbrainzId string) error {
-	_, err := Pool.Exec(context.Background(),
-		`UPDATE artists SET name = $1, image_url = $2, bio = $3, spotify_id = $4, musicbrainz_id = $5 WHERE id = $6`,
-		name, imageUrl, bio, spotifyId, musicbrainzId, id)
-	return err
+func UpdateArtist(userId, id int, name, imageUrl, bio, spotifyId, musicbrainzId string) error {
+	return updateEntity(Pool, userId, EntityArtist, id, 0,
+		`name = $6, image_url = $7, bio = $8, spotify_id = $9, musicbrainz_id = $10`,
+		name, imageUrl, bio, spotifyId, musicbrainzId)
 }
 
 func SearchArtists(userId int, query string) ([]Artist, float64, error) {
 	likePattern := "%" + query + "%"
 	rows, err := Pool.Query(context.Background(),
-		`SELECT id, user_id, name, image_url, bio, spotify_id, musicbrainz_id, similarity(name, $2) as sim
-		FROM artists WHERE user_id = $1 AND (similarity(name, $2) > 0.1 OR LOWER(name) LIKE LOWER($3))
-		ORDER BY similarity(name, $2) DESC LIMIT 20`,
+		`SELECT id, user_id, name, image_url, bio, spotify_id, musicbrainz_id,
+			GREATEST(similarity(name, $2), `+aliasSimilarity(EntityArtist, "artists.id")+`) as sim
+		FROM artists WHERE user_id = $1 AND (similarity(name, $2) > 0.1 OR LOWER(name) LIKE LOWER($3)
+			OR `+aliasMatch(EntityArtist, "id")+`)
+		ORDER BY sim DESC LIMIT 20`,
 		userId, query, likePattern)
 	if err != nil {
 		return nil, 0, err
@@ -164,19 +183,26 @@ func SearchArtists(userId int, query string) ([]Artist, float64, error) {
 }
 
 func GetOrCreateAlbum(userId int, title string, artistId int) (int, bool, error) {
+	return getOrCreateAlbum(Pool, userId, title, artistId)
+}
+
+func getOrCreateAlbum(q querier, userId int, title string, artistId int) (int, bool, error) {
 	if title == "" {
 		return 0, false, nil
 	}
 
 	var id int
-	err := Pool.QueryRow(context.Background(),
+	err := q.QueryRow(context.Background(),
 		"SELECT id FROM albums WHERE user_id = $1 AND title = $2 AND (artist_id = $3 OR (artist_id IS NULL AND $3 IS NULL))",
 		userId, title, artistId).Scan(&id)
 	if err == nil {
 		return id, false, nil
 	}
+	if id, err := getIdByAlias(q, userId, EntityAlbum, title, artistId); err == nil {
+		return id, false, nil
+	}
 
-	err = Pool.QueryRow(context.Background(),
+	err = q.QueryRow(context.Background(),
 		`INSERT INTO albums (user_id, title, artist_id) VALUES ($1, $2, $3) 
 		ON CONFLICT (user_id, title, artist_id) DO UPDATE SET title = EXCLUDED.title
 		RETURNING id`,
@@ -188,6 +214,25 @@ func GetOrCreateAlbum(userId int, title string, artistId int) (int, bool, error)
 	return id, true, nil
 }
 
+// Returns the artist the album of a scrobble goes under, the first artist
+// of its album artist credit, or primary, the first of its track artists,
+// when it has no album artist of its own
+func GetAlbumArtistId(userId int, p *credits.Parser, albumArtist, artist string, primary int) (int, error) {
+	return getAlbumArtistId(Pool, userId, p, albumArtist, artist, primary)
+}
+
+func getAlbumArtistId(q querier, userId int, p *credits.Parser, albumArtist, artist string, primary int) (int, error) {
+	if albumArtist == "" || albumArtist == artist {
+		return primary, nil
+	}
+	names := p.SplitArtists(albumArtist)
+	if len(names) == 0 {
+		return primary, nil
+	}
+	id, _, err := getOrCreateArtist(q, userId, names[0])
+	return id, err
+}
+
 func GetAlbumById(id int) (Album, error) {
 	var album Album
 	err := Pool.QueryRow(context.Background(),
@@ -236,42 +281,40 @@ func GetAlbumByName(userId int, title string, artistId int) (Album, error) {
 	return album, nil
 }
 
-func UpdateAlbum(id int, title, coverUrl, spotifyId, musicbrainzId string) error {
-	_, err := Pool.Exec(context.Background(),
-		`UPDATE albums SET 
-			title = COALESCE(NULLIF($1, ''), title),
-			cover_url = COALESCE(NULLIF($2, ''), cover_url),
-			spotify_id = COALESCE(NULLIF($3, ''), spotify_id),
-			musicbrainz_id = COALESCE(NULLIF($4, ''), musicbrainz_id)
-		WHERE id = $5`,
-		title, coverUrl, spotifyId, musicbrainzId, id)
-	return err
+func UpdateAlbum(userId, id int, title, coverUrl, spotifyId, musicbrainzId string) error {
+	return updateEntity(Pool, userId, EntityAlbum, id, 0,
+		`title = COALESCE(NULLIF($6, ''), title),
+			cover_url = COALESCE(NULLIF($7, ''), cover_url),
+			spotify_id = COALESCE(NULLIF($8, ''), spotify_id),
+			musicbrainz_id = COALESCE(NULLIF($9, ''), musicbrainz_id)`,
+		title, coverUrl, spotifyId, musicbrainzId)
 }
 
-func UpdateAlbumField(id int, field string, value string) error {
-	var query string
+func UpdateAlbumField(userId, id int, field string, value string) error {
+	var set string
 	switch field {
 	case "title":
-		query = "UPDATE albums SET title = $1 WHERE id = $2"
+		set = "title = $6"
 	case "cover_url":
-		query = "UPDATE albums SET cover_url = $1 WHERE id = $2"
+		set = "cover_url = $6"
 	case "spotify_id":
-		query = "UPDATE albums SET spotify_id = $1 WHERE id = $2"
+		set = "spotify_id = $6"
 	case "musicbrainz_id":
-		query = "UPDATE albums SET musicbrainz_id = $1 WHERE id = $2"
+		set = "musicbrainz_id = $6"
 	default:
 		return fmt.Errorf("unknown field: %s", field)
 	}
-	_, err := Pool.Exec(context.Background(), query, value, id)
-	return err
+	return updateEntity(Pool, userId, EntityAlbum, id, 0, set, value)
 }
 
 func SearchAlbums(userId int, query string) ([]Album, float64, error) {
 	likePattern := "%" + query + "%"
 	rows, err := Pool.Query(context.Background(),
-		`SELECT id, user_id, title, artist_id, cover_url, spotify_id, musicbrainz_id, similarity(title, $2) as sim
-		FROM albums WHERE user_id = $1 AND (similarity(title, $2) > 0.1 OR LOWER(title) LIKE LOWER($3))
-		ORDER BY similarity(title, $2) DESC LIMIT 20`,
+		`SELECT id, user_id, title, artist_id, cover_url, spotify_id, musicbrainz_id,
+			GREATEST(similarity(title, $2), `+aliasSimilarity(EntityAlbum, "albums.id")+`) as sim
+		FROM albums WHERE user_id = $1 AND (similarity(title, $2) > 0.1 OR LOWER(title) LIKE LOWER($3)
+			OR `+aliasMatch(EntityAlbum, "id")+`)
+		ORDER BY sim DESC LIMIT 20`,
 		userId, query, likePattern)
 	if err != nil {
 		return nil, 0, err
@@ -308,12 +351,16 @@ func SearchAlbums(userId int, query string) ([]Album, float64, error) {
 }
 
 func GetOrCreateSong(userId int, title string, artistId int, albumId int) (int, bool, error) {
+	return getOrCreateSong(Pool, userId, title, artistId, albumId)
+}
+
+func getOrCreateSong(q querier, userId int, title string, artistId int, albumId int) (int, bool, error) {
 	if title == "" {
 		return 0, false, nil
 	}
 
 	var id int
-	err := Pool.QueryRow(context.Background(),
+	err := q.QueryRow(context.Background(),
 		`SELECT id FROM songs 
 		WHERE user_id = $1 AND title = $2 AND artist_id = $3 
 		AND (album_id = $4 OR (album_id IS NULL AND $4 IS NULL))`,
@@ -321,6 +368,9 @@ func GetOrCreateSong(userId int, title string, artistId int, albumId int) (int,
 	if err == nil {
 		return id, false, nil
 	}
+	if id, err := getIdByAlias(q, userId, EntitySong, title, artistId); err == nil {
+		return id, false, nil
+	}
 
 	var albumIdVal pgtype.Int4
 	if albumId > 0 {
@@ -329,7 +379,7 @@ func GetOrCreateSong(userId int, title string, artistId int, albumId int) (int,
 		albumIdVal.Status = pgtype.Null
 	}
 
-	err = Pool.QueryRow(context.Background(),
+	err = q.QueryRow(context.Background(),
 		`INSERT INTO songs (user_id, title, artist_id, album_id) VALUES ($1, $2, $3, $4) 
 		ON CONFLICT (user_id, title, artist_id, album_id) DO UPDATE SET album_id = EXCLUDED.album_id
 		RETURNING id`,
@@ -447,25 +497,56 @@ func GetSongsByName(userId int, title string, artistId int) ([]Song, error) {
 	return songs, nil
 }
 
-func UpdateSong(id int, title string, durationMs int, spotifyId, musicbrainzId string) error {
-	_, err := Pool.Exec(context.Background(),
-		`UPDATE songs SET title = $1, duration_ms = $2, spotify_id = $3, musicbrainz_id = $4 WHERE id = $5`,
-		title, durationMs, spotifyId, musicbrainzId, id)
+func UpdateSong(userId, id int, title string, durationMs int, spotifyId, musicbrainzId string) error {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = Pool.Exec(context.Background(),
-		`UPDATE history SET song_name = $1 WHERE song_id = $2`,
-		title, id)
-	return err
+	defer tx.Rollback(ctx)
+
+	err = updateEntity(tx, userId, EntitySong, id, 0,
+		`title = $6, duration_ms = $7, spotify_id = $8, musicbrainz_id = $9`,
+		title, durationMs, spotifyId, musicbrainzId)
+	if err != nil {
+		return err
+	}
+	if err := syncSongTitle(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Renames the scrobbles of a song after its title and rebuilds their rollups
+// and charts
+func syncSongTitle(tx pgx.Tx, id int) error {
+	var userId *int
+	var minTs, maxTs *time.Time
+	err := tx.QueryRow(context.Background(),
+		`WITH updated AS (
+			UPDATE history h SET song_name = s.title FROM songs s
+			WHERE s.id = $1 AND h.song_id = s.id AND h.song_name != s.title
+			RETURNING h.user_id, h.timestamp
+		)
+		SELECT MIN(user_id), MIN(timestamp), MAX(timestamp) FROM updated`,
+		id).Scan(&userId, &minTs, &maxTs)
+	if err != nil || userId == nil {
+		return err
+	}
+	if err := refreshDailyRollups(tx, *userId, *minTs, *maxTs); err != nil {
+		return err
+	}
+	return invalidateChartWeeks(tx, *userId, *minTs, *maxTs)
 }
 
 func SearchSongs(userId int, query string) ([]Song, float64, error) {
 	likePattern := "%" + query + "%"
 	rows, err := Pool.Query(context.Background(),
-		`SELECT id, user_id, title, artist_id, album_id, duration_ms, spotify_id, musicbrainz_id, similarity(title, $2) as sim
-		FROM songs WHERE user_id = $1 AND (similarity(title, $2) > 0.1 OR LOWER(title) LIKE LOWER($3))
-		ORDER BY similarity(title, $2) DESC LIMIT 20`,
+		`SELECT id, user_id, title, artist_id, album_id, duration_ms, spotify_id, musicbrainz_id,
+			GREATEST(similarity(title, $2), `+aliasSimilarity(EntitySong, "songs.id")+`) as sim
+		FROM songs WHERE user_id = $1 AND (similarity(title, $2) > 0.1 OR LOWER(title) LIKE LOWER($3)
+			OR `+aliasMatch(EntitySong, "id")+`)
+		ORDER BY sim DESC LIMIT 20`,
 		userId, query, likePattern)
 	if err != nil {
 		return nil, 0, err
@@ -503,17 +584,30 @@ func SearchSongs(userId int, query string) ([]Song, float64, error) {
 	return songs, maxSim, nil
 }
 
-func GetArtistStats(userId, artistId int) (int, error) {
+// Returns the number of listens matching the filter
+func GetListenCount(f Filter) (int, error) {
+	q := &queryArgs{}
+	var query string
+	artistOnly := f
+	artistOnly.ArtistId = 0
+	if f.rollupOnly() {
+		query = "SELECT COALESCE(SUM(r.listen_count), 0) FROM song_daily r WHERE " + f.rollupWhere(q)
+	} else if f.ArtistId != 0 && artistOnly.rollupOnly() {
+		query = "SELECT COALESCE(SUM(r.listen_count), 0) FROM artist_daily r WHERE " +
+			f.rollupWhere(q) + " AND r.artist_id = " + q.add(f.ArtistId)
+	} else {
+		query = "SELECT COUNT(*) FROM history h WHERE " + f.historyWhere(q)
+	}
+
 	var count int
-	err := Pool.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM history WHERE user_id = $1 AND $2 = ANY(artist_ids)",
-		userId, artistId).Scan(&count)
+	err := Pool.QueryRow(context.Background(), query, q.args...).Scan(&count)
 	return count, err
 }
 
 type TopArtist struct {
 	Artist      Artist
 	ListenCount int
+	MsPlayed    int
 }
 
 type TopAlbum struct {
@@ -521,60 +615,38 @@ type TopAlbum struct {
 	Artist      string
 	CoverUrl    string
 	ListenCount int
+	MsPlayed    int
 }
 
 type TopTrack struct {
 	SongName    string
 	Artist      string
 	ListenCount int
+	MsPlayed    int
 }
 
-func GetTopArtists(userId int, limit int, startDate, endDate *time.Time) ([]TopArtist, error) {
-	var err error
-	var rows pgx.Rows
-
-	if startDate == nil && endDate == nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT a.id, a.user_id, a.name, a.image_url, a.bio, a.spotify_id, a.musicbrainz_id, COUNT(*) as listen_count
-			FROM artists a
-			JOIN history h ON h.user_id = a.user_id AND a.id = ANY(h.artist_ids)
-			WHERE h.user_id = $1
-			GROUP BY a.id
-			ORDER BY listen_count DESC
-			LIMIT $2`,
-			userId, limit)
-	} else if startDate != nil && endDate == nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT a.id, a.user_id, a.name, a.image_url, a.bio, a.spotify_id, a.musicbrainz_id, COUNT(*) as listen_count
-			FROM artists a
-			JOIN history h ON h.user_id = a.user_id AND a.id = ANY(h.artist_ids)
-			WHERE h.user_id = $1 AND h.timestamp >= $2
-			GROUP BY a.id
-			ORDER BY listen_count DESC
-			LIMIT $3`,
-			userId, startDate, limit)
-	} else if startDate == nil && endDate != nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT a.id, a.user_id, a.name, a.image_url, a.bio, a.spotify_id, a.musicbrainz_id, COUNT(*) as listen_count
-			FROM artists a
-			JOIN history h ON h.user_id = a.user_id AND a.id = ANY(h.artist_ids)
-			WHERE h.user_id = $1 AND h.timestamp <= $2
-			GROUP BY a.id
-			ORDER BY listen_count DESC
-			LIMIT $3`,
-			userId, endDate, limit)
+func GetTopArtists(f Filter) ([]TopArtist, error) {
+	q := &queryArgs{}
+	var query string
+	if f.rollupOnly() {
+		query = `SELECT a.id, a.user_id, a.name, a.image_url, a.bio, a.spotify_id, a.musicbrainz_id,
+			SUM(r.listen_count) as listen_count, SUM(r.ms_played)::bigint as ms_played
+		FROM artist_daily r
+		JOIN artists a ON a.id = r.artist_id
+		WHERE ` + f.rollupWhere(q) + `
+		GROUP BY a.id
+		ORDER BY ` + f.topOrder("a.name") + f.page(q)
 	} else {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT a.id, a.user_id, a.name, a.image_url, a.bio, a.spotify_id, a.musicbrainz_id, COUNT(*) as listen_count
-			FROM artists a
-			JOIN history h ON h.user_id = a.user_id AND a.id = ANY(h.artist_ids)
-			WHERE h.user_id = $1 AND h.timestamp >= $2 AND h.timestamp <= $3
-			GROUP BY a.id
-			ORDER BY listen_count DESC
-			LIMIT $4`,
-			userId, startDate, endDate, limit)
+		query = `SELECT a.id, a.user_id, a.name, a.image_url, a.bio, a.spotify_id, a.musicbrainz_id,
+			COUNT(*) as listen_count, COALESCE(SUM(h.ms_played), 0) as ms_played
+		FROM history h
+		JOIN artists a ON a.id = ANY(h.artist_ids)
+		WHERE ` + f.historyWhere(q) + `
+		GROUP BY a.id
+		ORDER BY ` + f.topOrder("a.name") + f.page(q)
 	}
 
+	rows, err := Pool.Query(context.Background(), query, q.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -583,9 +655,9 @@ func GetTopArtists(userId int, limit int, startDate, endDate *time.Time) ([]TopA
 	var topArtists []TopArtist
 	for rows.Next() {
 		var a Artist
-		var count int
+		var count, msPlayed int
 		var imageUrlPg, bioPg, spotifyIdPg, musicbrainzIdPg pgtype.Text
-		err := rows.Scan(&a.Id, &a.UserId, &a.Name, &imageUrlPg, &bioPg, &spotifyIdPg, &musicbrainzIdPg, &count)
+		err := rows.Scan(&a.Id, &a.UserId, &a.Name, &imageUrlPg, &bioPg, &spotifyIdPg, &musicbrainzIdPg, &count, &msPlayed)
 		if err != nil {
 			return nil, err
 		}
@@ -593,57 +665,42 @@ func GetTopArtists(userId int, limit int, startDate, endDate *time.Time) ([]TopA
 		a.Bio = bioPg.String
 		a.SpotifyId = spotifyIdPg.String
 		a.MusicbrainzId = musicbrainzIdPg.String
-		topArtists = append(topArtists, TopArtist{Artist: a, ListenCount: count})
+		topArtists = append(topArtists, TopArtist{Artist: a, ListenCount: count, MsPlayed: msPlayed})
 	}
 	return topArtists, nil
 }
 
-func GetTopAlbums(userId int, limit int, startDate, endDate *time.Time) ([]TopAlbum, error) {
-	var err error
-	var rows pgx.Rows
-
-	if startDate == nil && endDate == nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT h.album_name, h.artist, COALESCE(a.cover_url, ''), COUNT(*) as listen_count
-			FROM history h
-			LEFT JOIN albums a ON a.user_id = h.user_id AND a.title = h.album_name AND a.artist_id IN (SELECT id FROM artists WHERE user_id = h.user_id AND name = h.artist)
-			WHERE h.user_id = $1 AND h.album_name IS NOT NULL AND h.album_name != ''
-			GROUP BY h.album_name, h.artist, a.cover_url
-			ORDER BY listen_count DESC
-			LIMIT $2`,
-			userId, limit)
-	} else if startDate != nil && endDate == nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT h.album_name, h.artist, COALESCE(a.cover_url, ''), COUNT(*) as listen_count
-			FROM history h
-			LEFT JOIN albums a ON a.user_id = h.user_id AND a.title = h.album_name AND a.artist_id IN (SELECT id FROM artists WHERE user_id = h.user_id AND name = h.artist)
-			WHERE h.user_id = $1 AND h.timestamp >= $2 AND h.album_name IS NOT NULL AND h.album_name != ''
-			GROUP BY h.album_name, h.artist, a.cover_url
-			ORDER BY listen_count DESC
-			LIMIT $3`,
-			userId, startDate, limit)
-	} else if startDate == nil && endDate != nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT h.album_name, h.artist, COALESCE(a.cover_url, ''), COUNT(*) as listen_count
-			FROM history h
-			LEFT JOIN albums a ON a.user_id = h.user_id AND a.title = h.album_name AND a.artist_id IN (SELECT id FROM artists WHERE user_id = h.user_id AND name = h.artist)
-			WHERE h.user_id = $1 AND h.timestamp <= $2 AND h.album_name IS NOT NULL AND h.album_name != ''
-			GROUP BY h.album_name, h.artist, a.cover_url
-			ORDER BY listen_count DESC
-			LIMIT $3`,
-			userId, endDate, limit)
+func GetTopAlbums(f Filter) ([]TopAlbum, error) {
+	q := &queryArgs{}
+	var inner string
+	if f.rollupOnly() {
+		inner = `SELECT r.album_name, r.artist, SUM(r.listen_count) as listen_count, SUM(r.ms_played)::bigint as ms_played
+			FROM album_daily r
+			WHERE ` + f.rollupWhere(q) + `
+			GROUP BY r.album_name, r.artist`
 	} else {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT h.album_name, h.artist, COALESCE(a.cover_url, ''), COUNT(*) as listen_count
+		inner = `SELECT h.album_name, ` + albumArtistColumn + ` AS artist, COUNT(*) as listen_count, COALESCE(SUM(h.ms_played), 0) as ms_played
 			FROM history h
-			LEFT JOIN albums a ON a.user_id = h.user_id AND a.title = h.album_name AND a.artist_id IN (SELECT id FROM artists WHERE user_id = h.user_id AND name = h.artist)
-			WHERE h.user_id = $1 AND h.timestamp >= $2 AND h.timestamp <= $3 AND h.album_name IS NOT NULL AND h.album_name != ''
-			GROUP BY h.album_name, h.artist, a.cover_url
-			ORDER BY listen_count DESC
-			LIMIT $4`,
-			userId, startDate, endDate, limit)
-	}
-
+			WHERE ` + f.historyWhere(q) + ` AND h.album_name IS NOT NULL AND h.album_name != ''
+			GROUP BY h.album_name, ` + albumArtistColumn
+	}
+	order := f.topOrder("album_name, artist")
+	query := `SELECT t.album_name, t.artist, COALESCE(c.cover_url, ''), t.listen_count, t.ms_played
+		FROM (` + inner + ` ORDER BY ` + order + f.page(q) + `) t
+		LEFT JOIN LATERAL (
+			SELECT al.cover_url FROM albums al
+			WHERE al.user_id = $1 AND al.title = t.album_name
+				AND EXISTS (
+					SELECT 1 FROM songs s JOIN history h ON h.song_id = s.id
+					WHERE s.album_id = al.id AND h.album_name = t.album_name
+						AND ` + albumArtistColumn + ` = t.artist
+				)
+			ORDER BY al.cover_url IS NULL
+			LIMIT 1
+		) c ON true
+		ORDER BY ` + order
+
+	rows, err := Pool.Query(context.Background(), query, q.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -652,58 +709,34 @@ func GetTopAlbums(userId int, limit int, startDate, endDate *time.Time) ([]TopAl
 	var topAlbums []TopAlbum
 	for rows.Next() {
 		var albumName, artist, coverUrl string
-		var count int
-		err := rows.Scan(&albumName, &artist, &coverUrl, &count)
+		var count, msPlayed int
+		err := rows.Scan(&albumName, &artist, &coverUrl, &count, &msPlayed)
 		if err != nil {
 			return nil, err
 		}
-		topAlbums = append(topAlbums, TopAlbum{AlbumName: albumName, Artist: artist, CoverUrl: coverUrl, ListenCount: count})
+		topAlbums = append(topAlbums, TopAlbum{AlbumName: albumName, Artist: artist, CoverUrl: coverUrl, ListenCount: count, MsPlayed: msPlayed})
 	}
 	return topAlbums, nil
 }
 
-func GetTopTracks(userId int, limit int, startDate, endDate *time.Time) ([]TopTrack, error) {
-	var err error
-	var rows pgx.Rows
-
-	if startDate == nil && endDate == nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT song_name, artist, COUNT(*) as listen_count
-			FROM history
-			WHERE user_id = $1
-			GROUP BY song_name, artist
-			ORDER BY listen_count DESC
-			LIMIT $2`,
-			userId, limit)
-	} else if startDate != nil && endDate == nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT song_name, artist, COUNT(*) as listen_count
-			FROM history
-			WHERE user_id = $1 AND timestamp >= $2
-			GROUP BY song_name, artist
-			ORDER BY listen_count DESC
-			LIMIT $3`,
-			userId, startDate, limit)
-	} else if startDate == nil && endDate != nil {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT song_name, artist, COUNT(*) as listen_count
-			FROM history
-			WHERE user_id = $1 AND timestamp <= $2
-			GROUP BY song_name, artist
-			ORDER BY listen_count DESC
-			LIMIT $3`,
-			userId, endDate, limit)
+func GetTopTracks(f Filter) ([]TopTrack, error) {
+	q := &queryArgs{}
+	var query string
+	if f.rollupOnly() {
+		query = `SELECT r.song_name, r.artist, SUM(r.listen_count) as listen_count, SUM(r.ms_played)::bigint as ms_played
+		FROM song_daily r
+		WHERE ` + f.rollupWhere(q) + `
+		GROUP BY r.song_name, r.artist
+		ORDER BY ` + f.topOrder("r.song_name, r.artist") + f.page(q)
 	} else {
-		rows, err = Pool.Query(context.Background(),
-			`SELECT song_name, artist, COUNT(*) as listen_count
-			FROM history
-			WHERE user_id = $1 AND timestamp >= $2 AND timestamp <= $3
-			GROUP BY song_name, artist
-			ORDER BY listen_count DESC
-			LIMIT $4`,
-			userId, startDate, endDate, limit)
+		query = `SELECT h.song_name, h.artist, COUNT(*) as listen_count, COALESCE(SUM(h.ms_played), 0) as ms_played
+		FROM history h
+		WHERE ` + f.historyWhere(q) + `
+		GROUP BY h.song_name, h.artist
+		ORDER BY ` + f.topOrder("h.song_name, h.artist") + f.page(q)
 	}
 
+	rows, err := Pool.Query(context.Background(), query, q.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -712,76 +745,27 @@ func GetTopTracks(userId int, limit int, startDate, endDate *time.Time) ([]TopTr
 	var topTracks []TopTrack
 	for rows.Next() {
 		var songName, artist string
-		var count int
-		err := rows.Scan(&songName, &artist, &count)
+		var count, msPlayed int
+		err := rows.Scan(&songName, &artist, &count, &msPlayed)
 		if err != nil {
 			return nil, err
 		}
-		topTracks = append(topTracks, TopTrack{SongName: songName, Artist: artist, ListenCount: count})
+		topTracks = append(topTracks, TopTrack{SongName: songName, Artist: artist, ListenCount: count, MsPlayed: msPlayed})
 	}
 	return topTracks, nil
 }
 
-func GetSongStats(userId, songId int) (int, error) {
-	var count int
-	err := Pool.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM history WHERE user_id = $1 AND song_id = $2",
-		userId, songId).Scan(&count)
-	return count, err
-}
-
-func MergeArtists(userId int, fromArtistId, toArtistId int) error {
-	_, err := Pool.Exec(context.Background(),
-		`UPDATE history SET artist_id = $1 WHERE user_id = $2 AND artist_id = $3`,
-		toArtistId, userId, fromArtistId)
-	if err != nil {
-		return err
-	}
-	_, err = Pool.Exec(context.Background(),
-		`UPDATE songs SET artist_id = $1 WHERE user_id = $2 AND artist_id = $3`,
-		toArtistId, userId, fromArtistId)
-	if err != nil {
-		return err
-	}
-	_, err = Pool.Exec(context.Background(),
-		`DELETE FROM artists WHERE id = $1 AND user_id = $2`,
-		fromArtistId, userId)
-	return err
-}
-
-func GetHistoryForArtist(userId, artistId int, limit, offset int) ([]ScrobbleEntry, error) {
-	rows, err := Pool.Query(context.Background(),
-		`SELECT h.timestamp, h.song_name, h.album_name, h.ms_played, h.platform,
-			(SELECT name FROM artists WHERE id = h.artist_id) as artist_name,
-			h.artist_ids
-		FROM history h WHERE h.user_id = $1 AND $2 = ANY(h.artist_ids) 
-		ORDER BY h.timestamp DESC LIMIT $3 OFFSET $4`,
-		userId, artistId, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var entries []ScrobbleEntry
-	for rows.Next() {
-		var e ScrobbleEntry
-		err := rows.Scan(&e.Timestamp, &e.SongName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.ArtistName, &e.ArtistIds)
-		if err != nil {
-			return nil, err
-		}
-		entries = append(entries, e)
-	}
-	return entries, nil
-}
-
-func GetHistoryForSong(userId, songId int, limit, offset int) ([]ScrobbleEntry, error) {
+// Returns the scrobbles matching the filter, newest first unless sorted
+// with SortOldest
+func GetHistory(f Filter) ([]ScrobbleEntry, error) {
+	q := &queryArgs{}
 	rows, err := Pool.Query(context.Background(),
-		`SELECT h.timestamp, h.song_name, h.album_name, h.ms_played, h.platform,
-			(SELECT name FROM artists WHERE id = h.artist_id) as artist_name,
-			h.artist_ids
-		FROM history h WHERE h.user_id = $1 AND h.song_id = $2 
-		ORDER BY h.timestamp DESC LIMIT $3 OFFSET $4`,
-		userId, songId, limit, offset)
+		`SELECT h.id, h.timestamp, h.song_name, COALESCE(h.album_name, ''), COALESCE(h.ms_played, 0),
+			COALESCE(h.platform, ''), COALESCE((SELECT name FROM artists WHERE id = h.artist_id), '') as artist_name,
+			h.artist_ids, COALESCE(h.client, ''), h.skipped OR h.skip_flagged
+		FROM history h WHERE `+f.historyWhere(q)+`
+		ORDER BY `+f.historyOrder()+f.page(q),
+		q.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -790,7 +774,7 @@ func GetHistoryForSong(userId, songId int, limit, offset int) ([]ScrobbleEntry,
 	var entries []ScrobbleEntry
 	for rows.Next() {
 		var e ScrobbleEntry
-		err := rows.Scan(&e.Timestamp, &e.SongName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.ArtistName, &e.ArtistIds)
+		err := rows.Scan(&e.Id, &e.Timestamp, &e.SongName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.ArtistName, &e.ArtistIds, &e.Client, &e.Skipped)
 		if err != nil {
 			return nil, err
 		}
@@ -800,19 +784,21 @@ func GetHistoryForSong(userId, songId int, limit, offset int) ([]ScrobbleEntry,
 }
 
 type ScrobbleEntry struct {
-	Id         int
-	Timestamp  time.Time
-	SongName   string
-	ArtistName string
-	AlbumName  string
-	MsPlayed   int
-	Platform   string
-	ArtistIds  []int
+	Id         int       `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	SongName   string    `json:"song_name"`
+	ArtistName string    `json:"artist"`
+	AlbumName  string    `json:"album_name"`
+	MsPlayed   int       `json:"ms_played"`
+	Platform   string    `json:"platform"`
+	Client     string    `json:"client"`
+	ArtistIds  []int     `json:"artist_ids"`
+	Skipped    bool      `json:"skipped"`
 }
 
 func MigrateHistoryEntities() error {
 	rows, err := Pool.Query(context.Background(),
-		`SELECT DISTINCT h.user_id, h.artist, h.song_name, h.album_name 
+		`SELECT DISTINCT h.user_id, h.artist, h.song_name, h.album_name, `+albumArtistColumn+`
 		FROM history h 
 		WHERE h.artist_id IS NULL OR h.song_id IS NULL`)
 	if err != nil {
@@ -822,20 +808,21 @@ func MigrateHistoryEntities() error {
 	defer rows.Close()
 
 	type UniqueEntity struct {
-		UserId   int
-		Artist   string
-		SongName string
-		Album    string
+		UserId      int
+		Artist      string
+		SongName    string
+		Album       string
+		AlbumArtist string
 	}
 
 	var entities []UniqueEntity
 	seen := make(map[string]bool)
 	for rows.Next() {
 		var r UniqueEntity
-		if err := rows.Scan(&r.UserId, &r.Artist, &r.SongName, &r.Album); err != nil {
+		if err := rows.Scan(&r.UserId, &r.Artist, &r.SongName, &r.Album, &r.AlbumArtist); err != nil {
 			continue
 		}
-		key := fmt.Sprintf("%d-%s-%s-%s", r.UserId, r.Artist, r.SongName, r.Album)
+		key := fmt.Sprintf("%d-%s-%s-%s-%s", r.UserId, r.Artist, r.SongName, r.Album, r.AlbumArtist)
 		if !seen[key] {
 			seen[key] = true
 			entities = append(entities, r)
@@ -846,24 +833,27 @@ func MigrateHistoryEntities() error {
 	albumIds := make(map[string]int)
 
 	for _, e := range entities {
-		if e.Artist == "" {
-			continue
-		}
-		key := fmt.Sprintf("%d-%s", e.UserId, e.Artist)
-		if _, exists := artistIds[key]; !exists {
-			id, _, err := GetOrCreateArtist(e.UserId, e.Artist)
-			if err != nil {
+		for _, name := range []string{e.Artist, e.AlbumArtist} {
+			if name == "" {
 				continue
 			}
-			artistIds[key] = id
+			key := fmt.Sprintf("%d-%s", e.UserId, name)
+			if _, exists := artistIds[key]; !exists {
+				id, _, err := GetOrCreateArtist(e.UserId, name)
+				if err != nil {
+					continue
+				}
+				artistIds[key] = id
+			}
 		}
 	}
 
+	// Albums go under their album artist
 	for _, e := range entities {
-		if e.Album == "" || e.Artist == "" {
+		if e.Album == "" || e.AlbumArtist == "" {
 			continue
 		}
-		artistKey := fmt.Sprintf("%d-%s", e.UserId, e.Artist)
+		artistKey := fmt.Sprintf("%d-%s", e.UserId, e.AlbumArtist)
 		artistId, ok := artistIds[artistKey]
 		if !ok {
 			continue
@@ -890,7 +880,8 @@ func MigrateHistoryEntities() error {
 
 		var albumId int
 		if e.Album != "" {
-			albumKey := fmt.Sprintf("%d-%s-%d", e.UserId, e.Album, artistId)
+			albumArtistId := artistIds[fmt.Sprintf("%d-%s", e.UserId, e.AlbumArtist)]
+			albumKey := fmt.Sprintf("%d-%s-%d", e.UserId, e.Album, albumArtistId)
 			albumId = albumIds[albumKey]
 		}
 
@@ -912,92 +903,42 @@ func MigrateHistoryEntities() error {
 	return nil
 }
 
-func GetAlbumStats(userId, albumId int) (int, error) {
-	var count int
-	err := Pool.QueryRow(context.Background(),
-		`SELECT COUNT(*) FROM history h 
-		JOIN songs s ON h.song_id = s.id 
-		WHERE h.user_id = $1 AND s.album_id = $2`,
-		userId, albumId).Scan(&count)
-	return count, err
-}
-
-func GetHistoryForAlbum(userId, albumId int, limit, offset int) ([]ScrobbleEntry, error) {
-	rows, err := Pool.Query(context.Background(),
-		`SELECT h.timestamp, h.song_name, h.album_name, h.ms_played, h.platform,
-			(SELECT name FROM artists WHERE id = h.artist_id) as artist_name,
-			h.artist_ids
-		FROM history h
-		JOIN songs s ON h.song_id = s.id
-		WHERE h.user_id = $1 AND s.album_id = $2 
-		ORDER BY h.timestamp DESC LIMIT $3 OFFSET $4`,
-		userId, albumId, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var entries []ScrobbleEntry
-	for rows.Next() {
-		var e ScrobbleEntry
-		err := rows.Scan(&e.Timestamp, &e.SongName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.ArtistName, &e.ArtistIds)
-		if err != nil {
-			return nil, err
-		}
-		entries = append(entries, e)
-	}
-	return entries, nil
-}
-
-func GetSongStatsForSongs(userId int, songIds []int) (int, error) {
-	if len(songIds) == 0 {
-		return 0, nil
-	}
-	var count int
-	err := Pool.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM history WHERE user_id = $1 AND song_id = ANY($2)",
-		userId, songIds).Scan(&count)
-	return count, err
-}
-
-func GetHistoryForSongs(userId int, songIds []int, limit, offset int) ([]ScrobbleEntry, error) {
-	if len(songIds) == 0 {
-		return []ScrobbleEntry{}, nil
-	}
-	rows, err := Pool.Query(context.Background(),
-		`SELECT h.id, h.timestamp, h.song_name, h.album_name, h.ms_played, h.platform,
-			(SELECT name FROM artists WHERE id = h.artist_id) as artist_name,
-			h.artist_ids
-		FROM history h WHERE h.user_id = $1 AND h.song_id = ANY($2) 
-		ORDER BY h.timestamp DESC LIMIT $3 OFFSET $4`,
-		userId, songIds, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var entries []ScrobbleEntry
-	for rows.Next() {
-		var e ScrobbleEntry
-		err := rows.Scan(&e.Id, &e.Timestamp, &e.SongName, &e.AlbumName, &e.MsPlayed, &e.Platform, &e.ArtistName, &e.ArtistIds)
-		if err != nil {
-			return nil, err
-		}
-		entries = append(entries, e)
-	}
-	return entries, nil
-}
-
+// Moves the scrobbles to the trash, from where they can be restored until
+// they are purged
 func DeleteHistoryByIds(userId int, ids []int) error {
 	if len(ids) == 0 {
 		return nil
 	}
-	_, err := Pool.Exec(context.Background(),
-		`DELETE FROM history WHERE user_id = $1 AND id = ANY($2)`,
-		userId, ids)
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var minTs, maxTs *time.Time
+	err = tx.QueryRow(ctx,
+		`WITH deleted AS (
+			UPDATE history SET deleted_at = NOW()
+			WHERE user_id = $1 AND id = ANY($2) AND deleted_at IS NULL
+			RETURNING *
+		),
+		logged AS (
+			INSERT INTO change_log (user_id, kind, before, after)
+			SELECT $1, $3::text, jsonb_agg(to_jsonb(deleted)), '[]' FROM deleted
+			HAVING COUNT(*) > 0
+		)
+		SELECT MIN(timestamp), MAX(timestamp) FROM deleted`,
+		userId, ids, ChangeHistoryDelete).Scan(&minTs, &maxTs)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error deleting history: %v\n", err)
 		return err
 	}
-	return nil
+	if minTs == nil {
+		return nil
+	}
+	if err := refreshDailyRollups(tx, userId, *minTs, *maxTs); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
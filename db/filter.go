@@ -0,0 +1,220 @@
+package db
+
+// Filter shared by the stats and history queries, and the helpers that turn
+// it into SQL conditions with numbered arguments
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SortPlays  = "plays"
+	SortTime   = "time"
+	SortName   = "name"
+	SortRecent = "recent"
+	SortOldest = "oldest"
+)
+
+type Filter struct {
+	UserId int
+	// Start is inclusive and End is exclusive, either may be nil
+	Start     *time.Time
+	End       *time.Time
+	Platforms []string
+	ArtistId  int
+	AlbumId   int
+	SongIds   []int
+	// Album name as it was scrobbled, matched case insensitively
+	AlbumName string
+	// Text to look for in the track, artist or album name
+	Search      string
+	MinMsPlayed int
+	// Only plays whose song, album or an artist has this tag
+	Tag string
+	// Skipped plays are left out unless this is set
+	IncludeSkips bool
+	// Only plays after the cursor in the order of historyOrder, used
+	// instead of Offset for paging through history
+	Cursor *HistoryCursor
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// Position of a play in the history, ordered by timestamp and then id
+type HistoryCursor struct {
+	Timestamp time.Time
+	Id        int
+}
+
+// Collects query arguments and hands out their placeholders
+type queryArgs struct {
+	args []any
+}
+
+func (q *queryArgs) add(v any) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// True when the filter only limits by user and whole days, so the daily
+// rollups can answer it. Periods starting or ending within a day are
+// counted from history so they come out the same with any other filter.
+func (f Filter) rollupOnly() bool {
+	return len(f.Platforms) == 0 && f.ArtistId == 0 && f.AlbumId == 0 &&
+		len(f.SongIds) == 0 && f.AlbumName == "" && f.Search == "" &&
+		f.MinMsPlayed == 0 && f.Tag == "" && !f.IncludeSkips && f.Cursor == nil &&
+		isDayStart(f.Start) && isDayStart(f.End)
+}
+
+// True for nil and for midnight in the time zone the rollups are bucketed
+// in. False for everything else if that zone is unknown.
+func isDayStart(t *time.Time) bool {
+	if t == nil {
+		return true
+	}
+	loc := rollupZone()
+	if loc == nil {
+		return false
+	}
+	y, m, d := t.In(loc).Date()
+	return t.Equal(time.Date(y, m, d, 0, 0, 0, 0, loc))
+}
+
+var (
+	rollupZoneMu  sync.Mutex
+	rollupZoneLoc *time.Location
+)
+
+// The database's time zone, in which timestamp::date and so the daily
+// rollups split days. Nil if it can't be read or isn't known to Go.
+func rollupZone() *time.Location {
+	rollupZoneMu.Lock()
+	defer rollupZoneMu.Unlock()
+	if rollupZoneLoc != nil {
+		return rollupZoneLoc
+	}
+
+	var name string
+	err := Pool.QueryRow(context.Background(), "SELECT current_setting('TimeZone')").Scan(&name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get database time zone: %v\n", err)
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load database time zone: %v\n", err)
+		return nil
+	}
+	rollupZoneLoc = loc
+	return loc
+}
+
+// Conditions on the history table under alias h. Deleted plays are always
+// left out.
+func (f Filter) historyWhere(q *queryArgs) string {
+	conds := []string{"h.user_id = " + q.add(f.UserId), "h.deleted_at IS NULL"}
+	if f.Start != nil {
+		conds = append(conds, "h.timestamp >= "+q.add(*f.Start))
+	}
+	if f.End != nil {
+		conds = append(conds, "h.timestamp < "+q.add(*f.End))
+	}
+	if len(f.Platforms) > 0 {
+		conds = append(conds, "h.platform = ANY("+q.add(f.Platforms)+")")
+	}
+	if f.ArtistId != 0 {
+		conds = append(conds, q.add(f.ArtistId)+" = ANY(h.artist_ids)")
+	}
+	if f.AlbumId != 0 {
+		conds = append(conds, "h.song_id IN (SELECT id FROM songs WHERE album_id = "+q.add(f.AlbumId)+")")
+	}
+	if len(f.SongIds) > 0 {
+		conds = append(conds, "h.song_id = ANY("+q.add(f.SongIds)+")")
+	}
+	if f.AlbumName != "" {
+		conds = append(conds, "h.album_name ILIKE "+q.add(escapeLike(f.AlbumName)))
+	}
+	if f.Search != "" {
+		pattern := q.add("%" + escapeLike(f.Search) + "%")
+		conds = append(conds, "(h.song_name ILIKE "+pattern+" OR h.artist ILIKE "+pattern+" OR h.album_name ILIKE "+pattern+")")
+	}
+	if f.MinMsPlayed > 0 {
+		conds = append(conds, "h.ms_played >= "+q.add(f.MinMsPlayed))
+	}
+	if f.Tag != "" {
+		conds = append(conds, `EXISTS (SELECT 1 FROM tags t JOIN entity_tags et ON et.tag_id = t.id
+			WHERE t.user_id = h.user_id AND t.name = `+q.add(NormalizeTag(f.Tag))+` AND `+tagMatch+`)`)
+	}
+	if !f.IncludeSkips {
+		conds = append(conds, "NOT h.skipped")
+	}
+	if f.Cursor != nil {
+		op := "<"
+		if f.Sort == SortOldest {
+			op = ">"
+		}
+		conds = append(conds, "(h.timestamp, h.id) "+op+" ("+q.add(f.Cursor.Timestamp)+", "+q.add(f.Cursor.Id)+")")
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// Conditions on a daily rollup table under alias r. Times are rounded down
+// to whole days, see rollupOnly.
+func (f Filter) rollupWhere(q *queryArgs) string {
+	conds := append([]string{"r.user_id = " + q.add(f.UserId)}, f.rollupDays(q)...)
+	return strings.Join(conds, " AND ")
+}
+
+// Conditions limiting a daily rollup table under alias r to the period
+func (f Filter) rollupDays(q *queryArgs) []string {
+	var conds []string
+	if f.Start != nil {
+		conds = append(conds, "r.day >= "+q.add(*f.Start)+"::timestamptz::date")
+	}
+	if f.End != nil {
+		conds = append(conds, "r.day < "+q.add(*f.End)+"::timestamptz::date")
+	}
+	return conds
+}
+
+// ORDER BY for aggregated top lists, given the expression for the name
+func (f Filter) topOrder(name string) string {
+	switch f.Sort {
+	case SortTime:
+		return "ms_played DESC, listen_count DESC"
+	case SortName:
+		return name
+	default:
+		return "listen_count DESC, ms_played DESC"
+	}
+}
+
+// ORDER BY for history listings
+func (f Filter) historyOrder() string {
+	if f.Sort == SortOldest {
+		return "h.timestamp ASC, h.id ASC"
+	}
+	return "h.timestamp DESC, h.id DESC"
+}
+
+// Escapes the wildcards in a LIKE pattern so s matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (f Filter) page(q *queryArgs) string {
+	var s string
+	if f.Limit > 0 {
+		s += " LIMIT " + q.add(f.Limit)
+	}
+	if f.Offset > 0 {
+		s += " OFFSET " + q.add(f.Offset)
+	}
+	return s
+}
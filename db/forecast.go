@@ -0,0 +1,178 @@
+package db
+
+// Listening pace and simple linear projections. The yearly forecast assumes
+// the rest of the year goes like the year so far; artist forecasts use the
+// pace of the last forecastWindow. Both are computed from the daily rollups.
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+)
+
+const forecastWindow = 90 * 24 * time.Hour
+
+// Scrobble counts reported as milestones, see GetScrobbleMilestones
+var scrobbleMilestoneCounts = []int{100, 500, 1000, 5000}
+
+type Forecast struct {
+	Year          int     `json:"year"`
+	YearScrobbles int     `json:"year_scrobbles"`
+	DaysElapsed   int     `json:"days_elapsed"`
+	DaysInYear    int     `json:"days_in_year"`
+	PerDay        float64 `json:"per_day"`
+	ProjectedYear int     `json:"projected_year_end"`
+	Total         int     `json:"total"`
+	NextMilestone int     `json:"next_milestone"`
+	// Zero when nothing was played this year
+	MilestoneDays int       `json:"milestone_days,omitempty"`
+	MilestoneDate time.Time `json:"milestone_date,omitzero"`
+	// Scrobbles so far this year at the end of every day up to today
+	Days []DayCount `json:"days"`
+}
+
+type DayCount struct {
+	Day        time.Time `json:"day"`
+	Cumulative int       `json:"cumulative"`
+}
+
+type ArtistForecast struct {
+	ArtistId      int       `json:"artist_id"`
+	Name          string    `json:"name"`
+	Plays         int       `json:"plays"`
+	PerDay        float64   `json:"per_day"`
+	NextMilestone int       `json:"next_milestone"`
+	Date          time.Time `json:"date"`
+}
+
+// Returns the next round number of plays after count, following the
+// scrobble milestones and then every 10,000th
+func NextScrobbleMilestone(count int) int {
+	for _, m := range scrobbleMilestoneCounts {
+		if count < m {
+			return m
+		}
+	}
+	return (count/10000 + 1) * 10000
+}
+
+// Returns the next artist milestone after count, following the artist
+// milestones and then every 5,000th
+func NextArtistMilestone(count int) int {
+	for _, m := range artistMilestoneCounts {
+		if count < m {
+			return m
+		}
+	}
+	return (count/5000 + 1) * 5000
+}
+
+// Days needed to add remaining plays at perDay, rounded up
+func daysToReach(remaining int, perDay float64) int {
+	if perDay <= 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(remaining) / perDay))
+}
+
+// Returns the pace of the current year as of now and what it projects
+func GetForecast(userId int, now time.Time) (Forecast, error) {
+	yearStart := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	f := Forecast{
+		Year:        now.Year(),
+		DaysElapsed: today.YearDay(),
+		DaysInYear:  yearStart.AddDate(1, 0, -1).YearDay(),
+	}
+
+	err := Pool.QueryRow(context.Background(),
+		`SELECT COALESCE(SUM(listen_count), 0) FROM song_daily WHERE user_id = $1`,
+		userId).Scan(&f.Total)
+	if err != nil {
+		return f, err
+	}
+
+	rows, err := Pool.Query(context.Background(),
+		`SELECT day, SUM(listen_count)::int
+		FROM song_daily
+		WHERE user_id = $1 AND day >= $2::date
+		GROUP BY 1`,
+		userId, yearStart)
+	if err != nil {
+		return f, err
+	}
+	perDay := make(map[string]int)
+	for rows.Next() {
+		var day time.Time
+		var n int
+		if err := rows.Scan(&day, &n); err != nil {
+			rows.Close()
+			return f, err
+		}
+		perDay[day.Format(time.DateOnly)] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return f, err
+	}
+
+	for day := yearStart; !day.After(today); day = day.AddDate(0, 0, 1) {
+		f.YearScrobbles += perDay[day.Format(time.DateOnly)]
+		f.Days = append(f.Days, DayCount{Day: day, Cumulative: f.YearScrobbles})
+	}
+
+	f.PerDay = float64(f.YearScrobbles) / float64(f.DaysElapsed)
+	f.ProjectedYear = f.YearScrobbles + int(math.Round(f.PerDay*float64(f.DaysInYear-f.DaysElapsed)))
+	f.NextMilestone = NextScrobbleMilestone(f.Total)
+	if f.MilestoneDays = daysToReach(f.NextMilestone-f.Total, f.PerDay); f.MilestoneDays > 0 {
+		f.MilestoneDate = today.AddDate(0, 0, f.MilestoneDays)
+	}
+	return f, nil
+}
+
+// Returns when artists played in the last forecastWindow reach their next
+// milestone at their recent pace, soonest first
+func GetArtistForecasts(userId int, now time.Time, limit int) ([]ArtistForecast, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT a.id, a.name, SUM(r.listen_count)::int, SUM(r.listen_count) FILTER (WHERE r.day >= $2::date)::int
+		FROM artist_daily r
+		JOIN artists a ON a.id = r.artist_id
+		WHERE r.user_id = $1
+		GROUP BY a.id, a.name
+		HAVING SUM(r.listen_count) FILTER (WHERE r.day >= $2::date) > 0`,
+		userId, now.Add(-forecastWindow))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	windowDays := forecastWindow.Hours() / 24
+	var forecasts []ArtistForecast
+	for rows.Next() {
+		var a ArtistForecast
+		var recent int
+		if err := rows.Scan(&a.ArtistId, &a.Name, &a.Plays, &recent); err != nil {
+			return nil, err
+		}
+		a.PerDay = float64(recent) / windowDays
+		a.NextMilestone = NextArtistMilestone(a.Plays)
+		a.Date = today.AddDate(0, 0, daysToReach(a.NextMilestone-a.Plays, a.PerDay))
+		forecasts = append(forecasts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(forecasts, func(i, j int) bool {
+		if !forecasts[i].Date.Equal(forecasts[j].Date) {
+			return forecasts[i].Date.Before(forecasts[j].Date)
+		}
+		return forecasts[i].Plays > forecasts[j].Plays
+	})
+	if limit > 0 && len(forecasts) > limit {
+		forecasts = forecasts[:limit]
+	}
+	return forecasts, nil
+}
@@ -0,0 +1,191 @@
+package db
+
+// Instance wide charts across every user that opted in to sharing. Entities
+// are stored per user, so artists are grouped by MusicBrainz id where one is
+// known and by normalized name otherwise, and albums and tracks by
+// normalized name and artist.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type GlobalArtist struct {
+	Name        string `json:"name"`
+	Listeners   int    `json:"listeners"`
+	ListenCount int    `json:"listen_count"`
+	MsPlayed    int64  `json:"ms_played"`
+}
+
+type GlobalAlbum struct {
+	AlbumName   string `json:"album_name"`
+	Artist      string `json:"artist"`
+	Listeners   int    `json:"listeners"`
+	ListenCount int    `json:"listen_count"`
+	MsPlayed    int64  `json:"ms_played"`
+}
+
+type GlobalTrack struct {
+	SongName    string `json:"song_name"`
+	Artist      string `json:"artist"`
+	Listeners   int    `json:"listeners"`
+	ListenCount int    `json:"listen_count"`
+	MsPlayed    int64  `json:"ms_played"`
+}
+
+type GlobalUser struct {
+	Id       int
+	Username string
+}
+
+// Lowercases, trims and collapses whitespace, and drops a leading "the" so
+// "The Beatles" and "beatles" match
+func NormalizeName(name string) string {
+	n := strings.Join(strings.Fields(strings.ToLower(name)), " ")
+	if rest, ok := strings.CutPrefix(n, "the "); ok && rest != "" {
+		n = rest
+	}
+	return n
+}
+
+// SQL version of NormalizeName, so names can be grouped in queries
+func CreateNormalizeNameFunction() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE OR REPLACE FUNCTION normalize_name(name TEXT) RETURNS TEXT AS $$
+			SELECT regexp_replace(btrim(regexp_replace(lower(name), '\s+', ' ', 'g')), '^the (?=.)', '')
+		$$ LANGUAGE sql IMMUTABLE;`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating normalize_name function: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Rollup rows of users sharing their listening, limited to the period in f.
+// f.UserId is ignored.
+func globalWhere(f Filter, q *queryArgs) string {
+	conds := append([]string{"u.share_global"}, f.rollupDays(q)...)
+	return strings.Join(conds, " AND ")
+}
+
+func GetGlobalTopArtists(f Filter) ([]GlobalArtist, error) {
+	q := &queryArgs{}
+	where := globalWhere(f, q)
+	// Names that some sharing user has a MusicBrainz id for, so users
+	// without the id still land in the same group
+	query := `WITH mbids AS (
+			SELECT normalize_name(a.name) AS norm, MIN(a.musicbrainz_id) AS mbid
+			FROM artists a
+			JOIN users u ON u.pk = a.user_id AND u.share_global
+			WHERE a.musicbrainz_id IS NOT NULL AND a.musicbrainz_id != ''
+			GROUP BY 1
+		)
+		SELECT mode() WITHIN GROUP (ORDER BY a.name) AS name,
+			COUNT(DISTINCT r.user_id),
+			SUM(r.listen_count) AS listen_count,
+			SUM(r.ms_played) AS ms_played
+		FROM artist_daily r
+		JOIN users u ON u.pk = r.user_id
+		JOIN artists a ON a.id = r.artist_id
+		LEFT JOIN mbids m ON m.norm = normalize_name(a.name)
+		WHERE ` + where + `
+		GROUP BY COALESCE(NULLIF(a.musicbrainz_id, ''), m.mbid, normalize_name(a.name))
+		ORDER BY ` + f.topOrder("name") + f.page(q)
+
+	rows, err := Pool.Query(context.Background(), query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (GlobalArtist, error) {
+		var a GlobalArtist
+		err := row.Scan(&a.Name, &a.Listeners, &a.ListenCount, &a.MsPlayed)
+		return a, err
+	})
+}
+
+func GetGlobalTopAlbums(f Filter) ([]GlobalAlbum, error) {
+	q := &queryArgs{}
+	where := globalWhere(f, q)
+	query := `SELECT mode() WITHIN GROUP (ORDER BY r.album_name) AS name,
+			mode() WITHIN GROUP (ORDER BY r.artist),
+			COUNT(DISTINCT r.user_id),
+			SUM(r.listen_count) AS listen_count,
+			SUM(r.ms_played) AS ms_played
+		FROM album_daily r
+		JOIN users u ON u.pk = r.user_id
+		WHERE ` + where + `
+		GROUP BY normalize_name(r.album_name), normalize_name(r.artist)
+		ORDER BY ` + f.topOrder("name") + f.page(q)
+
+	rows, err := Pool.Query(context.Background(), query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (GlobalAlbum, error) {
+		var a GlobalAlbum
+		err := row.Scan(&a.AlbumName, &a.Artist, &a.Listeners, &a.ListenCount, &a.MsPlayed)
+		return a, err
+	})
+}
+
+func GetGlobalTopTracks(f Filter) ([]GlobalTrack, error) {
+	q := &queryArgs{}
+	where := globalWhere(f, q)
+	query := `SELECT mode() WITHIN GROUP (ORDER BY r.song_name) AS name,
+			mode() WITHIN GROUP (ORDER BY r.artist),
+			COUNT(DISTINCT r.user_id),
+			SUM(r.listen_count) AS listen_count,
+			SUM(r.ms_played) AS ms_played
+		FROM song_daily r
+		JOIN users u ON u.pk = r.user_id
+		WHERE ` + where + `
+		GROUP BY normalize_name(r.song_name), normalize_name(r.artist)
+		ORDER BY ` + f.topOrder("name") + f.page(q)
+
+	rows, err := Pool.Query(context.Background(), query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (GlobalTrack, error) {
+		var t GlobalTrack
+		err := row.Scan(&t.SongName, &t.Artist, &t.Listeners, &t.ListenCount, &t.MsPlayed)
+		return t, err
+	})
+}
+
+// Number of users whose listening is included in the global charts
+func GetGlobalUserCount() (int, error) {
+	var count int
+	err := Pool.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM users WHERE share_global").Scan(&count)
+	return count, err
+}
+
+// Users that allow what they are playing to be shown to the whole server
+func GetNowPlayingSharers() ([]GlobalUser, error) {
+	rows, err := Pool.Query(context.Background(),
+		"SELECT pk, username FROM users WHERE share_now_playing ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[GlobalUser])
+}
+
+func GetUserPrivacy(userId int) (shareGlobal, shareNowPlaying bool, err error) {
+	err = Pool.QueryRow(context.Background(),
+		`SELECT COALESCE(share_global, FALSE), COALESCE(share_now_playing, FALSE)
+		FROM users WHERE pk = $1`,
+		userId).Scan(&shareGlobal, &shareNowPlaying)
+	return shareGlobal, shareNowPlaying, err
+}
+
+func UpdateUserPrivacy(userId int, shareGlobal, shareNowPlaying bool) error {
+	_, err := Pool.Exec(context.Background(),
+		"UPDATE users SET share_global = $1, share_now_playing = $2 WHERE pk = $3",
+		shareGlobal, shareNowPlaying, userId)
+	return err
+}
@@ -0,0 +1,554 @@
+package db
+
+// Merging an artist, album or song into another one of the same user. Every
+// reference to the merged entity is moved to the one it is merged into,
+// scrobbles that would end up the same as one already there are moved to the
+// trash, and the merged entity is deleted, all in one transaction.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"muzi/credits"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrMergeSame = errors.New("cannot merge into itself")
+
+// What a merge changes, or would change when previewed
+type MergeResult struct {
+	// Scrobbles moved to the entity merged into
+	Scrobbles int
+	// Albums and songs of a merged artist moved to the other artist
+	Albums int
+	Songs  int
+	// Albums and songs of a merged artist merged into one of the other
+	// artist with the same title
+	MergedAlbums int
+	MergedSongs  int
+	// Scrobbles moved to the trash because the other entity already has them
+	Duplicates int
+}
+
+type merger struct {
+	ctx    context.Context
+	tx     pgx.Tx
+	userId int
+	parser *credits.Parser
+	result MergeResult
+	// Time range of the scrobbles changed, to rebuild their rollups
+	minTs, maxTs time.Time
+}
+
+// Runs merge in a transaction. The changes are only committed, and the
+// rollups and charts of the changed days rebuilt, when apply is set.
+func runMerge(userId int, apply bool, merge func(m *merger) error) (MergeResult, error) {
+	parser, err := GetCreditParser(userId)
+	if err != nil {
+		return MergeResult{}, err
+	}
+
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	m := &merger{ctx: ctx, tx: tx, userId: userId, parser: parser}
+	if err := merge(m); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return MergeResult{}, ErrEditConflict
+		}
+		return MergeResult{}, err
+	}
+	if !apply {
+		return m.result, nil
+	}
+
+	if !m.minTs.IsZero() {
+		if err := refreshDailyRollups(tx, userId, m.minTs, m.maxTs); err != nil {
+			return MergeResult{}, err
+		}
+		if err := invalidateChartWeeks(tx, userId, m.minTs, m.maxTs); err != nil {
+			return MergeResult{}, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return MergeResult{}, err
+	}
+	return m.result, nil
+}
+
+func PreviewMergeArtists(userId, fromId, toId int) (MergeResult, error) {
+	return runMerge(userId, false, func(m *merger) error { return m.artists(fromId, toId, true) })
+}
+
+// Merges the artist fromId into toId. Scrobbles crediting it are credited to
+// toId instead, and its albums and songs are moved over or merged into the
+// ones toId already has.
+func MergeArtists(userId, fromId, toId int) (MergeResult, error) {
+	return runMerge(userId, true, func(m *merger) error { return m.artists(fromId, toId, true) })
+}
+
+func PreviewMergeAlbums(userId, fromId, toId int) (MergeResult, error) {
+	return runMerge(userId, false, func(m *merger) error { return m.albums(fromId, toId, true) })
+}
+
+// Merges the album fromId into toId, moving its songs and scrobbles. The
+// artists credited on the scrobbles are kept.
+func MergeAlbums(userId, fromId, toId int) (MergeResult, error) {
+	return runMerge(userId, true, func(m *merger) error { return m.albums(fromId, toId, true) })
+}
+
+func PreviewMergeSongs(userId, fromId, toId int) (MergeResult, error) {
+	return runMerge(userId, false, func(m *merger) error { return m.songs(fromId, toId, true) })
+}
+
+// Merges the song fromId into toId, moving its scrobbles. The artists
+// credited on the scrobbles are kept.
+func MergeSongs(userId, fromId, toId int) (MergeResult, error) {
+	return runMerge(userId, true, func(m *merger) error { return m.songs(fromId, toId, true) })
+}
+
+// Merges an entity of any type into another, counting its scrobbles as moved
+func (m *merger) merge(entityType string, fromId, toId int) error {
+	switch entityType {
+	case EntityArtist:
+		return m.artists(fromId, toId, true)
+	case EntityAlbum:
+		return m.albums(fromId, toId, true)
+	default:
+		return m.songs(fromId, toId, true)
+	}
+}
+
+// Widens the changed time range to the scrobbles matching cond, where $1 is
+// the user and $2 the entity, and returns how many there are
+func (m *merger) cover(cond string, id int) (int, error) {
+	var n int
+	var first, last *time.Time
+	err := m.tx.QueryRow(m.ctx,
+		`SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM history WHERE user_id = $1 AND `+cond,
+		m.userId, id).Scan(&n, &first, &last)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	if m.minTs.IsZero() || first.Before(m.minTs) {
+		m.minTs = *first
+	}
+	if m.maxTs.IsZero() || last.After(m.maxTs) {
+		m.maxTs = *last
+	}
+	return n, nil
+}
+
+// Looks up the names of two entities of the user in table, locking them
+// for the rest of the merge
+func (m *merger) lockPair(table, nameColumn string, fromId, toId int) (string, string, error) {
+	if fromId == toId {
+		return "", "", ErrMergeSame
+	}
+	var names [2]string
+	for i, id := range []int{fromId, toId} {
+		err := m.tx.QueryRow(m.ctx,
+			fmt.Sprintf(`SELECT %s FROM %s WHERE id = $1 AND user_id = $2 FOR UPDATE`, nameColumn, table),
+			id, m.userId).Scan(&names[i])
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return names[0], names[1], nil
+}
+
+// Moves the tags of an entity to another one, keeping the tags it already
+// has
+func (m *merger) moveTags(entityType string, fromId, toId int) error {
+	_, err := m.tx.Exec(m.ctx,
+		`INSERT INTO entity_tags (tag_id, entity_type, entity_id, source, weight)
+		SELECT tag_id, entity_type, $3, source, weight FROM entity_tags
+		WHERE entity_type = $1 AND entity_id = $2
+		ON CONFLICT (tag_id, entity_type, entity_id) DO NOTHING`,
+		entityType, fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`DELETE FROM entity_tags WHERE entity_type = $1 AND entity_id = $2`,
+		entityType, fromId)
+	return err
+}
+
+func (m *merger) artists(fromId, toId int, top bool) error {
+	from, to, err := m.lockPair("artists", "name", fromId, toId)
+	if err != nil {
+		return err
+	}
+	credited := "(artist_id = $2 OR $2 = ANY(artist_ids))"
+	n, err := m.cover(credited, fromId)
+	if err != nil {
+		return err
+	}
+	if top {
+		m.result.Scrobbles += n
+	}
+
+	// The artist text of the scrobbles names the merged artist alone or
+	// among others
+	rows, err := m.tx.Query(m.ctx,
+		`SELECT DISTINCT artist FROM history WHERE user_id = $1 AND `+credited,
+		m.userId, fromId)
+	if err != nil {
+		return err
+	}
+	texts, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, old := range texts {
+		renamed := replaceCredit(m.parser, old, from, to)
+		if renamed == old {
+			continue
+		}
+		where := `h.artist = $3 AND (h.artist_id = $2 OR $2 = ANY(h.artist_ids))`
+		same := `t.artist = $4 AND t.song_name = h.song_name`
+		if err := m.dropDuplicates(where, same, m.userId, fromId, old, renamed); err != nil {
+			return err
+		}
+		if err := m.renameHistory(`artist = $4`, where, same, m.userId, fromId, old, renamed); err != nil {
+			return err
+		}
+	}
+	// Albums credited to the artist, which its scrobbles may not be
+	_, err = m.cover("album_artist = (SELECT name FROM artists WHERE id = $2)", fromId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE history SET album_artist = $3 WHERE user_id = $1 AND album_artist = $2`,
+		m.userId, from, to)
+	if err != nil {
+		return err
+	}
+
+	// Credits keep their order, and an artist credited next to the one
+	// merged into it is only credited once, in the first of their places
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE history h SET artist_ids = (
+			SELECT array_agg(id ORDER BY first) FROM (
+				SELECT CASE WHEN a = $2 THEN $3 ELSE a END AS id, MIN(o) AS first
+				FROM unnest(h.artist_ids) WITH ORDINALITY AS u(a, o)
+				GROUP BY 1
+			) s
+		)
+		WHERE h.user_id = $1 AND $2 = ANY(h.artist_ids)`,
+		m.userId, fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE history SET artist_id = $3 WHERE user_id = $1 AND artist_id = $2`,
+		m.userId, fromId, toId)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"albums", "songs"} {
+		rows, err := m.tx.Query(m.ctx,
+			fmt.Sprintf(`SELECT f.id, COALESCE(t.id, 0) FROM %[1]s f
+			LEFT JOIN %[1]s t ON t.user_id = f.user_id AND t.artist_id = $3 AND t.title = f.title
+			WHERE f.user_id = $1 AND f.artist_id = $2`, table),
+			m.userId, fromId, toId)
+		if err != nil {
+			return err
+		}
+		// The other artist's album or song with the same title, if any
+		pairs, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct{ From, To int }])
+		if err != nil {
+			return err
+		}
+		for _, p := range pairs {
+			switch {
+			case p.To == 0:
+				_, err = m.tx.Exec(m.ctx,
+					fmt.Sprintf(`UPDATE %s SET artist_id = $2 WHERE id = $1`, table), p.From, toId)
+			case table == "albums":
+				err = m.albums(p.From, p.To, false)
+			default:
+				err = m.songs(p.From, p.To, false)
+			}
+			if err != nil {
+				return err
+			}
+			switch {
+			case table == "albums" && p.To == 0:
+				m.result.Albums++
+			case table == "albums":
+				m.result.MergedAlbums++
+			case p.To == 0:
+				m.result.Songs++
+			default:
+				m.result.MergedSongs++
+			}
+		}
+	}
+
+	if err := m.moveTags(EntityArtist, fromId, toId); err != nil {
+		return err
+	}
+	if err := m.moveAliases(EntityArtist, fromId, toId, from, to); err != nil {
+		return err
+	}
+	if err := m.dropDismissals(EntityArtist, fromId); err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE artists t SET
+			image_url = COALESCE(NULLIF(t.image_url, ''), f.image_url),
+			bio = COALESCE(NULLIF(t.bio, ''), f.bio),
+			spotify_id = COALESCE(NULLIF(t.spotify_id, ''), f.spotify_id),
+			musicbrainz_id = COALESCE(NULLIF(t.musicbrainz_id, ''), f.musicbrainz_id)
+		FROM artists f WHERE f.id = $1 AND t.id = $2`,
+		fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx, `DELETE FROM artists WHERE id = $1`, fromId)
+	return err
+}
+
+func (m *merger) albums(fromId, toId int, top bool) error {
+	from, to, err := m.lockPair("albums", "title", fromId, toId)
+	if err != nil {
+		return err
+	}
+	// Scrobbles belong to an album through their song
+	ofAlbum := "song_id IN (SELECT id FROM songs WHERE album_id = $2)"
+	n, err := m.cover(ofAlbum, fromId)
+	if err != nil {
+		return err
+	}
+	if top {
+		m.result.Scrobbles += n
+	}
+
+	if from != to {
+		_, err = m.tx.Exec(m.ctx,
+			`UPDATE history SET album_name = $3 WHERE user_id = $1 AND album_name = $4 AND `+ofAlbum,
+			m.userId, fromId, to, from)
+		if err != nil {
+			return err
+		}
+	}
+	// Albums are grouped under their album artist, so the scrobbles follow
+	// the artist of the merged album to be counted with it
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE history h SET album_artist = ar.name
+		FROM albums al JOIN artists ar ON ar.id = al.artist_id
+		WHERE al.id = $3 AND h.user_id = $1 AND h.`+ofAlbum+`
+			AND `+albumArtistColumn+` != ar.name`,
+		m.userId, fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE songs SET album_id = $3 WHERE user_id = $1 AND album_id = $2`,
+		m.userId, fromId, toId)
+	if err != nil {
+		return err
+	}
+
+	// A tracklist is only kept when the other album has none, otherwise it
+	// goes with the merged album
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE album_tracks SET album_id = $2
+		WHERE album_id = $1 AND NOT EXISTS (SELECT 1 FROM album_tracks WHERE album_id = $2)`,
+		fromId, toId)
+	if err != nil {
+		return err
+	}
+
+	if err := m.moveTags(EntityAlbum, fromId, toId); err != nil {
+		return err
+	}
+	if err := m.moveAliases(EntityAlbum, fromId, toId, from, to); err != nil {
+		return err
+	}
+	if err := m.dropDismissals(EntityAlbum, fromId); err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE albums t SET
+			cover_url = COALESCE(NULLIF(t.cover_url, ''), f.cover_url),
+			spotify_id = COALESCE(NULLIF(t.spotify_id, ''), f.spotify_id),
+			musicbrainz_id = COALESCE(NULLIF(t.musicbrainz_id, ''), f.musicbrainz_id)
+		FROM albums f WHERE f.id = $1 AND t.id = $2`,
+		fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx, `DELETE FROM albums WHERE id = $1`, fromId)
+	return err
+}
+
+func (m *merger) songs(fromId, toId int, top bool) error {
+	from, to, err := m.lockPair("songs", "title", fromId, toId)
+	if err != nil {
+		return err
+	}
+	n, err := m.cover("song_id = $2", fromId)
+	if err != nil {
+		return err
+	}
+	if top {
+		m.result.Scrobbles += n
+	}
+
+	// Scrobbles of the same artist at the same time as one of the other song
+	// are the same play
+	where := `h.song_id = $2 AND h.song_name != $3`
+	same := `t.artist = h.artist AND t.song_name = $3`
+	if err := m.dropDuplicates(where, same, m.userId, fromId, to); err != nil {
+		return err
+	}
+	if err := m.renameHistory(`song_name = $3`, where, same, m.userId, fromId, to); err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE history SET song_id = $3 WHERE user_id = $1 AND song_id = $2`,
+		m.userId, fromId, toId)
+	if err != nil {
+		return err
+	}
+
+	if err := m.moveTags(EntitySong, fromId, toId); err != nil {
+		return err
+	}
+	if err := m.moveAliases(EntitySong, fromId, toId, from, to); err != nil {
+		return err
+	}
+	if err := m.dropDismissals(EntitySong, fromId); err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx,
+		`UPDATE songs t SET
+			album_id = COALESCE(t.album_id, f.album_id),
+			duration_ms = COALESCE(t.duration_ms, f.duration_ms),
+			spotify_id = COALESCE(NULLIF(t.spotify_id, ''), f.spotify_id),
+			musicbrainz_id = COALESCE(NULLIF(t.musicbrainz_id, ''), f.musicbrainz_id)
+		FROM songs f WHERE f.id = $1 AND t.id = $2`,
+		fromId, toId)
+	if err != nil {
+		return err
+	}
+	_, err = m.tx.Exec(m.ctx, `DELETE FROM songs WHERE id = $1`, fromId)
+	return err
+}
+
+// Drops the scrobbles about to be renamed, matching where under alias h,
+// that would end up the same as one matching same under alias t. The
+// renamed scrobbles are the ones kept when the other copy is in the trash,
+// so trashed copies in their way are purged. Live copies of a kept
+// scrobble are moved to the trash with their old names and logged like
+// any delete; trashed ones are only purged. $1 is the user and the other
+// arguments are shared by where and same.
+func (m *merger) dropDuplicates(where, same string, args ...any) error {
+	_, err := m.tx.Exec(m.ctx,
+		`DELETE FROM history t WHERE t.user_id = $1 AND t.deleted_at IS NOT NULL
+			AND EXISTS (
+				SELECT 1 FROM history h WHERE h.user_id = $1 AND `+where+`
+					AND `+same+` AND h.timestamp = t.timestamp
+			)`,
+		args...)
+	if err != nil {
+		return err
+	}
+	live := `EXISTS (
+		SELECT 1 FROM history t WHERE t.user_id = $1 AND ` + same + `
+			AND t.timestamp = h.timestamp AND t.deleted_at IS NULL
+	)`
+	_, err = m.tx.Exec(m.ctx,
+		`DELETE FROM history h WHERE h.user_id = $1 AND h.deleted_at IS NOT NULL AND `+where+` AND `+live,
+		args...)
+	if err != nil {
+		return err
+	}
+
+	var n int
+	err = m.tx.QueryRow(m.ctx,
+		fmt.Sprintf(`WITH dropped AS (
+			UPDATE history h SET deleted_at = NOW()
+			WHERE h.user_id = $1 AND h.deleted_at IS NULL AND %[1]s AND %[2]s
+			RETURNING h.*
+		),
+		logged AS (
+			INSERT INTO change_log (user_id, kind, summary, before, after)
+			SELECT $1, $%[3]d::text, $%[4]d::text, jsonb_agg(to_jsonb(dropped)), '[]' FROM dropped
+			HAVING COUNT(*) > 0
+		)
+		SELECT COUNT(*) FROM dropped`, where, live, len(args)+1, len(args)+2),
+		append(args, ChangeHistoryDelete, "duplicates dropped by a merge")...).Scan(&n)
+	if err != nil {
+		return err
+	}
+	m.result.Duplicates += n
+	return nil
+}
+
+// Renames the scrobbles matching where under alias h with the SET clause
+// set, leaving out the ones dropDuplicates trashed as copies of one
+// matching same under alias t
+func (m *merger) renameHistory(set, where, same string, args ...any) error {
+	_, err := m.tx.Exec(m.ctx,
+		`UPDATE history h SET `+set+`
+		WHERE h.user_id = $1 AND `+where+`
+			AND NOT EXISTS (
+				SELECT 1 FROM history t WHERE t.user_id = $1 AND `+same+`
+					AND t.timestamp = h.timestamp
+			)`,
+		args...)
+	return err
+}
+
+// Replaces the name from with to in an artist credit, where it is one of
+// the artists the credit names
+func replaceCredit(p *credits.Parser, credit, from, to string) string {
+	if credit == from {
+		return to
+	}
+	if !slices.Contains(p.SplitArtists(credit), from) {
+		return credit
+	}
+
+	var b strings.Builder
+	rest := credit
+	for {
+		i := strings.Index(rest, from)
+		if i < 0 {
+			b.WriteString(rest)
+			return b.String()
+		}
+		end := i + len(from)
+		before, _ := utf8.DecodeLastRuneInString(rest[:i])
+		after, _ := utf8.DecodeRuneInString(rest[end:])
+		if (i == 0 || !isNameRune(before)) && (end == len(rest) || !isNameRune(after)) {
+			b.WriteString(rest[:i] + to)
+		} else {
+			b.WriteString(rest[:end])
+		}
+		rest = rest[end:]
+	}
+}
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
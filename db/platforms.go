@@ -0,0 +1,75 @@
+package db
+
+// Breakdown of scrobbles by the platform (API or import) and client (app or
+// device) they were recorded from
+
+import (
+	"context"
+	"time"
+)
+
+type PlatformStat struct {
+	Platform  string `json:"platform"`
+	Scrobbles int    `json:"scrobbles"`
+	MsPlayed  int    `json:"ms_played"`
+}
+
+type ClientStat struct {
+	Platform  string    `json:"platform"`
+	Client    string    `json:"client"`
+	Scrobbles int       `json:"scrobbles"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// Returns scrobble counts and time played per platform, most used first
+func GetPlatformBreakdown(f Filter) ([]PlatformStat, error) {
+	q := &queryArgs{}
+	rows, err := Pool.Query(context.Background(),
+		`SELECT COALESCE(h.platform, ''), COUNT(*), COALESCE(SUM(h.ms_played), 0)
+		FROM history h
+		WHERE `+f.historyWhere(q)+`
+		GROUP BY 1
+		ORDER BY 2 DESC`,
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []PlatformStat
+	for rows.Next() {
+		var s PlatformStat
+		if err := rows.Scan(&s.Platform, &s.Scrobbles, &s.MsPlayed); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// Returns the clients scrobbles came from, most used first. Scrobbles
+// without a known client are left out.
+func GetClientBreakdown(f Filter) ([]ClientStat, error) {
+	q := &queryArgs{}
+	rows, err := Pool.Query(context.Background(),
+		`SELECT COALESCE(h.platform, ''), h.client, COUNT(*), MAX(h.timestamp)
+		FROM history h
+		WHERE `+f.historyWhere(q)+` AND h.client IS NOT NULL
+		GROUP BY 1, 2
+		ORDER BY 3 DESC`+f.page(q),
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []ClientStat
+	for rows.Next() {
+		var s ClientStat
+		if err := rows.Scan(&s.Platform, &s.Client, &s.Scrobbles, &s.LastUsed); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,81 @@
+package db
+
+// The profile page stats that can't be read from the daily rollups, like
+// skips, platforms and milestones. They are cached per user until the
+// user's history changes, or profileStatsTTL has passed for the changes
+// that don't touch the history, like renamed artists and fetched
+// tracklists.
+
+import (
+	"sync"
+	"time"
+)
+
+const profileStatsTTL = 10 * time.Minute
+
+type ProfileStats struct {
+	Milestones      []Milestone
+	OnThisDay       []OnThisDay
+	PlatformStats   []PlatformStat
+	ClientStats     []ClientStat
+	SkippedTracks   []SkipStat
+	SkippedArtists  []SkipStat
+	CompletedAlbums []CompletedAlbum
+	computedAt      time.Time
+}
+
+var (
+	profileStatsCache   = make(map[int]ProfileStats)
+	profileStatsCacheMu sync.Mutex
+)
+
+// Returns the user's profile stats as of now, from the cache when they
+// were computed on the same day
+func GetProfileStats(userId int, now time.Time) (ProfileStats, error) {
+	profileStatsCacheMu.Lock()
+	stats, ok := profileStatsCache[userId]
+	profileStatsCacheMu.Unlock()
+	y1, m1, d1 := stats.computedAt.Date()
+	y2, m2, d2 := now.Date()
+	if ok && now.Sub(stats.computedAt) < profileStatsTTL && y1 == y2 && m1 == m2 && d1 == d2 {
+		return stats, nil
+	}
+
+	stats = ProfileStats{computedAt: now}
+	var err error
+	if stats.Milestones, err = GetMilestones(userId, 8); err != nil {
+		return stats, err
+	}
+	if stats.OnThisDay, err = GetOnThisDay(userId, now); err != nil {
+		return stats, err
+	}
+	if stats.PlatformStats, err = GetPlatformBreakdown(Filter{UserId: userId}); err != nil {
+		return stats, err
+	}
+	if stats.ClientStats, err = GetClientBreakdown(Filter{UserId: userId, Limit: 10}); err != nil {
+		return stats, err
+	}
+	if stats.SkippedTracks, err = GetMostSkipped(Filter{UserId: userId, Limit: 5}, ChartTrack, 5); err != nil {
+		return stats, err
+	}
+	if stats.SkippedArtists, err = GetMostSkipped(Filter{UserId: userId, Limit: 5}, ChartArtist, 10); err != nil {
+		return stats, err
+	}
+	if stats.CompletedAlbums, err = GetMostCompletedAlbums(userId, 5); err != nil {
+		return stats, err
+	}
+
+	profileStatsCacheMu.Lock()
+	profileStatsCache[userId] = stats
+	profileStatsCacheMu.Unlock()
+	return stats, nil
+}
+
+// Drops the cached profile stats of the user. Every change to the history
+// does this through the rollups, only a new skipped scrobble, which the
+// rollups leave out, has to call it itself.
+func ForgetProfileStats(userId int) {
+	profileStatsCacheMu.Lock()
+	delete(profileStatsCache, userId)
+	profileStatsCacheMu.Unlock()
+}
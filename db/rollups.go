@@ -0,0 +1,197 @@
+package db
+
+// Daily per-user rollups of listen counts and time played for artists,
+// albums and songs, leaving out skipped and deleted plays. Top lists and
+// artist stats read these instead of aggregating the whole history table on
+// every request.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The artist the album of a scrobble is grouped under
+const albumArtistColumn = "COALESCE(NULLIF(h.album_artist, ''), h.artist)"
+
+// Rebuild queries for the rollups of one user, formatted with a condition on
+// the history table
+var rollupRebuildQueries = []string{
+	`INSERT INTO artist_daily (user_id, day, artist_id, listen_count, ms_played)
+	SELECT h.user_id, h.timestamp::date, a.artist_id, COUNT(*), COALESCE(SUM(h.ms_played), 0)
+	FROM history h, unnest(h.artist_ids) AS a(artist_id)
+	WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND %s
+	GROUP BY 1, 2, 3`,
+	`INSERT INTO album_daily (user_id, day, album_name, artist, listen_count, ms_played)
+	SELECT h.user_id, h.timestamp::date, h.album_name, ` + albumArtistColumn + `, COUNT(*), COALESCE(SUM(h.ms_played), 0)
+	FROM history h
+	WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND h.album_name IS NOT NULL AND h.album_name != '' AND %s
+	GROUP BY 1, 2, 3, 4`,
+	`INSERT INTO song_daily (user_id, day, song_name, artist, listen_count, ms_played)
+	SELECT h.user_id, h.timestamp::date, h.song_name, h.artist, COUNT(*), COALESCE(SUM(h.ms_played), 0)
+	FROM history h
+	WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND %s
+	GROUP BY 1, 2, 3, 4`,
+}
+
+var rollupTables = []string{"artist_daily", "album_daily", "song_daily"}
+
+func CreateDailyRollupTables() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS artist_daily (
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			day DATE NOT NULL,
+			artist_id INTEGER NOT NULL,
+			listen_count INTEGER NOT NULL,
+			ms_played BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, day, artist_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_artist_daily_artist ON artist_daily(user_id, artist_id);
+		CREATE TABLE IF NOT EXISTS album_daily (
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			day DATE NOT NULL,
+			album_name TEXT NOT NULL,
+			artist TEXT NOT NULL,
+			listen_count INTEGER NOT NULL,
+			ms_played BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, day, album_name, artist)
+		);
+		CREATE TABLE IF NOT EXISTS song_daily (
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			day DATE NOT NULL,
+			song_name TEXT NOT NULL,
+			artist TEXT NOT NULL,
+			listen_count INTEGER NOT NULL,
+			ms_played BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (user_id, day, song_name, artist)
+		);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating daily rollup tables: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Adds a single newly inserted scrobble to the rollups, as part of the
+// transaction inserting it. Skipped plays must not be added. The album is
+// counted under the track artist when albumArtist is empty.
+func incrementDailyRollups(tx pgx.Tx, userId int, timestamp time.Time, songName, artist, albumName, albumArtist string, msPlayed int, artistIds []int) error {
+	ForgetProfileStats(userId)
+	ctx := context.Background()
+	batch := &pgx.Batch{}
+	batch.Queue(
+		`INSERT INTO artist_daily (user_id, day, artist_id, listen_count, ms_played)
+		SELECT DISTINCT $1::int, $2::timestamptz::date, a, 1, $3::bigint FROM unnest($4::int[]) AS a
+		ON CONFLICT (user_id, day, artist_id) DO UPDATE
+		SET listen_count = artist_daily.listen_count + 1, ms_played = artist_daily.ms_played + EXCLUDED.ms_played`,
+		userId, timestamp, msPlayed, artistIds)
+	if albumName != "" {
+		if albumArtist == "" {
+			albumArtist = artist
+		}
+		batch.Queue(
+			`INSERT INTO album_daily (user_id, day, album_name, artist, listen_count, ms_played)
+			VALUES ($1, $2::timestamptz::date, $3, $4, 1, $5)
+			ON CONFLICT (user_id, day, album_name, artist) DO UPDATE
+			SET listen_count = album_daily.listen_count + 1, ms_played = album_daily.ms_played + EXCLUDED.ms_played`,
+			userId, timestamp, albumName, albumArtist, msPlayed)
+	}
+	batch.Queue(
+		`INSERT INTO song_daily (user_id, day, song_name, artist, listen_count, ms_played)
+		VALUES ($1, $2::timestamptz::date, $3, $4, 1, $5)
+		ON CONFLICT (user_id, day, song_name, artist) DO UPDATE
+		SET listen_count = song_daily.listen_count + 1, ms_played = song_daily.ms_played + EXCLUDED.ms_played`,
+		userId, timestamp, songName, artist, msPlayed)
+	return tx.SendBatch(ctx, batch).Close()
+}
+
+// Recomputes the rollups for every day between start and end, inclusive.
+// Used after bulk imports, deletes and edits of existing history.
+func RefreshDailyRollups(userId int, start, end time.Time) error {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := refreshDailyRollups(tx, userId, start, end); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RefreshDailyRollups as part of a transaction
+func refreshDailyRollups(tx pgx.Tx, userId int, start, end time.Time) error {
+	ForgetProfileStats(userId)
+	ctx := context.Background()
+	for _, table := range rollupTables {
+		_, err := tx.Exec(ctx,
+			fmt.Sprintf(`DELETE FROM %s WHERE user_id = $1
+				AND day >= $2::timestamptz::date AND day <= $3::timestamptz::date`, table),
+			userId, start, end)
+		if err != nil {
+			return err
+		}
+	}
+
+	cond := "h.timestamp >= $2::timestamptz::date AND h.timestamp < $3::timestamptz::date + 1"
+	for _, q := range rollupRebuildQueries {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(q, cond), userId, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Throws away and rebuilds all rollups of a user
+func RebuildDailyRollups(userId int) error {
+	ForgetProfileStats(userId)
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range rollupTables {
+		_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE user_id = $1", table), userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, q := range rollupRebuildQueries {
+		if _, err := tx.Exec(ctx, fmt.Sprintf(q, "TRUE"), userId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Builds rollups for users that have history but no rollups yet, which is
+// the case for every user the first time this version starts
+func BackfillDailyRollups() error {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT pk FROM users u
+		WHERE EXISTS (SELECT 1 FROM history WHERE user_id = u.pk AND deleted_at IS NULL)
+			AND NOT EXISTS (SELECT 1 FROM song_daily WHERE user_id = u.pk)`)
+	if err != nil {
+		return err
+	}
+	users, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+
+	for _, userId := range users {
+		if err := RebuildDailyRollups(userId); err != nil {
+			return fmt.Errorf("user %d: %w", userId, err)
+		}
+	}
+	return nil
+}
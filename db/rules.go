@@ -0,0 +1,281 @@
+package db
+
+// User-defined rewrite rules that correct scrobble metadata before it is
+// resolved to artists, albums and songs. Rules run in the order they were
+// added, each one seeing the result of the ones before it.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	RuleFieldArtist = "artist"
+	RuleFieldTitle  = "title"
+	RuleFieldAlbum  = "album"
+	// Applies to the artist, title and album alike
+	RuleFieldAny = "any"
+
+	// The whole field equals the pattern and is replaced
+	RuleMatchExact = "exact"
+	// Every match of the pattern is replaced, $1 and ${name} expand to
+	// its groups
+	RuleMatchRegex = "regex"
+)
+
+type RewriteRule struct {
+	Id          int    `json:"-"`
+	Field       string `json:"field"`
+	Match       string `json:"match"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	IgnoreCase  bool   `json:"ignore_case"`
+	Enabled     bool   `json:"enabled"`
+	re          *regexp.Regexp
+}
+
+// The enabled rules of a user, ready to apply
+type RuleSet []RewriteRule
+
+var (
+	ruleSetCache   = make(map[int]RuleSet)
+	ruleSetCacheMu sync.Mutex
+)
+
+func CreateRewriteRulesTable() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS rewrite_rules (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			field TEXT NOT NULL,
+			match TEXT NOT NULL,
+			pattern TEXT NOT NULL,
+			replacement TEXT NOT NULL DEFAULT '',
+			ignore_case BOOLEAN NOT NULL DEFAULT FALSE,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE
+		);
+		CREATE INDEX IF NOT EXISTS idx_rewrite_rules_user ON rewrite_rules(user_id, id);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating rewrite_rules table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Checks the rule and compiles its pattern
+func (r *RewriteRule) compile() error {
+	switch r.Field {
+	case RuleFieldArtist, RuleFieldTitle, RuleFieldAlbum, RuleFieldAny:
+	default:
+		return fmt.Errorf("unknown field: %s", r.Field)
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("empty pattern")
+	}
+	switch r.Match {
+	case RuleMatchExact:
+	case RuleMatchRegex:
+		pattern := r.Pattern
+		if r.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", r.Pattern, err)
+		}
+		r.re = re
+	default:
+		return fmt.Errorf("unknown match type: %s", r.Match)
+	}
+	return nil
+}
+
+// Returns whether the rule checks the field
+func (r RewriteRule) appliesTo(field string) bool {
+	return r.Field == RuleFieldAny || r.Field == field
+}
+
+func (r RewriteRule) rewrite(value string) string {
+	if r.Match == RuleMatchRegex {
+		return strings.TrimSpace(r.re.ReplaceAllString(value, r.Replacement))
+	}
+	if value == r.Pattern || (r.IgnoreCase && strings.EqualFold(value, r.Pattern)) {
+		return r.Replacement
+	}
+	return value
+}
+
+// Runs every rule over the fields of a scrobble. A rule never empties the
+// artist or the title, only the album can be removed.
+func (rs RuleSet) Rewrite(artist, title, album string) (string, string, string) {
+	for _, r := range rs {
+		if r.appliesTo(RuleFieldArtist) {
+			if v := r.rewrite(artist); v != "" {
+				artist = v
+			}
+		}
+		if r.appliesTo(RuleFieldTitle) {
+			if v := r.rewrite(title); v != "" {
+				title = v
+			}
+		}
+		if r.appliesTo(RuleFieldAlbum) && album != "" {
+			album = r.rewrite(album)
+		}
+	}
+	return artist, title, album
+}
+
+// Returns every rule of the user, enabled or not, in the order they run
+func GetRewriteRules(userId int) ([]RewriteRule, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, field, match, pattern, replacement, ignore_case, enabled
+		FROM rewrite_rules WHERE user_id = $1 ORDER BY id`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []RewriteRule
+	for rows.Next() {
+		var r RewriteRule
+		err := rows.Scan(&r.Id, &r.Field, &r.Match, &r.Pattern, &r.Replacement, &r.IgnoreCase, &r.Enabled)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// Returns the enabled rules of the user. They are cached until the user
+// changes their rules.
+func GetRuleSet(userId int) (RuleSet, error) {
+	ruleSetCacheMu.Lock()
+	rs, ok := ruleSetCache[userId]
+	ruleSetCacheMu.Unlock()
+	if ok {
+		return rs, nil
+	}
+
+	rules, err := GetRewriteRules(userId)
+	if err != nil {
+		return nil, err
+	}
+	rs = RuleSet{}
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		// Stored rules were checked when they were added
+		if err := r.compile(); err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping rewrite rule %d: %v\n", r.Id, err)
+			continue
+		}
+		rs = append(rs, r)
+	}
+
+	ruleSetCacheMu.Lock()
+	ruleSetCache[userId] = rs
+	ruleSetCacheMu.Unlock()
+	return rs, nil
+}
+
+func forgetRuleSet(userId int) {
+	ruleSetCacheMu.Lock()
+	delete(ruleSetCache, userId)
+	ruleSetCacheMu.Unlock()
+}
+
+func AddRewriteRule(userId int, r RewriteRule) error {
+	if err := r.compile(); err != nil {
+		return err
+	}
+	_, err := Pool.Exec(context.Background(),
+		`INSERT INTO rewrite_rules (user_id, field, match, pattern, replacement, ignore_case, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		userId, r.Field, r.Match, r.Pattern, r.Replacement, r.IgnoreCase, r.Enabled)
+	forgetRuleSet(userId)
+	return err
+}
+
+func DeleteRewriteRule(userId, id int) error {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM rewrite_rules WHERE user_id = $1 AND id = $2`,
+		userId, id)
+	forgetRuleSet(userId)
+	return err
+}
+
+func SetRewriteRuleEnabled(userId, id int, enabled bool) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE rewrite_rules SET enabled = $3 WHERE user_id = $1 AND id = $2`,
+		userId, id, enabled)
+	forgetRuleSet(userId)
+	return err
+}
+
+// Adds the rules after the existing ones, or in their place when replace is
+// set. Nothing is stored if any rule is invalid.
+func ImportRewriteRules(userId int, rules []RewriteRule, replace bool) error {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if replace {
+		if _, err := tx.Exec(ctx, `DELETE FROM rewrite_rules WHERE user_id = $1`, userId); err != nil {
+			return err
+		}
+	}
+	for _, r := range rules {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO rewrite_rules (user_id, field, match, pattern, replacement, ignore_case, enabled)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			userId, r.Field, r.Match, r.Pattern, r.Replacement, r.IgnoreCase, r.Enabled)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	forgetRuleSet(userId)
+	return nil
+}
+
+// Returns the scrobbles in the user's history the rules would change
+func PreviewRewriteRules(userId int) ([]HistoryEditChange, error) {
+	rs, err := GetRuleSet(userId)
+	if err != nil || len(rs) == 0 {
+		return nil, err
+	}
+	rows, err := selectEditedRows(context.Background(), Pool, userId, nil, byNames(rs.Rewrite), false)
+	if err != nil {
+		return nil, err
+	}
+	return changesOf(rows), nil
+}
+
+// Rewrites the user's whole history with their rules in one transaction
+// and returns how many scrobbles changed
+func ApplyRewriteRules(userId int) (int, error) {
+	rs, err := GetRuleSet(userId)
+	if err != nil || len(rs) == 0 {
+		return 0, err
+	}
+	return applyHistoryRewrite(userId, nil, byNames(rs.Rewrite), "Applied rewrite rules")
+}
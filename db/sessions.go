@@ -0,0 +1,224 @@
+package db
+
+// Listening sessions. Scrobbles are split into sessions wherever the gap
+// to the previous scrobble is longer than the given gap.
+
+import (
+	"context"
+	"time"
+)
+
+// Gap used when none is given
+const DefaultSessionGap = 30 * time.Minute
+
+// Fewest distinct tracks a run needs to count as a full album listen, so
+// singles and EPs with two or three known songs don't count
+const minFullAlbumTracks = 4
+
+type ListeningSession struct {
+	Start          time.Time         `json:"start"`
+	End            time.Time         `json:"end"`
+	DurationMs     int               `json:"duration_ms"`
+	TrackCount     int               `json:"track_count"`
+	MsPlayed       int               `json:"ms_played"`
+	TopArtist      string            `json:"top_artist"`
+	TopArtistCount int               `json:"top_artist_count"`
+	TopAlbum       string            `json:"top_album"`
+	TopAlbumArtist string            `json:"top_album_artist"`
+	TopAlbumCount  int               `json:"top_album_count"`
+	FullAlbums     []FullAlbumListen `json:"full_albums"`
+}
+
+type FullAlbumListen struct {
+	AlbumName  string    `json:"album_name"`
+	Artist     string    `json:"artist"`
+	Start      time.Time `json:"start"`
+	TrackCount int       `json:"track_count"`
+}
+
+type sessionPlay struct {
+	timestamp   time.Time
+	songId      int
+	artist      string
+	albumName   string
+	albumId     int
+	albumTracks int
+	// Tracklist length of the album and the play's position on it, or 0
+	// if the album has no tracklist
+	listedTracks int
+	position     int
+}
+
+// Returns a page of sessions, newest first unless sorted with SortOldest.
+// Only the time range, platforms and paging of f are used.
+func GetListeningSessions(f Filter, gap time.Duration) ([]ListeningSession, error) {
+	if gap <= 0 {
+		gap = DefaultSessionGap
+	}
+	q := &queryArgs{}
+	where := Filter{UserId: f.UserId, Start: f.Start, End: f.End, Platforms: f.Platforms}.historyWhere(q)
+	order := "DESC"
+	if f.Sort == SortOldest {
+		order = "ASC"
+	}
+	rows, err := Pool.Query(context.Background(),
+		`WITH plays AS (
+			SELECT h.timestamp, COALESCE(h.ms_played, 0) AS ms_played,
+				CASE WHEN h.timestamp - LAG(h.timestamp) OVER (ORDER BY h.timestamp) <= `+q.add(gap.Milliseconds())+` * interval '1 millisecond'
+					THEN 0 ELSE 1 END AS new_session
+			FROM history h WHERE `+where+`
+		), numbered AS (
+			SELECT *, SUM(new_session) OVER (ORDER BY timestamp) AS session FROM plays
+		)
+		SELECT MIN(timestamp), MAX(timestamp + ms_played * interval '1 millisecond'), COUNT(*), SUM(ms_played)
+		FROM numbered
+		GROUP BY session
+		ORDER BY session `+order+f.page(q),
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []ListeningSession
+	for rows.Next() {
+		var s ListeningSession
+		if err := rows.Scan(&s.Start, &s.End, &s.TrackCount, &s.MsPlayed); err != nil {
+			return nil, err
+		}
+		s.DurationMs = int(s.End.Sub(s.Start).Milliseconds())
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return sessions, nil
+	}
+
+	// Load the plays of every session on the page at once and give each
+	// play to the latest session starting at or before it
+	first, end := sessions[0].Start, sessions[0].End
+	for _, s := range sessions {
+		if s.Start.Before(first) {
+			first = s.Start
+		}
+		if s.End.After(end) {
+			end = s.End
+		}
+	}
+	end = end.Add(time.Millisecond)
+	plays, err := getSessionPlays(Filter{UserId: f.UserId, Start: &first, End: &end, Platforms: f.Platforms})
+	if err != nil {
+		return nil, err
+	}
+	owned := make([][]sessionPlay, len(sessions))
+	for _, p := range plays {
+		owner := -1
+		for i, s := range sessions {
+			if !p.timestamp.Before(s.Start) && (owner == -1 || s.Start.After(sessions[owner].Start)) {
+				owner = i
+			}
+		}
+		if owner != -1 {
+			owned[owner] = append(owned[owner], p)
+		}
+	}
+	for i := range sessions {
+		summarizeSession(&sessions[i], owned[i])
+	}
+	return sessions, nil
+}
+
+// Plays matching f with what is needed to summarize sessions, oldest first
+func getSessionPlays(f Filter) ([]sessionPlay, error) {
+	q := &queryArgs{}
+	rows, err := Pool.Query(context.Background(),
+		`SELECT h.timestamp, COALESCE(h.song_id, 0), h.artist, COALESCE(h.album_name, ''),
+			COALESCE(s.album_id, 0),
+			COALESCE((SELECT COUNT(*) FROM songs WHERE album_id = s.album_id), 0),
+			COALESCE((SELECT COUNT(*) FROM album_tracks WHERE album_id = s.album_id), 0),
+			COALESCE((
+				SELECT t.disc_number * 1000 + t.track_number FROM album_tracks t
+				WHERE t.album_id = s.album_id AND normalize_name(t.title) = normalize_name(s.title)
+				ORDER BY 1 LIMIT 1
+			), 0)
+		FROM history h
+		LEFT JOIN songs s ON s.id = h.song_id
+		WHERE `+f.historyWhere(q)+`
+		ORDER BY h.timestamp`,
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plays []sessionPlay
+	for rows.Next() {
+		var p sessionPlay
+		if err := rows.Scan(&p.timestamp, &p.songId, &p.artist, &p.albumName, &p.albumId, &p.albumTracks, &p.listedTracks, &p.position); err != nil {
+			return nil, err
+		}
+		plays = append(plays, p)
+	}
+	return plays, rows.Err()
+}
+
+// Fills in the dominant artist and album and the full album listens of a
+// session from its plays
+func summarizeSession(s *ListeningSession, plays []sessionPlay) {
+	artistCounts := make(map[string]int)
+	albumCounts := make(map[string]int)
+	for _, p := range plays {
+		artistCounts[p.artist]++
+		if n := artistCounts[p.artist]; n > s.TopArtistCount {
+			s.TopArtist, s.TopArtistCount = p.artist, n
+		}
+		if p.albumName == "" {
+			continue
+		}
+		key := chartKey(p.albumName, p.artist)
+		albumCounts[key]++
+		if n := albumCounts[key]; n > s.TopAlbumCount {
+			s.TopAlbum, s.TopAlbumArtist, s.TopAlbumCount = p.albumName, p.artist, n
+		}
+	}
+	s.FullAlbums = detectFullAlbums(plays)
+}
+
+// Finds runs of consecutive plays from one album that don't repeat a
+// song. When the album has a tracklist the run has to play every listed
+// track in order. Otherwise it has to cover every song the user has on
+// the album, which can't tell skipped tracks or shuffled order apart.
+func detectFullAlbums(plays []sessionPlay) []FullAlbumListen {
+	var found []FullAlbumListen
+	for i := 0; i < len(plays); {
+		j := i
+		seen := make(map[int]bool)
+		inOrder := true
+		for j < len(plays) && plays[j].albumId != 0 && plays[j].albumId == plays[i].albumId && !seen[plays[j].songId] {
+			if j > i && plays[j].position <= plays[j-1].position {
+				inOrder = false
+			}
+			seen[plays[j].songId] = true
+			j++
+		}
+		full := len(seen) >= plays[i].albumTracks
+		if plays[i].listedTracks > 0 {
+			full = inOrder && plays[i].position > 0 && len(seen) >= plays[i].listedTracks
+		}
+		if j > i && len(seen) >= minFullAlbumTracks && full {
+			found = append(found, FullAlbumListen{
+				AlbumName:  plays[i].albumName,
+				Artist:     plays[i].artist,
+				Start:      plays[i].timestamp,
+				TrackCount: len(seen),
+			})
+		}
+		if j == i {
+			j++
+		}
+		i = j
+	}
+	return found
+}
@@ -0,0 +1,79 @@
+package db
+
+// Skip rates. Plays count both listens and skips, so the rate is the share
+// of times something was started and then skipped. Plays Spotify flagged as
+// skipped count as skips here even though they still count as listens
+// everywhere else.
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const skipCondition = "(h.skipped OR h.skip_flagged)"
+
+type SkipStat struct {
+	Name     string `json:"name"`
+	Artist   string `json:"artist,omitempty"`
+	Plays    int    `json:"plays"`
+	Skips    int    `json:"skips"`
+	SkipRate int    `json:"skip_rate"`
+}
+
+func (s *SkipStat) setRate() {
+	if s.Plays > 0 {
+		s.SkipRate = s.Skips * 100 / s.Plays
+	}
+}
+
+// Returns the plays and skips matching the filter, e.g. for one song or
+// artist. f.IncludeSkips is ignored.
+func GetSkipRate(f Filter) (SkipStat, error) {
+	var s SkipStat
+	f.IncludeSkips = true
+	q := &queryArgs{}
+	err := Pool.QueryRow(context.Background(),
+		`SELECT COUNT(*), COUNT(*) FILTER (WHERE `+skipCondition+`)
+		FROM history h
+		WHERE `+f.historyWhere(q),
+		q.args...).Scan(&s.Plays, &s.Skips)
+	s.setRate()
+	return s, err
+}
+
+// Returns the artists or tracks (ChartArtist or ChartTrack) skipped most
+// often relative to how often they were played. Entries with fewer than
+// minPlays plays are left out so a single skip doesn't top the list.
+func GetMostSkipped(f Filter, kind string, minPlays int) ([]SkipStat, error) {
+	f.IncludeSkips = true
+	q := &queryArgs{}
+	where := f.historyWhere(q)
+	var query string
+	if kind == ChartArtist {
+		query = `SELECT ar.name, '', COUNT(*), COUNT(*) FILTER (WHERE ` + skipCondition + `) AS skips
+			FROM history h
+			JOIN artists ar ON ar.id = ANY(h.artist_ids)
+			WHERE ` + where + `
+			GROUP BY ar.id, ar.name`
+	} else {
+		query = `SELECT h.song_name, h.artist, COUNT(*), COUNT(*) FILTER (WHERE ` + skipCondition + `) AS skips
+			FROM history h
+			WHERE ` + where + `
+			GROUP BY h.song_name, h.artist`
+	}
+	query += `
+		HAVING COUNT(*) >= ` + q.add(minPlays) + ` AND COUNT(*) FILTER (WHERE ` + skipCondition + `) > 0
+		ORDER BY COUNT(*) FILTER (WHERE ` + skipCondition + `)::float / COUNT(*) DESC, skips DESC` + f.page(q)
+
+	rows, err := Pool.Query(context.Background(), query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SkipStat, error) {
+		var s SkipStat
+		err := row.Scan(&s.Name, &s.Artist, &s.Plays, &s.Skips)
+		s.setRate()
+		return s, err
+	})
+}
@@ -0,0 +1,249 @@
+package db
+
+// Listening streaks, computed from the daily rollups, and milestones,
+// computed from the history table
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type Streak struct {
+	Current      int       `json:"current"`
+	CurrentStart time.Time `json:"current_start"`
+	Longest      int       `json:"longest"`
+	LongestStart time.Time `json:"longest_start"`
+	LongestEnd   time.Time `json:"longest_end"`
+}
+
+type ArtistStreak struct {
+	Artist Artist
+	Days   int
+	Start  time.Time
+	End    time.Time
+}
+
+type Milestone struct {
+	Kind      string    `json:"kind"`
+	Count     int       `json:"count"`
+	Timestamp time.Time `json:"timestamp"`
+	SongName  string    `json:"song_name"`
+	Artist    string    `json:"artist"`
+	ArtistId  int       `json:"artist_id,omitempty"`
+}
+
+const (
+	MilestoneScrobble    = "scrobble"
+	MilestoneArtistFirst = "artist_first"
+	MilestoneArtistPlays = "artist_plays"
+)
+
+// Play counts that are reported as artist milestones besides the first listen
+var artistMilestoneCounts = []int{100, 500, 1000, 5000}
+
+// Run detection query, formatted with a query for the distinct listening
+// days. Consecutive listening days share the same (day - row_number) value,
+// so grouping by it yields one row per streak. The first row returned is
+// the longest streak, the second is the most recent. A streak is still
+// running if it includes today or yesterday, taken from the database so the
+// days match the rollups' days.
+const streakQuery = `
+	WITH runs AS (
+		SELECT MIN(day) AS start_day, MAX(day) AS end_day, COUNT(*) AS len
+		FROM (
+			SELECT day, day - (ROW_NUMBER() OVER (ORDER BY day))::int AS grp
+			FROM (%s) d
+		) g
+		GROUP BY grp
+	)
+	(SELECT start_day, end_day, len, end_day >= CURRENT_DATE - 1 FROM runs ORDER BY len DESC, end_day DESC LIMIT 1)
+	UNION ALL
+	(SELECT start_day, end_day, len, end_day >= CURRENT_DATE - 1 FROM runs ORDER BY end_day DESC LIMIT 1)`
+
+func scanStreak(rows pgx.Rows) (Streak, error) {
+	defer rows.Close()
+
+	var streak Streak
+	row := 0
+	for rows.Next() {
+		var start, end time.Time
+		var length int
+		var running bool
+		if err := rows.Scan(&start, &end, &length, &running); err != nil {
+			return Streak{}, err
+		}
+		if row == 0 {
+			streak.Longest = length
+			streak.LongestStart = start
+			streak.LongestEnd = end
+		} else if running {
+			streak.Current = length
+			streak.CurrentStart = start
+		}
+		row++
+	}
+	return streak, rows.Err()
+}
+
+func GetListeningStreak(userId int) (Streak, error) {
+	rows, err := Pool.Query(context.Background(),
+		fmt.Sprintf(streakQuery, "SELECT DISTINCT day FROM song_daily WHERE user_id = $1"),
+		userId)
+	if err != nil {
+		return Streak{}, err
+	}
+	return scanStreak(rows)
+}
+
+func GetArtistListeningStreak(userId, artistId int) (Streak, error) {
+	rows, err := Pool.Query(context.Background(),
+		fmt.Sprintf(streakQuery, "SELECT day FROM artist_daily WHERE user_id = $1 AND artist_id = $2"),
+		userId, artistId)
+	if err != nil {
+		return Streak{}, err
+	}
+	return scanStreak(rows)
+}
+
+// Returns the artists with the longest consecutive-day listening streaks
+func GetTopArtistStreaks(userId, limit int) ([]ArtistStreak, error) {
+	rows, err := Pool.Query(context.Background(),
+		`WITH runs AS (
+			SELECT artist_id, MIN(day) AS start_day, MAX(day) AS end_day, COUNT(*) AS len
+			FROM (
+				SELECT artist_id, day,
+					day - (ROW_NUMBER() OVER (PARTITION BY artist_id ORDER BY day))::int AS grp
+				FROM artist_daily
+				WHERE user_id = $1
+			) g
+			GROUP BY artist_id, grp
+		), best AS (
+			SELECT DISTINCT ON (artist_id) artist_id, start_day, end_day, len
+			FROM runs ORDER BY artist_id, len DESC, end_day DESC
+		)
+		SELECT ar.id, ar.name, COALESCE(ar.image_url, ''), b.len, b.start_day, b.end_day
+		FROM best b JOIN artists ar ON ar.id = b.artist_id
+		WHERE b.len > 1
+		ORDER BY b.len DESC, b.end_day DESC
+		LIMIT $2`,
+		userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var streaks []ArtistStreak
+	for rows.Next() {
+		var s ArtistStreak
+		err := rows.Scan(&s.Artist.Id, &s.Artist.Name, &s.Artist.ImageUrl, &s.Days, &s.Start, &s.End)
+		if err != nil {
+			return nil, err
+		}
+		s.Artist.UserId = userId
+		streaks = append(streaks, s)
+	}
+	return streaks, rows.Err()
+}
+
+// Returns the first scrobble, the 100th, 500th, 1,000th and 5,000th, and
+// every 10,000th scrobble after that
+func GetScrobbleMilestones(userId int) ([]Milestone, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT rn, timestamp, song_name, artist FROM (
+			SELECT ROW_NUMBER() OVER (ORDER BY timestamp, id) AS rn, timestamp, song_name, artist
+			FROM history WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL
+		) h
+		WHERE rn IN (1, 100, 500, 1000, 5000) OR rn % 10000 = 0
+		ORDER BY rn`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var milestones []Milestone
+	for rows.Next() {
+		m := Milestone{Kind: MilestoneScrobble}
+		if err := rows.Scan(&m.Count, &m.Timestamp, &m.SongName, &m.Artist); err != nil {
+			return nil, err
+		}
+		milestones = append(milestones, m)
+	}
+	return milestones, rows.Err()
+}
+
+// Returns the first listen of each artist and the scrobbles where they
+// crossed 100, 500, 1,000 and 5,000 plays. An artistId of 0 returns the
+// milestones of every artist.
+func GetArtistMilestones(userId, artistId int) ([]Milestone, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT p.rn, p.timestamp, p.song_name, ar.id, ar.name FROM (
+			SELECT a.artist_id, h.timestamp, h.song_name,
+				ROW_NUMBER() OVER (PARTITION BY a.artist_id ORDER BY h.timestamp, h.id) AS rn
+			FROM history h, unnest(h.artist_ids) AS a(artist_id)
+			WHERE h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL AND ($2 = 0 OR a.artist_id = $2)
+		) p
+		JOIN artists ar ON ar.id = p.artist_id
+		WHERE p.rn = 1 OR p.rn = ANY($3)
+		ORDER BY p.timestamp`,
+		userId, artistId, artistMilestoneCounts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var milestones []Milestone
+	for rows.Next() {
+		var m Milestone
+		err := rows.Scan(&m.Count, &m.Timestamp, &m.SongName, &m.ArtistId, &m.Artist)
+		if err != nil {
+			return nil, err
+		}
+		if m.Count == 1 {
+			m.Kind = MilestoneArtistFirst
+		} else {
+			m.Kind = MilestoneArtistPlays
+		}
+		milestones = append(milestones, m)
+	}
+	return milestones, rows.Err()
+}
+
+// Returns all scrobble and artist milestones, newest first. Artist first
+// listens are only included for artists that went on to reach 100 plays so
+// the list isn't flooded with one-off listens. A limit of 0 returns all.
+func GetMilestones(userId, limit int) ([]Milestone, error) {
+	milestones, err := GetScrobbleMilestones(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	artistMilestones, err := GetArtistMilestones(userId, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	notable := make(map[int]bool)
+	for _, m := range artistMilestones {
+		if m.Kind == MilestoneArtistPlays {
+			notable[m.ArtistId] = true
+		}
+	}
+	for _, m := range artistMilestones {
+		if m.Kind == MilestoneArtistPlays || notable[m.ArtistId] {
+			milestones = append(milestones, m)
+		}
+	}
+
+	sort.SliceStable(milestones, func(i, j int) bool {
+		return milestones[i].Timestamp.After(milestones[j].Timestamp)
+	})
+	if limit > 0 && len(milestones) > limit {
+		milestones = milestones[:limit]
+	}
+	return milestones, nil
+}
@@ -0,0 +1,173 @@
+package db
+
+// Tags on artists, albums and songs. Tags belong to a user like the entities
+// they are on, and a play counts towards a tag when its song, the song's
+// album or any of its artists carries the tag.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	EntityArtist = "artist"
+	EntityAlbum  = "album"
+	EntitySong   = "song"
+)
+
+const (
+	TagSourceUser        = "user"
+	TagSourceLastFM      = "lastfm"
+	TagSourceMusicBrainz = "musicbrainz"
+)
+
+// Condition matching history rows under alias h to the tags under alias
+// et, shared by the tag filter and the tag charts
+const tagMatch = `((et.entity_type = 'artist' AND et.entity_id = ANY(h.artist_ids))
+	OR (et.entity_type = 'song' AND et.entity_id = h.song_id)
+	OR (et.entity_type = 'album' AND et.entity_id = (SELECT album_id FROM songs WHERE id = h.song_id)))`
+
+type EntityTag struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	// Relevance from 1 to 100 as reported by Last.fm or MusicBrainz, 100
+	// for tags added by hand
+	Weight int `json:"weight"`
+}
+
+type TagStat struct {
+	Name        string `json:"name"`
+	ListenCount int    `json:"listen_count"`
+	MsPlayed    int    `json:"ms_played"`
+}
+
+func CreateTagTables() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS tags (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(pk) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			UNIQUE (user_id, name)
+		);
+		CREATE TABLE IF NOT EXISTS entity_tags (
+			tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+			entity_type TEXT NOT NULL,
+			entity_id INTEGER NOT NULL,
+			source TEXT NOT NULL DEFAULT 'user',
+			weight INTEGER NOT NULL DEFAULT 100,
+			PRIMARY KEY (tag_id, entity_type, entity_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_entity_tags_entity ON entity_tags(entity_type, entity_id);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating tag tables: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Tags are compared case insensitively, so they are stored lowercased and
+// with whitespace collapsed
+func NormalizeTag(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+// Tags an entity. A tag added by hand replaces an imported one with the
+// same name, an imported one never replaces a tag added by hand.
+func AddEntityTag(userId int, entityType string, entityId int, name, source string, weight int) error {
+	name = NormalizeTag(name)
+	if name == "" {
+		return nil
+	}
+	_, err := Pool.Exec(context.Background(),
+		`WITH t AS (
+			INSERT INTO tags (user_id, name) VALUES ($1, $2)
+			ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id
+		)
+		INSERT INTO entity_tags (tag_id, entity_type, entity_id, source, weight)
+		SELECT id, $3, $4, $5, $6 FROM t
+		ON CONFLICT (tag_id, entity_type, entity_id) DO UPDATE
+		SET source = EXCLUDED.source, weight = EXCLUDED.weight
+		WHERE entity_tags.source != 'user' OR EXCLUDED.source = 'user'`,
+		userId, name, entityType, entityId, source, weight)
+	return err
+}
+
+func RemoveEntityTag(userId int, entityType string, entityId int, name string) error {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM entity_tags et USING tags t
+		WHERE et.tag_id = t.id AND t.user_id = $1 AND t.name = $2
+			AND et.entity_type = $3 AND et.entity_id = $4`,
+		userId, NormalizeTag(name), entityType, entityId)
+	return err
+}
+
+// Replaces the tags an entity got from one import source
+func SetImportedTags(userId int, entityType string, entityId int, source string, tags []EntityTag) error {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM entity_tags
+		WHERE entity_type = $1 AND entity_id = $2 AND source = $3
+			AND tag_id IN (SELECT id FROM tags WHERE user_id = $4)`,
+		entityType, entityId, source, userId)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if err := AddEntityTag(userId, entityType, entityId, t.Name, source, t.Weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the tags of an entity, most relevant first
+func GetEntityTags(userId int, entityType string, entityId int) ([]EntityTag, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT t.name, et.source, et.weight
+		FROM entity_tags et
+		JOIN tags t ON t.id = et.tag_id
+		WHERE t.user_id = $1 AND et.entity_type = $2 AND et.entity_id = $3
+		ORDER BY et.weight DESC, t.name`,
+		userId, entityType, entityId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[EntityTag])
+}
+
+// Names of every tag the user has on at least one entity
+func GetUserTags(userId int) ([]string, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT t.name FROM tags t
+		WHERE t.user_id = $1 AND EXISTS (SELECT 1 FROM entity_tags WHERE tag_id = t.id)
+		ORDER BY t.name`,
+		userId)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// Returns listen counts per tag for the plays matching the filter. A play
+// counts once for each of its tags.
+func GetTopTags(f Filter) ([]TagStat, error) {
+	q := &queryArgs{}
+	where := f.historyWhere(q)
+	rows, err := Pool.Query(context.Background(),
+		`SELECT t.name AS name, COUNT(*) AS listen_count, COALESCE(SUM(h.ms_played), 0) AS ms_played
+		FROM history h
+		JOIN tags t ON t.user_id = h.user_id
+			AND EXISTS (SELECT 1 FROM entity_tags et WHERE et.tag_id = t.id AND `+tagMatch+`)
+		WHERE `+where+`
+		GROUP BY t.name
+		ORDER BY `+f.topOrder("name")+f.page(q),
+		q.args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[TagStat])
+}
@@ -0,0 +1,172 @@
+package db
+
+// Album tracklists. Tracks are matched to the user's songs on the album by
+// normalized title, so play counts and completion can be shown per track.
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type AlbumTrack struct {
+	DiscNumber    int    `json:"disc_number"`
+	TrackNumber   int    `json:"track_number"`
+	Title         string `json:"title"`
+	DurationMs    int    `json:"duration_ms"`
+	MusicbrainzId string `json:"musicbrainz_id"`
+	SongId        int    `json:"song_id"`
+	ListenCount   int    `json:"listen_count"`
+}
+
+type AlbumCompletion struct {
+	Tracks  []AlbumTrack `json:"tracks"`
+	Played  int          `json:"played"`
+	Total   int          `json:"total"`
+	Percent int          `json:"percent"`
+}
+
+type CompletedAlbum struct {
+	AlbumId int    `json:"album_id"`
+	Title   string `json:"title"`
+	Artist  string `json:"artist"`
+	Played  int    `json:"played"`
+	Total   int    `json:"total"`
+	Percent int    `json:"percent"`
+}
+
+func CreateAlbumTracksTable() error {
+	_, err := Pool.Exec(context.Background(),
+		`CREATE TABLE IF NOT EXISTS album_tracks (
+			album_id INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+			disc_number INTEGER NOT NULL DEFAULT 1,
+			track_number INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			duration_ms INTEGER,
+			musicbrainz_id TEXT,
+			PRIMARY KEY (album_id, disc_number, track_number)
+		);`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating album_tracks table: %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// Replaces the tracklist of an album
+func SetAlbumTracklist(albumId int, tracks []AlbumTrack) error {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM album_tracks WHERE album_id = $1", albumId); err != nil {
+		return err
+	}
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"album_tracks"},
+		[]string{"album_id", "disc_number", "track_number", "title", "duration_ms", "musicbrainz_id"},
+		pgx.CopyFromSlice(len(tracks), func(i int) ([]any, error) {
+			t := tracks[i]
+			return []any{albumId, t.DiscNumber, t.TrackNumber, t.Title, nullIfZero(t.DurationMs), nullIfEmpty(t.MusicbrainzId)}, nil
+		}))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Returns the tracklist of an album with the song each track matched and
+// how often the user played it. Empty if the album has no tracklist.
+func GetAlbumCompletion(userId, albumId int) (AlbumCompletion, error) {
+	var c AlbumCompletion
+	rows, err := Pool.Query(context.Background(),
+		`SELECT t.disc_number, t.track_number, t.title, COALESCE(t.duration_ms, 0), COALESCE(t.musicbrainz_id, ''),
+			COALESCE(s.id, 0),
+			(SELECT COUNT(*) FROM history h WHERE h.user_id = $1 AND h.song_id = s.id AND NOT h.skipped AND h.deleted_at IS NULL)
+		FROM album_tracks t
+		LEFT JOIN LATERAL (
+			SELECT id FROM songs
+			WHERE user_id = $1 AND album_id = t.album_id AND normalize_name(title) = normalize_name(t.title)
+			ORDER BY id
+			LIMIT 1
+		) s ON TRUE
+		WHERE t.album_id = $2
+		ORDER BY t.disc_number, t.track_number`,
+		userId, albumId)
+	if err != nil {
+		return c, err
+	}
+	c.Tracks, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (AlbumTrack, error) {
+		var t AlbumTrack
+		err := row.Scan(&t.DiscNumber, &t.TrackNumber, &t.Title, &t.DurationMs, &t.MusicbrainzId, &t.SongId, &t.ListenCount)
+		return t, err
+	})
+	if err != nil {
+		return c, err
+	}
+
+	c.Total = len(c.Tracks)
+	for _, t := range c.Tracks {
+		if t.ListenCount > 0 {
+			c.Played++
+		}
+	}
+	if c.Total > 0 {
+		c.Percent = c.Played * 100 / c.Total
+	}
+	return c, nil
+}
+
+// Albums with a tracklist ordered by the share of their tracks the user
+// has played, then by tracklist length
+func GetMostCompletedAlbums(userId, limit int) ([]CompletedAlbum, error) {
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, title, artist, played, total FROM (
+			SELECT al.id, al.title, COALESCE(ar.name, '') AS artist,
+				COUNT(*) FILTER (WHERE EXISTS (
+					SELECT 1 FROM songs s
+					JOIN history h ON h.song_id = s.id AND h.user_id = $1 AND NOT h.skipped AND h.deleted_at IS NULL
+					WHERE s.user_id = $1 AND s.album_id = al.id AND normalize_name(s.title) = normalize_name(t.title)
+				)) AS played,
+				COUNT(*) AS total
+			FROM albums al
+			JOIN album_tracks t ON t.album_id = al.id
+			LEFT JOIN artists ar ON ar.id = al.artist_id
+			WHERE al.user_id = $1
+			GROUP BY al.id, al.title, ar.name
+		) c
+		WHERE played > 0
+		ORDER BY played::float / total DESC, total DESC, title
+		LIMIT $2`,
+		userId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (CompletedAlbum, error) {
+		var a CompletedAlbum
+		err := row.Scan(&a.AlbumId, &a.Title, &a.Artist, &a.Played, &a.Total)
+		if a.Total > 0 {
+			a.Percent = a.Played * 100 / a.Total
+		}
+		return a, err
+	})
+}
+
+func nullIfZero(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,205 @@
+package db
+
+// The trash of deleted scrobbles. Deleting only sets deleted_at, so until a
+// scrobble is purged it can be restored along with its place in the stats.
+// Scrobbling a deleted play again purges it and records the new scrobble.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// How often trash older than its user's trash_days is purged
+const trashPurgeInterval = time.Hour
+
+type TrashEntry struct {
+	ScrobbleEntry
+	DeletedAt time.Time
+}
+
+// Returns up to limit of the user's deleted scrobbles, last deleted first,
+// and how many there are in all
+func GetTrash(userId, limit int) ([]TrashEntry, int, error) {
+	var count int
+	err := Pool.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM history WHERE user_id = $1 AND deleted_at IS NOT NULL`,
+		userId).Scan(&count)
+	if err != nil || count == 0 {
+		return nil, 0, err
+	}
+
+	rows, err := Pool.Query(context.Background(),
+		`SELECT id, timestamp, song_name, artist, COALESCE(album_name, ''), COALESCE(ms_played, 0),
+			COALESCE(platform, ''), COALESCE(client, ''), deleted_at
+		FROM history
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, timestamp DESC
+		LIMIT $2`,
+		userId, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (TrashEntry, error) {
+		var e TrashEntry
+		err := row.Scan(&e.Id, &e.Timestamp, &e.SongName, &e.ArtistName, &e.AlbumName, &e.MsPlayed,
+			&e.Platform, &e.Client, &e.DeletedAt)
+		return e, err
+	})
+	return entries, count, err
+}
+
+// A scrobble to add to the history, with its artists, album and song
+// already resolved
+type NewScrobble struct {
+	UserId      int
+	Timestamp   time.Time
+	SongName    string
+	Artist      string
+	Album       string
+	AlbumArtist string
+	MsPlayed    int
+	Platform    string
+	Client      string
+	Skipped     bool
+	ReasonEnd   string
+	ArtistId    int
+	SongId      int
+	ArtistIds   []int
+}
+
+// Adds a scrobble to the history and the rollups in one transaction, and
+// returns whether it was added. Deleted copies of it, the same song by the
+// same artist within tolerance of it, are purged first so they don't keep
+// it out.
+func InsertScrobble(s NewScrobble, tolerance time.Duration) (bool, error) {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`DELETE FROM history
+		WHERE user_id = $1 AND artist = $2 AND song_name = $3 AND deleted_at IS NOT NULL
+			AND (timestamp = $4 OR ABS(EXTRACT(EPOCH FROM (timestamp - $4))) < $5)`,
+		s.UserId, s.Artist, s.SongName, s.Timestamp, tolerance.Seconds())
+	if err != nil {
+		return false, err
+	}
+
+	tag, err := tx.Exec(ctx,
+		`INSERT INTO history (user_id, timestamp, song_name, artist, album_name, ms_played, platform, artist_id, song_id, artist_ids, client, skipped, reason_end, album_artist)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NULLIF($8, 0), NULLIF($9, 0), $10, NULLIF($11, ''), $12, NULLIF($13, ''), NULLIF($14, ''))
+		ON CONFLICT (user_id, song_name, artist, timestamp) DO NOTHING`,
+		s.UserId, s.Timestamp, s.SongName, s.Artist, s.Album, s.MsPlayed, s.Platform, s.ArtistId, s.SongId,
+		s.ArtistIds, s.Client, s.Skipped, s.ReasonEnd, s.AlbumArtist)
+	if err != nil || tag.RowsAffected() == 0 {
+		return false, err
+	}
+
+	if s.Skipped {
+		// Skips are left out of the rollups but not the profile stats
+		ForgetProfileStats(s.UserId)
+	} else {
+		err = incrementDailyRollups(tx, s.UserId, s.Timestamp, s.SongName, s.Artist, s.Album,
+			s.AlbumArtist, s.MsPlayed, s.ArtistIds)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit(ctx)
+}
+
+// Takes the deleted scrobbles among ids, or all of them when ids is nil, out
+// of the trash and returns how many were restored
+func RestoreScrobbles(userId int, ids []int) (int, error) {
+	ctx := context.Background()
+	tx, err := Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var n int
+	var first, last *time.Time
+	err = tx.QueryRow(ctx,
+		`WITH restored AS (
+			UPDATE history SET deleted_at = NULL
+			WHERE user_id = $1 AND deleted_at IS NOT NULL AND ($2::int[] IS NULL OR id = ANY($2))
+			RETURNING timestamp
+		)
+		SELECT COUNT(*), MIN(timestamp), MAX(timestamp) FROM restored`,
+		userId, ids).Scan(&n, &first, &last)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	if err := refreshDailyRollups(tx, userId, *first, *last); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Deletes the deleted scrobbles among ids, or all of them when ids is nil,
+// for good and returns how many were purged
+func PurgeScrobbles(userId int, ids []int) (int, error) {
+	return purgeTrash(Pool, userId, ids)
+}
+
+func purgeTrash(q querier, userId int, ids []int) (int, error) {
+	tag, err := q.Exec(context.Background(),
+		`DELETE FROM history
+		WHERE user_id = $1 AND deleted_at IS NOT NULL AND ($2::int[] IS NULL OR id = ANY($2))`,
+		userId, ids)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Returns after how many days the user's deleted scrobbles are purged, 0
+// for never
+func GetTrashDays(userId int) (int, error) {
+	var days int
+	err := Pool.QueryRow(context.Background(),
+		`SELECT trash_days FROM users WHERE pk = $1`,
+		userId).Scan(&days)
+	return days, err
+}
+
+func SetTrashDays(userId, days int) error {
+	_, err := Pool.Exec(context.Background(),
+		`UPDATE users SET trash_days = $2 WHERE pk = $1`,
+		userId, days)
+	return err
+}
+
+// Purges every user's trash of scrobbles deleted longer ago than their
+// trash_days now and then periodically
+func StartTrashPurger() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	go func() {
+		for {
+			purgeExpiredTrash()
+			<-ticker.C
+		}
+	}()
+}
+
+func purgeExpiredTrash() {
+	_, err := Pool.Exec(context.Background(),
+		`DELETE FROM history h USING users u
+		WHERE h.user_id = u.pk AND u.trash_days > 0
+			AND h.deleted_at < NOW() - make_interval(days => u.trash_days)`)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error purging expired trash: %v\n", err)
+	}
+}
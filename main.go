@@ -35,6 +35,9 @@ func main() {
 
 	check("ensuring all tables exist", db.CreateAllTables())
 	check("cleaning expired sessions", db.CleanupExpiredSessions())
+	check("building daily rollups", db.BackfillDailyRollups())
 	scrobble.StartSpotifyPoller()
+	db.StartChartUpdater()
+	db.StartTrashPurger()
 	web.Start()
 }
@@ -0,0 +1,174 @@
+package metadata
+
+// Genre lookups used for importing tags. Both sources report a vote count
+// per tag, which is scaled to a weight from 1 to 100 relative to the most
+// popular tag so they can be ranked side by side.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"muzi/db"
+)
+
+const lastFMAPIURL = "https://ws.audioscrobbler.com/2.0/"
+
+// At most this many tags are imported per entity, and tags with a weight
+// below minTagWeight are dropped as noise
+const (
+	maxImportedTags = 10
+	minTagWeight    = 10
+)
+
+type tagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func scaleTags(counts []tagCount) []db.EntityTag {
+	top := 0
+	for _, c := range counts {
+		top = max(top, c.Count)
+	}
+	var tags []db.EntityTag
+	for _, c := range counts {
+		weight := 100
+		if top > 0 {
+			weight = c.Count * 100 / top
+		}
+		if weight < minTagWeight || db.NormalizeTag(c.Name) == "" {
+			continue
+		}
+		tags = append(tags, db.EntityTag{Name: c.Name, Weight: weight})
+	}
+	// Both services return tags sorted by count already
+	if len(tags) > maxImportedTags {
+		tags = tags[:maxImportedTags]
+	}
+	return tags
+}
+
+// Finds the MusicBrainz id of an artist or recording by name
+func searchMusicBrainz(entity, query string) (string, error) {
+	var search struct {
+		Artists []struct {
+			Id string `json:"id"`
+		} `json:"artists"`
+		Recordings []struct {
+			Id string `json:"id"`
+		} `json:"recordings"`
+	}
+	err := getJSON(musicBrainzAPIURL+"/"+entity+"/?fmt=json&limit=1&query="+url.QueryEscape(query), &search)
+	if err != nil {
+		return "", err
+	}
+	if len(search.Artists) > 0 {
+		return search.Artists[0].Id, nil
+	}
+	if len(search.Recordings) > 0 {
+		return search.Recordings[0].Id, nil
+	}
+	return "", ErrNotFound
+}
+
+// Fetches the MusicBrainz genres of an artist, album or song (one of
+// db.EntityArtist, db.EntityAlbum or db.EntitySong). mbid may be empty, in
+// which case the entity is searched for by name and artist.
+func GetMusicBrainzGenres(entityType, mbid, name, artist string) ([]db.EntityTag, error) {
+	var endpoint string
+	var err error
+	switch entityType {
+	case db.EntityArtist:
+		if mbid == "" {
+			mbid, err = searchMusicBrainz("artist", "artist:"+quote(name))
+		}
+		endpoint = "/artist/"
+	case db.EntitySong:
+		if mbid == "" {
+			mbid, err = searchMusicBrainz("recording", "recording:"+quote(name)+" AND artist:"+quote(artist))
+		}
+		endpoint = "/recording/"
+	case db.EntityAlbum:
+		// Genres are mostly voted on release groups rather than releases
+		var releaseId string
+		releaseId, err = FindRelease(mbid, name, artist)
+		if err != nil {
+			return nil, err
+		}
+		var release struct {
+			ReleaseGroup struct {
+				Id string `json:"id"`
+			} `json:"release-group"`
+		}
+		err = getJSON(musicBrainzAPIURL+"/release/"+url.PathEscape(releaseId)+"?inc=release-groups&fmt=json", &release)
+		mbid = release.ReleaseGroup.Id
+		endpoint = "/release-group/"
+	default:
+		return nil, fmt.Errorf("unknown entity type %q", entityType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Genres []tagCount `json:"genres"`
+	}
+	err = getJSON(musicBrainzAPIURL+endpoint+url.PathEscape(mbid)+"?inc=genres&fmt=json", &result)
+	if err != nil {
+		return nil, err
+	}
+	return scaleTags(result.Genres), nil
+}
+
+// Fetches the Last.fm top tags of an artist, album or song. artist is
+// ignored for artists.
+func GetLastFMTopTags(apiKey, entityType, name, artist string) ([]db.EntityTag, error) {
+	params := url.Values{}
+	params.Set("api_key", apiKey)
+	params.Set("format", "json")
+	params.Set("autocorrect", "1")
+	switch entityType {
+	case db.EntityArtist:
+		params.Set("method", "artist.gettoptags")
+		params.Set("artist", name)
+	case db.EntityAlbum:
+		params.Set("method", "album.gettoptags")
+		params.Set("artist", artist)
+		params.Set("album", name)
+	case db.EntitySong:
+		params.Set("method", "track.gettoptags")
+		params.Set("artist", artist)
+		params.Set("track", name)
+	default:
+		return nil, fmt.Errorf("unknown entity type %q", entityType)
+	}
+
+	var result struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+		TopTags struct {
+			Tag []tagCount `json:"tag"`
+		} `json:"toptags"`
+	}
+	req, err := http.NewRequest("GET", lastFMAPIURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Last.fm describes errors in the body whatever the status
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Last.fm returned %s", resp.Status)
+	}
+	if result.Error != 0 {
+		return nil, fmt.Errorf("Last.fm: %s", result.Message)
+	}
+	return scaleTags(result.TopTags.Tag), nil
+}
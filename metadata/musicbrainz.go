@@ -0,0 +1,164 @@
+package metadata
+
+// Lookups against the MusicBrainz web service. MusicBrainz asks clients to
+// identify themselves with contact details and to make at most one request
+// per second, so every request goes through getJSON, which waits its turn.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"muzi/config"
+	"muzi/db"
+)
+
+const musicBrainzAPIURL = "https://musicbrainz.org/ws/2"
+
+const musicBrainzInterval = time.Second
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// Time of the last MusicBrainz request, shared by every lookup
+var (
+	lastRequest   time.Time
+	lastRequestMu sync.Mutex
+)
+
+// Returns the User-Agent sent with every request, with the contact from the
+// config when one is set
+func userAgent() string {
+	if contact := config.Get().MusicBrainz.Contact; contact != "" {
+		return "muzi/1.0 ( " + contact + " )"
+	}
+	return "muzi/1.0"
+}
+
+// Blocks until a MusicBrainz request is allowed
+func waitForMusicBrainz() {
+	lastRequestMu.Lock()
+	defer lastRequestMu.Unlock()
+	if wait := musicBrainzInterval - time.Since(lastRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	lastRequest = time.Now()
+}
+
+var ErrNotFound = errors.New("not found on MusicBrainz")
+
+type mbRelease struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Media []struct {
+		Position int `json:"position"`
+		Tracks   []struct {
+			Position  int    `json:"position"`
+			Title     string `json:"title"`
+			Length    int    `json:"length"`
+			Recording struct {
+				Id string `json:"id"`
+			} `json:"recording"`
+		} `json:"tracks"`
+	} `json:"media"`
+}
+
+func getJSON(endpoint string, v any) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", "application/json")
+
+	waitForMusicBrainz()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("MusicBrainz returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Quotes a value for a MusicBrainz search query
+func quote(s string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// Finds the release id of an album. mbid may be a release or release group
+// id; when it is empty the release is searched for by title and artist.
+func FindRelease(mbid, title, artist string) (string, error) {
+	if mbid != "" {
+		var release mbRelease
+		err := getJSON(musicBrainzAPIURL+"/release/"+url.PathEscape(mbid)+"?fmt=json", &release)
+		if err == nil {
+			return release.Id, nil
+		}
+		if err != ErrNotFound {
+			return "", err
+		}
+
+		var group struct {
+			Releases []struct {
+				Id string `json:"id"`
+			} `json:"releases"`
+		}
+		err = getJSON(musicBrainzAPIURL+"/release-group/"+url.PathEscape(mbid)+"?inc=releases&fmt=json", &group)
+		if err != nil {
+			return "", err
+		}
+		if len(group.Releases) == 0 {
+			return "", ErrNotFound
+		}
+		return group.Releases[0].Id, nil
+	}
+
+	var search struct {
+		Releases []struct {
+			Id string `json:"id"`
+		} `json:"releases"`
+	}
+	query := "release:" + quote(title) + " AND artist:" + quote(artist)
+	err := getJSON(musicBrainzAPIURL+"/release/?fmt=json&limit=1&query="+url.QueryEscape(query), &search)
+	if err != nil {
+		return "", err
+	}
+	if len(search.Releases) == 0 {
+		return "", ErrNotFound
+	}
+	return search.Releases[0].Id, nil
+}
+
+// Fetches the tracklist of a release
+func GetReleaseTracklist(releaseId string) ([]db.AlbumTrack, error) {
+	var release mbRelease
+	err := getJSON(musicBrainzAPIURL+"/release/"+url.PathEscape(releaseId)+"?inc=recordings&fmt=json", &release)
+	if err != nil {
+		return nil, err
+	}
+
+	var tracks []db.AlbumTrack
+	for _, medium := range release.Media {
+		for _, t := range medium.Tracks {
+			tracks = append(tracks, db.AlbumTrack{
+				DiscNumber:    medium.Position,
+				TrackNumber:   t.Position,
+				Title:         t.Title,
+				DurationMs:    t.Length,
+				MusicbrainzId: t.Recording.Id,
+			})
+		}
+	}
+	return tracks, nil
+}
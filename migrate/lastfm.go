@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"muzi/credits"
 	"muzi/db"
 
 	"github.com/jackc/pgx/v5"
@@ -136,6 +137,30 @@ func ImportLastFM(
 		}
 		return err
 	}
+	rules, err := db.GetRuleSet(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading rewrite rules: %v\n", err)
+		if progressChan != nil {
+			progressChan <- ProgressUpdate{Status: "error", Error: err.Error()}
+		}
+		return err
+	}
+	parser, err := db.GetCreditParser(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading credit exceptions: %v\n", err)
+		if progressChan != nil {
+			progressChan <- ProgressUpdate{Status: "error", Error: err.Error()}
+		}
+		return err
+	}
+	aliases, err := db.GetArtistAliases(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading artist aliases: %v\n", err)
+		if progressChan != nil {
+			progressChan <- ProgressUpdate{Status: "error", Error: err.Error()}
+		}
+		return err
+	}
 	fmt.Printf("%s started a LastFM import job of %d total pages\n", username,
 		totalPages)
 
@@ -177,11 +202,15 @@ func ImportLastFM(
 			fmt.Fprintf(os.Stderr, "Error on page %d: %v\n", result.pageNum, result.err)
 			continue
 		}
+		for i, t := range result.tracks {
+			result.tracks[i].Artist, result.tracks[i].SongName, result.tracks[i].Album = rules.Rewrite(t.Artist, t.SongName, t.Album)
+			result.tracks[i].Artist = aliases.Canonical(parser, result.tracks[i].Artist)
+		}
 		trackBatch = append(trackBatch, result.tracks...)
 		for len(trackBatch) >= batchSize {
 			batch := trackBatch[:batchSize]
 			trackBatch = trackBatch[batchSize:]
-			err := insertBatch(batch, &totalImported)
+			err := insertBatch(batch, parser, &totalImported)
 			if err != nil {
 				// prevent logs being filled by duplicate warnings
 				if !strings.Contains(err.Error(), "duplicate") {
@@ -208,7 +237,7 @@ func ImportLastFM(
 	}
 
 	if len(trackBatch) > 0 {
-		err := insertBatch(trackBatch, &totalImported)
+		err := insertBatch(trackBatch, parser, &totalImported)
 		if err != nil {
 			// prevent logs being filled by duplicate warnings
 			if !strings.Contains(err.Error(), "duplicate") {
@@ -235,12 +264,12 @@ func ImportLastFM(
 	return nil
 }
 
-func insertBatch(tracks []LastFMTrack, totalImported *int) error {
+func insertBatch(tracks []LastFMTrack, parser *credits.Parser, totalImported *int) error {
 	if len(tracks) == 0 {
 		return nil
 	}
 
-	artistIdMap, err := resolveLastFMArtistIds(tracks)
+	artistIdMap, err := resolveLastFMArtistIds(tracks, parser)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error resolving artist IDs: %v\n", err)
 		return err
@@ -248,7 +277,7 @@ func insertBatch(tracks []LastFMTrack, totalImported *int) error {
 
 	rows := make([][]any, 0, len(tracks))
 	for _, t := range tracks {
-		artistNames := parseArtistString(t.Artist)
+		artistNames := parser.Credits(t.Artist, t.SongName)
 		var artistIds []int
 		for _, name := range artistNames {
 			if ids, ok := artistIdMap[name]; ok {
@@ -276,14 +305,27 @@ func insertBatch(tracks []LastFMTrack, totalImported *int) error {
 		pgx.CopyFromRows(rows),
 	)
 	*totalImported += int(copyCount)
-	return err
+	if err != nil {
+		return err
+	}
+
+	minTs, maxTs := tracks[0].Timestamp, tracks[0].Timestamp
+	for _, t := range tracks {
+		if t.Timestamp.Before(minTs) {
+			minTs = t.Timestamp
+		}
+		if t.Timestamp.After(maxTs) {
+			maxTs = t.Timestamp
+		}
+	}
+	return db.RefreshDailyRollups(tracks[0].UserId, minTs, maxTs)
 }
 
-func resolveLastFMArtistIds(tracks []LastFMTrack) (map[string][]int, error) {
+func resolveLastFMArtistIds(tracks []LastFMTrack, parser *credits.Parser) (map[string][]int, error) {
 	artistIdMap := make(map[string][]int)
 
 	for _, t := range tracks {
-		artistNames := parseArtistString(t.Artist)
+		artistNames := parser.Credits(t.Artist, t.SongName)
 		for _, name := range artistNames {
 			if _, exists := artistIdMap[name]; !exists {
 				artistId, _, err := db.GetOrCreateArtist(t.UserId, name)
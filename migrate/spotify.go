@@ -6,6 +6,7 @@ package migrate
 // This file handles:
 // - Parsing Spotify JSON track data
 // - Batch processing with deduplication (20-second window)
+// - Flagging skips and plays under 20 seconds
 // - Efficient bulk inserts using pgx.CopyFrom
 
 import (
@@ -16,6 +17,7 @@ import (
 	"strings"
 	"time"
 
+	"muzi/credits"
 	"muzi/db"
 
 	"github.com/jackc/pgx/v5"
@@ -34,6 +36,24 @@ type SpotifyTrack struct {
 	Name      string    `json:"master_metadata_track_name"`
 	Artist    string    `json:"master_metadata_album_artist_name"`
 	Album     string    `json:"master_metadata_album_album_name"`
+	Platform  string    `json:"platform"`
+	Skipped   *bool     `json:"skipped"`
+	ReasonEnd string    `json:"reason_end"`
+	// The export only names the album artist, which stands in for the track
+	// artist as well. It is kept apart from Artist since rewrite rules may
+	// change the track artist alone.
+	AlbumArtist string `json:"-"`
+}
+
+// Plays shorter than minPlayTime are skips and left out of stats
+func (t SpotifyTrack) isSkip() bool {
+	return t.Played < minPlayTime
+}
+
+// Spotify's own skipped flag, set on plays of any length. It is kept for
+// skip rates but doesn't stop a play from counting.
+func (t SpotifyTrack) skipFlagged() bool {
+	return t.Skipped != nil && *t.Skipped
 }
 
 // Implements pgx.CopyFromSource for efficient bulk inserts.
@@ -56,20 +76,46 @@ type dbTrack struct {
 
 // Import Spotify listening history into the database.
 // Processes tracks in batches of 1000 (default), filters out tracks played <
-// 20 seconds, deduplicates against existing data, and sends progress updates
+// 20 seconds unless keepSkips is set, in which case they are stored flagged
+// as skips, deduplicates against existing data, and sends progress updates
 // via progressChan.
 // The progressChan must not be closed by the caller. The receiver should
 // stop reading when Status is "completed". This avoids panics from
 // sending on a closed channel.
 
 func ImportSpotify(tracks []SpotifyTrack,
-	userId int, progressChan chan ProgressUpdate,
+	userId int, progressChan chan ProgressUpdate, keepSkips bool,
 ) {
 	totalImported := 0
 	totalTracks := len(tracks)
 	batchStart := 0
 	totalBatches := (totalTracks + batchSize - 1) / batchSize
 
+	rules, err := db.GetRuleSet(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading rewrite rules: %v\n", err)
+		if progressChan != nil {
+			progressChan <- ProgressUpdate{Status: "error", Error: err.Error()}
+		}
+		return
+	}
+	parser, err := db.GetCreditParser(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading credit exceptions: %v\n", err)
+		if progressChan != nil {
+			progressChan <- ProgressUpdate{Status: "error", Error: err.Error()}
+		}
+		return
+	}
+	aliases, err := db.GetArtistAliases(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading artist aliases: %v\n", err)
+		if progressChan != nil {
+			progressChan <- ProgressUpdate{Status: "error", Error: err.Error()}
+		}
+		return
+	}
+
 	// Send initial progress update
 	sendProgressUpdate(progressChan, 0, 0, totalBatches, totalImported, "running")
 
@@ -80,10 +126,15 @@ func ImportSpotify(tracks []SpotifyTrack,
 
 		var validTracks []SpotifyTrack
 		for i := batchStart; i < batchEnd; i++ {
-			if tracks[i].Played >= minPlayTime &&
+			if (tracks[i].Played >= minPlayTime || keepSkips) &&
 				tracks[i].Name != "" &&
 				tracks[i].Artist != "" {
-				validTracks = append(validTracks, tracks[i])
+				t := tracks[i]
+				t.Artist, t.Name, t.Album = rules.Rewrite(t.Artist, t.Name, t.Album)
+				t.Artist = aliases.Canonical(parser, t.Artist)
+				t.AlbumArtist, _, _ = rules.Rewrite(t.AlbumArtist, "", "")
+				t.AlbumArtist = aliases.Canonical(parser, t.AlbumArtist)
+				validTracks = append(validTracks, t)
 			}
 		}
 
@@ -108,7 +159,7 @@ func ImportSpotify(tracks []SpotifyTrack,
 			continue
 		}
 
-		artistIdMap, err := resolveArtistIds(userId, validTracks)
+		artistIdMap, err := resolveArtistIds(userId, parser, validTracks)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error resolving artist IDs: %v\n", err)
 			batchStart += batchSize
@@ -136,6 +187,11 @@ func ImportSpotify(tracks []SpotifyTrack,
 				"platform",
 				"artist_id",
 				"artist_ids",
+				"client",
+				"skipped",
+				"skip_flagged",
+				"reason_end",
+				"album_artist",
 			},
 			src,
 		)
@@ -146,6 +202,12 @@ func ImportSpotify(tracks []SpotifyTrack,
 			}
 		} else {
 			totalImported += int(copyCount)
+
+			minTs, maxTs := findTimeRange(validTracks)
+			err = db.RefreshDailyRollups(userId, minTs, maxTs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error refreshing daily rollups: %v\n", err)
+			}
 		}
 
 		sendProgressUpdate(
@@ -229,12 +291,12 @@ func getDupes(userId int, tracks []SpotifyTrack) (map[string]struct{}, error) {
 	return duplicates, nil
 }
 
-func resolveArtistIds(userId int, tracks []SpotifyTrack) (map[string][]int, error) {
+func resolveArtistIds(userId int, parser *credits.Parser, tracks []SpotifyTrack) (map[string][]int, error) {
 	artistIdMap := make(map[string][]int)
 
 	for _, track := range tracks {
 		trackKey := createTrackKey(track)
-		artistNames := parseArtistString(track.Artist)
+		artistNames := parser.Credits(track.Artist, track.Name)
 
 		var artistIds []int
 		for _, name := range artistNames {
@@ -252,20 +314,6 @@ func resolveArtistIds(userId int, tracks []SpotifyTrack) (map[string][]int, erro
 	return artistIdMap, nil
 }
 
-func parseArtistString(artist string) []string {
-	if artist == "" {
-		return nil
-	}
-	var artists []string
-	for _, a := range strings.Split(artist, ",") {
-		a = strings.TrimSpace(a)
-		if a != "" {
-			artists = append(artists, a)
-		}
-	}
-	return artists
-}
-
 // Get the min/max timestamp range for a batch of tracks
 func findTimeRange(tracks []SpotifyTrack) (time.Time, time.Time) {
 	var minTs, maxTs time.Time
@@ -281,7 +329,8 @@ func findTimeRange(tracks []SpotifyTrack) (time.Time, time.Time) {
 }
 
 // Get all tracks in the database for a user that have the same timestamp
-// range as the current batch
+// range as the current batch. Deleted tracks are included so importing the
+// same export again doesn't bring them back.
 func fetchDbTracks(userId int, minTs, maxTs time.Time) ([]dbTrack, error) {
 	rows, err := db.Pool.Query(context.Background(),
 		`SELECT song_name, artist, timestamp 
@@ -385,9 +434,22 @@ func (s *trackSource) Values() ([]any, error) {
 		"spotify",
 		primaryArtistId,
 		artistIds,
+		nullIfEmpty(t.Platform),
+		t.isSkip(),
+		t.skipFlagged(),
+		nullIfEmpty(t.ReasonEnd),
+		nullIfEmpty(t.AlbumArtist),
 	}, nil
 }
 
+// Optional string from the export, stored as NULL when missing
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
 // Returns any error encountered during iteration.
 // Currently always returns nil as errors are logged in Next()
 func (s *trackSource) Err() error {
@@ -413,5 +475,6 @@ func (s *SpotifyTrack) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("parsing timestamp: %w", err)
 	}
 	s.Timestamp = ts
+	s.AlbumArtist = s.Artist
 	return nil
 }
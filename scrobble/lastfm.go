@@ -221,7 +221,11 @@ func (h *LastFMHandler) handleNowPlaying(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *LastFMHandler) handleScrobble(w http.ResponseWriter, r *http.Request) {
+	// The 2.0 API names the session key sk
 	sessionKey := r.PostForm.Get("s")
+	if sessionKey == "" {
+		sessionKey = r.PostForm.Get("sk")
+	}
 	if sessionKey == "" {
 		h.respond(w, "failed", 9, "Invalid session")
 		return
@@ -233,7 +237,7 @@ func (h *LastFMHandler) handleScrobble(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scrobbles := h.parseScrobbles(r.PostForm, userId)
+	scrobbles := h.parseScrobbles(r.PostForm, userId, r.UserAgent())
 	if len(scrobbles) == 0 {
 		h.respond(w, "failed", 1, "No scrobbles to submit")
 		return
@@ -256,23 +260,27 @@ func (h *LastFMHandler) handleScrobble(w http.ResponseWriter, r *http.Request) {
 	h.respondOK(w, fmt.Sprintf("OK\n%d\n%d\n", accepted, ignored))
 }
 
-func (h *LastFMHandler) parseScrobbles(form url.Values, userId int) []Scrobble {
+// Scrobblers using the Last.fm API identify themselves only through their
+// user agent, so that is stored as the client. Clients of the 1.2
+// submissions protocol send a[i], t[i], b[i], i[i] and l[i], and clients of
+// the 2.0 API's track.scrobble send artist[i], track[i], album[i],
+// timestamp[i] and duration[i], along with albumArtist[i], which the 1.2
+// protocol has no key for.
+func (h *LastFMHandler) parseScrobbles(form url.Values, userId int, client string) []Scrobble {
 	var scrobbles []Scrobble
 
 	for i := 0; i < 50; i++ {
-		var artist, track, album, timestampStr string
-
-		if i == 0 {
-			artist = form.Get("a[0]")
-			track = form.Get("t[0]")
-			album = form.Get("b[0]")
-			timestampStr = form.Get("i[0]")
-		} else {
-			artist = form.Get(fmt.Sprintf("a[%d]", i))
-			track = form.Get(fmt.Sprintf("t[%d]", i))
-			album = form.Get(fmt.Sprintf("b[%d]", i))
-			timestampStr = form.Get(fmt.Sprintf("i[%d]", i))
+		get := func(key12, key20 string) string {
+			if v := form.Get(fmt.Sprintf("%s[%d]", key12, i)); v != "" {
+				return v
+			}
+			return form.Get(fmt.Sprintf("%s[%d]", key20, i))
 		}
+		artist := get("a", "artist")
+		track := get("t", "track")
+		album := get("b", "album")
+		timestampStr := get("i", "timestamp")
+		albumArtist := form.Get(fmt.Sprintf("albumArtist[%d]", i))
 
 		if artist == "" || track == "" || timestampStr == "" {
 			break
@@ -283,7 +291,7 @@ func (h *LastFMHandler) parseScrobbles(form url.Values, userId int) []Scrobble {
 			continue
 		}
 
-		duration := form.Get(fmt.Sprintf("l[%d]", i))
+		duration := get("l", "duration")
 		msPlayed := 0
 		if duration != "" {
 			if d, err := strconv.Atoi(duration); err == nil {
@@ -292,13 +300,15 @@ func (h *LastFMHandler) parseScrobbles(form url.Values, userId int) []Scrobble {
 		}
 
 		scrobbles = append(scrobbles, Scrobble{
-			UserId:    userId,
-			Timestamp: time.Unix(ts, 0).UTC(),
-			SongName:  track,
-			Artist:    artist,
-			Album:     album,
-			MsPlayed:  msPlayed,
-			Platform:  "lastfm_api",
+			UserId:      userId,
+			Timestamp:   time.Unix(ts, 0).UTC(),
+			SongName:    track,
+			Artist:      artist,
+			Album:       album,
+			AlbumArtist: albumArtist,
+			MsPlayed:    msPlayed,
+			Platform:    "lastfm_api",
+			Client:      client,
 		})
 	}
 
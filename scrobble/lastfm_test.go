@@ -0,0 +1,66 @@
+package scrobble
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScrobbles(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    []Scrobble
+	}{
+		{
+			name: "1.2 submission",
+			payload: "s=0123456789abcdef&a%5B0%5D=Daft+Punk&t%5B0%5D=One+More+Time&i%5B0%5D=1700000000" +
+				"&o%5B0%5D=P&r%5B0%5D=&l%5B0%5D=320&b%5B0%5D=Discovery&n%5B0%5D=1&m%5B0%5D=" +
+				"&a%5B1%5D=Kanye+West&t%5B1%5D=Stronger&i%5B1%5D=1700000320&l%5B1%5D=&b%5B1%5D=",
+			want: []Scrobble{
+				{Artist: "Daft Punk", SongName: "One More Time", Album: "Discovery",
+					Timestamp: time.Unix(1700000000, 0).UTC(), MsPlayed: 320000},
+				{Artist: "Kanye West", SongName: "Stronger",
+					Timestamp: time.Unix(1700000320, 0).UTC()},
+			},
+		},
+		{
+			name: "2.0 track.scrobble",
+			payload: "method=track.scrobble&api_key=0123456789abcdef&sk=0123456789abcdef" +
+				"&artist%5B0%5D=Kendrick+Lamar&track%5B0%5D=Money+Trees&album%5B0%5D=good+kid%2C+m.A.A.d+city" +
+				"&albumArtist%5B0%5D=Kendrick+Lamar&timestamp%5B0%5D=1700000000&duration%5B0%5D=386" +
+				"&artist%5B1%5D=Lil+Wayne&track%5B1%5D=Mona+Lisa&album%5B1%5D=Tha+Carter+V" +
+				"&albumArtist%5B1%5D=Various+Artists&timestamp%5B1%5D=1700000400" +
+				"&api_sig=0123456789abcdef0123456789abcdef",
+			want: []Scrobble{
+				{Artist: "Kendrick Lamar", SongName: "Money Trees", Album: "good kid, m.A.A.d city",
+					AlbumArtist: "Kendrick Lamar", Timestamp: time.Unix(1700000000, 0).UTC(), MsPlayed: 386000},
+				{Artist: "Lil Wayne", SongName: "Mona Lisa", Album: "Tha Carter V",
+					AlbumArtist: "Various Artists", Timestamp: time.Unix(1700000400, 0).UTC()},
+			},
+		},
+		{
+			name:    "no scrobbles",
+			payload: "method=track.scrobble&sk=0123456789abcdef&artist%5B0%5D=Daft+Punk",
+			want:    nil,
+		},
+	}
+
+	h := NewLastFMHandler()
+	for _, tt := range tests {
+		form, err := url.ParseQuery(tt.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for i := range tt.want {
+			tt.want[i].UserId = 1
+			tt.want[i].Platform = "lastfm_api"
+			tt.want[i].Client = "test"
+		}
+		got := h.parseScrobbles(form, 1, "test")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseScrobbles() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
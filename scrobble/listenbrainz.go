@@ -35,7 +35,44 @@ type TrackMetadata struct {
 }
 
 type AdditionalInfo struct {
-	Duration int `json:"duration"`
+	Duration                int    `json:"duration"`
+	SubmissionClient        string `json:"submission_client"`
+	SubmissionClientVersion string `json:"submission_client_version"`
+	MediaPlayer             string `json:"media_player"`
+	MediaPlayerVersion      string `json:"media_player_version"`
+	ReleaseArtistName       string `json:"release_artist_name"`
+	AlbumArtist             string `json:"albumartist"`
+}
+
+// The artist the release is credited to, which clients send under either
+// name
+func (info AdditionalInfo) albumArtist() string {
+	if info.ReleaseArtistName != "" {
+		return info.ReleaseArtistName
+	}
+	return info.AlbumArtist
+}
+
+// Describes the player and the scrobbler that submitted a listen,
+// e.g. "Feishin 0.12 via Navidrome 0.53"
+func (info AdditionalInfo) client() string {
+	player := withVersion(info.MediaPlayer, info.MediaPlayerVersion)
+	submitter := withVersion(info.SubmissionClient, info.SubmissionClientVersion)
+	switch {
+	case player != "" && submitter != "" && player != submitter:
+		return player + " via " + submitter
+	case player != "":
+		return player
+	default:
+		return submitter
+	}
+}
+
+func withVersion(name, version string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.TrimSpace(name + " " + version)
 }
 
 func (h *ListenbrainzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -117,13 +154,15 @@ func (h *ListenbrainzHandler) handleScrobbles(w http.ResponseWriter, userId int,
 		}
 
 		scrobbles = append(scrobbles, Scrobble{
-			UserId:    userId,
-			Timestamp: time.Unix(p.ListenedAt, 0).UTC(),
-			SongName:  p.TrackMetadata.TrackName,
-			Artist:    p.TrackMetadata.ArtistName,
-			Album:     p.TrackMetadata.ReleaseName,
-			MsPlayed:  duration,
-			Platform:  "listenbrainz",
+			UserId:      userId,
+			Timestamp:   time.Unix(p.ListenedAt, 0).UTC(),
+			SongName:    p.TrackMetadata.TrackName,
+			Artist:      p.TrackMetadata.ArtistName,
+			Album:       p.TrackMetadata.ReleaseName,
+			AlbumArtist: p.TrackMetadata.AdditionalInfo.albumArtist(),
+			MsPlayed:    duration,
+			Platform:    "listenbrainz",
+			Client:      p.TrackMetadata.AdditionalInfo.client(),
 		})
 	}
 
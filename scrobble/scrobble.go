@@ -6,9 +6,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
-	"strings"
 	"time"
 
+	"muzi/credits"
 	"muzi/db"
 
 	"github.com/jackc/pgtype"
@@ -22,9 +22,15 @@ type Scrobble struct {
 	SongName  string
 	Artist    string
 	Album     string
-	MsPlayed  int
-	Platform  string
-	Source    string
+	// Who the album is credited to when the source reports it, e.g.
+	// "Various Artists" for a compilation
+	AlbumArtist string
+	MsPlayed    int
+	Platform    string
+	Client      string
+	Source      string
+	Skipped     bool
+	ReasonEnd   string
 }
 
 type NowPlaying struct {
@@ -111,6 +117,27 @@ func GetUserBySessionKey(sessionKey string) (int, string, error) {
 }
 
 func SaveScrobble(scrobble Scrobble) error {
+	rules, err := db.GetRuleSet(scrobble.UserId)
+	if err != nil {
+		return err
+	}
+	scrobble.Artist, scrobble.SongName, scrobble.Album = rules.Rewrite(scrobble.Artist, scrobble.SongName, scrobble.Album)
+	if scrobble.AlbumArtist != "" {
+		scrobble.AlbumArtist, _, _ = rules.Rewrite(scrobble.AlbumArtist, "", "")
+	}
+	parser, err := db.GetCreditParser(scrobble.UserId)
+	if err != nil {
+		return err
+	}
+	aliases, err := db.GetArtistAliases(scrobble.UserId)
+	if err != nil {
+		return err
+	}
+	scrobble.Artist = aliases.Canonical(parser, scrobble.Artist)
+	if scrobble.AlbumArtist != "" {
+		scrobble.AlbumArtist = aliases.Canonical(parser, scrobble.AlbumArtist)
+	}
+
 	exists, err := checkDuplicate(scrobble.UserId, scrobble.Artist, scrobble.SongName, scrobble.Timestamp)
 	if err != nil {
 		return err
@@ -119,7 +146,7 @@ func SaveScrobble(scrobble Scrobble) error {
 		return fmt.Errorf("duplicate scrobble")
 	}
 
-	artistNames := parseArtistString(scrobble.Artist)
+	artistNames := parser.Credits(scrobble.Artist, scrobble.SongName)
 	artistIds, err := getOrCreateArtists(scrobble.UserId, artistNames)
 	if err != nil {
 		return err
@@ -132,7 +159,11 @@ func SaveScrobble(scrobble Scrobble) error {
 
 	var albumId int
 	if scrobble.Album != "" {
-		albumId, _, err = db.GetOrCreateAlbum(scrobble.UserId, scrobble.Album, primaryArtistId)
+		albumArtistId, err := getAlbumArtistId(scrobble, parser, primaryArtistId)
+		if err != nil {
+			return err
+		}
+		albumId, _, err = db.GetOrCreateAlbum(scrobble.UserId, scrobble.Album, albumArtistId)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error getting/creating album: %v\n", err)
 			return err
@@ -145,12 +176,22 @@ func SaveScrobble(scrobble Scrobble) error {
 		return err
 	}
 
-	_, err = db.Pool.Exec(context.Background(),
-		`INSERT INTO history (user_id, timestamp, song_name, artist, album_name, ms_played, platform, artist_id, song_id, artist_ids)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		ON CONFLICT (user_id, song_name, artist, timestamp) DO NOTHING`,
-		scrobble.UserId, scrobble.Timestamp, scrobble.SongName, scrobble.Artist,
-		scrobble.Album, scrobble.MsPlayed, scrobble.Platform, primaryArtistId, songId, artistIds)
+	_, err = db.InsertScrobble(db.NewScrobble{
+		UserId:      scrobble.UserId,
+		Timestamp:   scrobble.Timestamp,
+		SongName:    scrobble.SongName,
+		Artist:      scrobble.Artist,
+		Album:       scrobble.Album,
+		AlbumArtist: scrobble.AlbumArtist,
+		MsPlayed:    scrobble.MsPlayed,
+		Platform:    scrobble.Platform,
+		Client:      scrobble.Client,
+		Skipped:     scrobble.Skipped,
+		ReasonEnd:   scrobble.ReasonEnd,
+		ArtistId:    primaryArtistId,
+		SongId:      songId,
+		ArtistIds:   artistIds,
+	}, DuplicateToleranceSeconds*time.Second)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error saving scrobble: %v\n", err)
 		return err
@@ -158,18 +199,16 @@ func SaveScrobble(scrobble Scrobble) error {
 	return nil
 }
 
-func parseArtistString(artist string) []string {
-	if artist == "" {
-		return nil
-	}
-	var artists []string
-	for _, a := range strings.Split(artist, ",") {
-		a = strings.TrimSpace(a)
-		if a != "" {
-			artists = append(artists, a)
-		}
+// Albums belong to their album artist, or the primary track artist when
+// the scrobble has none. A compilation then stays one album instead of
+// one for every artist on it.
+func getAlbumArtistId(scrobble Scrobble, parser *credits.Parser, primaryArtistId int) (int, error) {
+	id, err := db.GetAlbumArtistId(scrobble.UserId, parser, scrobble.AlbumArtist, scrobble.Artist, primaryArtistId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting/creating album artist: %v\n", err)
+		return 0, err
 	}
-	return artists
+	return id, nil
 }
 
 func getOrCreateArtists(userId int, artistNames []string) ([]int, error) {
@@ -226,6 +265,7 @@ func checkDuplicate(userId int, artist, songName string, timestamp time.Time) (b
 			AND artist = $2 
 			AND song_name = $3 
 			AND ABS(EXTRACT(EPOCH FROM (timestamp - $4))) < $5
+			AND deleted_at IS NULL
 		)`,
 		userId, artist, songName, timestamp, DuplicateToleranceSeconds).Scan(&exists)
 	if err != nil {
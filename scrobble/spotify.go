@@ -19,6 +19,10 @@ const SpotifyTokenURL = "https://accounts.spotify.com/api/token"
 const SpotifyAuthURL = "https://accounts.spotify.com/authorize"
 const SpotifyAPIURL = "https://api.spotify.com/v1"
 
+// Plays shorter than this are dropped, like the export import does unless
+// asked to keep skips
+const minPlayTime = 20000 // 20000 ms = 20 sec
+
 var (
 	spotifyClient = &http.Client{Timeout: 30 * time.Second}
 	spotifyMu     sync.Mutex
@@ -59,7 +63,8 @@ type SpotifyArtist struct {
 }
 
 type SpotifyAlbum struct {
-	Name string `json:"name"`
+	Name    string          `json:"name"`
+	Artists []SpotifyArtist `json:"artists"`
 }
 
 type SpotifyRecentPlays struct {
@@ -375,13 +380,14 @@ func checkRecentPlays(userId int, accessToken string) error {
 		}
 
 		scrobbles = append(scrobbles, Scrobble{
-			UserId:    userId,
-			Timestamp: ts,
-			SongName:  item.Track.Name,
-			Artist:    artistName,
-			Album:     item.Track.Album.Name,
-			MsPlayed:  item.Track.DurationMs,
-			Platform:  "spotify",
+			UserId:      userId,
+			Timestamp:   ts,
+			SongName:    item.Track.Name,
+			Artist:      artistName,
+			Album:       item.Track.Album.Name,
+			AlbumArtist: getArtistName(item.Track.Album.Artists),
+			MsPlayed:    item.Track.DurationMs,
+			Platform:    "spotify",
 		})
 	}
 
@@ -418,36 +424,37 @@ func GetSpotifyAuthURL(userId int, baseURL string) (string, error) {
 }
 
 type LastTrack struct {
-	UserId     int
-	TrackId    string
-	SongName   string
-	Artist     string
-	AlbumName  string
-	DurationMs int
-	ProgressMs int
-	UpdatedAt  time.Time
+	UserId      int
+	TrackId     string
+	SongName    string
+	Artist      string
+	AlbumName   string
+	AlbumArtist string
+	DurationMs  int
+	ProgressMs  int
+	UpdatedAt   time.Time
 }
 
 func GetLastTrack(userId int) (*LastTrack, error) {
 	var track LastTrack
 	err := db.Pool.QueryRow(context.Background(),
-		`SELECT user_id, track_id, song_name, artist, album_name, duration_ms, progress_ms, updated_at
+		`SELECT user_id, track_id, song_name, artist, album_name, COALESCE(album_artist, ''), duration_ms, progress_ms, updated_at
 		 FROM spotify_last_track WHERE user_id = $1`,
 		userId).Scan(&track.UserId, &track.TrackId, &track.SongName, &track.Artist,
-		&track.AlbumName, &track.DurationMs, &track.ProgressMs, &track.UpdatedAt)
+		&track.AlbumName, &track.AlbumArtist, &track.DurationMs, &track.ProgressMs, &track.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return &track, nil
 }
 
-func SetLastTrack(userId int, trackId, songName, artist, albumName string, durationMs, progressMs int) error {
+func SetLastTrack(userId int, trackId, songName, artist, albumName, albumArtist string, durationMs, progressMs int) error {
 	_, err := db.Pool.Exec(context.Background(),
-		`INSERT INTO spotify_last_track (user_id, track_id, song_name, artist, album_name, duration_ms, progress_ms, updated_at)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		`INSERT INTO spotify_last_track (user_id, track_id, song_name, artist, album_name, album_artist, duration_ms, progress_ms, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
 		 ON CONFLICT (user_id) DO UPDATE SET
-			track_id = $2, song_name = $3, artist = $4, album_name = $5, duration_ms = $6, progress_ms = $7, updated_at = NOW()`,
-		userId, trackId, songName, artist, albumName, durationMs, progressMs)
+			track_id = $2, song_name = $3, artist = $4, album_name = $5, album_artist = $6, duration_ms = $7, progress_ms = $8, updated_at = NOW()`,
+		userId, trackId, songName, artist, albumName, albumArtist, durationMs, progressMs)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error saving last track: %v\n", err)
 		return err
@@ -464,7 +471,8 @@ func checkAndScrobbleHalfway(userId int, currentTrack *SpotifyTrack, progressMs
 	if err != nil {
 		if err.Error() == "no rows in result set" {
 			SetLastTrack(userId, currentTrack.Id, currentTrack.Name,
-				getArtistName(currentTrack.Artists), currentTrack.Album.Name, currentTrack.DurationMs, progressMs)
+				getArtistName(currentTrack.Artists), currentTrack.Album.Name, getArtistName(currentTrack.Album.Artists),
+				currentTrack.DurationMs, progressMs)
 		}
 		return
 	}
@@ -472,29 +480,37 @@ func checkAndScrobbleHalfway(userId int, currentTrack *SpotifyTrack, progressMs
 	if lastTrack.TrackId != currentTrack.Id {
 		if lastTrack.DurationMs > 0 {
 			percentagePlayed := float64(lastTrack.ProgressMs) / float64(lastTrack.DurationMs)
-			if percentagePlayed >= 0.5 || lastTrack.ProgressMs >= 240000 {
-				msPlayed := lastTrack.ProgressMs
-				if msPlayed > lastTrack.DurationMs {
-					msPlayed = lastTrack.DurationMs
-				}
-				scrobble := Scrobble{
-					UserId:    userId,
-					Timestamp: lastTrack.UpdatedAt,
-					SongName:  lastTrack.SongName,
-					Artist:    lastTrack.Artist,
-					Album:     lastTrack.AlbumName,
-					MsPlayed:  msPlayed,
-					Platform:  "spotify",
-				}
+			msPlayed := lastTrack.ProgressMs
+			if msPlayed > lastTrack.DurationMs {
+				msPlayed = lastTrack.DurationMs
+			}
+			scrobble := Scrobble{
+				UserId:      userId,
+				Timestamp:   lastTrack.UpdatedAt,
+				SongName:    lastTrack.SongName,
+				Artist:      lastTrack.Artist,
+				Album:       lastTrack.AlbumName,
+				AlbumArtist: lastTrack.AlbumArtist,
+				MsPlayed:    msPlayed,
+				Platform:    "spotify",
+			}
+			// Plays that changed track before the scrobble threshold are
+			// kept as skips, unless they were too short to count at all
+			if percentagePlayed < 0.5 && lastTrack.ProgressMs < 240000 {
+				scrobble.Skipped = true
+			}
+			if msPlayed >= minPlayTime {
 				SaveScrobble(scrobble)
 			}
 		}
 
 		SetLastTrack(userId, currentTrack.Id, currentTrack.Name,
-			getArtistName(currentTrack.Artists), currentTrack.Album.Name, currentTrack.DurationMs, progressMs)
+			getArtistName(currentTrack.Artists), currentTrack.Album.Name, getArtistName(currentTrack.Album.Artists),
+			currentTrack.DurationMs, progressMs)
 	} else {
 		SetLastTrack(userId, currentTrack.Id, currentTrack.Name,
-			getArtistName(currentTrack.Artists), currentTrack.Album.Name, currentTrack.DurationMs, progressMs)
+			getArtistName(currentTrack.Artists), currentTrack.Album.Name, getArtistName(currentTrack.Album.Artists),
+			currentTrack.DurationMs, progressMs)
 	}
 }
 
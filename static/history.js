@@ -0,0 +1,52 @@
+// Loads the next page of history into the table when the "Load More" link
+// scrolls into view. The link still works as a plain next page link.
+const historyNext = document.getElementById('history-next');
+let historyObserver = null;
+
+async function loadMoreHistory() {
+    if (!historyNext || historyNext.dataset.loading) {
+        return;
+    }
+    historyNext.dataset.loading = 'true';
+
+    try {
+        const resp = await fetch(historyNext.href);
+        if (!resp.ok) {
+            return;
+        }
+        const page = new DOMParser().parseFromString(await resp.text(), 'text/html');
+        const rows = document.getElementById('history-rows');
+        for (const row of page.querySelectorAll('#history-rows tr')) {
+            rows.appendChild(row);
+        }
+
+        const next = page.getElementById('history-next');
+        if (next) {
+            historyNext.href = next.getAttribute('href');
+            // Observing again fires right away if the link is still visible
+            historyObserver?.unobserve(historyNext);
+            historyObserver?.observe(historyNext);
+        } else {
+            historyNext.remove();
+        }
+    } finally {
+        delete historyNext.dataset.loading;
+    }
+}
+
+if (historyNext && 'IntersectionObserver' in window) {
+    historyObserver = new IntersectionObserver(entries => {
+        if (entries.some(e => e.isIntersecting)) {
+            loadMoreHistory();
+        }
+    });
+    historyObserver.observe(historyNext);
+}
+
+// Checks or clears every loaded row for the batch editor
+const historySelectAll = document.getElementById('history-select-all');
+historySelectAll?.addEventListener('change', () => {
+    for (const box of document.querySelectorAll('#history-rows input[name="id"]')) {
+        box.checked = historySelectAll.checked;
+    }
+});
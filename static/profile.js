@@ -131,3 +131,30 @@ document.addEventListener('DOMContentLoaded', function() {
     
     updateTopAlbumsLimitOptions();
 });
+
+function updateTag() {
+    const tag = document.getElementById('tag-select').value;
+
+    const params = new URLSearchParams(window.location.search);
+    if (tag) {
+        params.set('tag', tag);
+    } else {
+        params.delete('tag');
+    }
+
+    window.location.search = params.toString();
+}
+
+function updatePlatform() {
+    const platform = document.getElementById('platform-select').value;
+
+    const params = new URLSearchParams(window.location.search);
+    if (platform) {
+        params.set('platform', platform);
+    } else {
+        params.delete('platform');
+    }
+    params.delete('page');
+
+    window.location.search = params.toString();
+}
@@ -0,0 +1,88 @@
+package web
+
+// Functions used for managing the alternate names of artists, albums and
+// songs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Aliases shown on an artist, album or song page
+type AliasList struct {
+	EntityType string
+	// Base URL of the alias forms, e.g. /profile/name/artist/1/aliases
+	Action  string
+	CanEdit bool
+	Aliases []db.Alias
+}
+
+func loadAliasList(r *http.Request, username string, entityType string, entityId int) AliasList {
+	aliases, err := db.GetAliases(entityType, entityId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get %s aliases: %v\n", entityType, err)
+	}
+	return AliasList{
+		EntityType: entityType,
+		Action:     "/profile/" + username + "/" + entityType + "/" + strconv.Itoa(entityId) + "/aliases",
+		CanEdit:    getLoggedInUsername(r) == username,
+		Aliases:    aliases,
+	}
+}
+
+// Adds the alias in the form, merging in anything already named like it
+func addAliasHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, userId, ok := getOwnEntity(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimSpace(r.FormValue("alias"))
+		if name != "" {
+			_, err := db.AddAlias(userId, entityType, e.Id, name)
+			if errors.Is(err, db.ErrEditConflict) {
+				http.Error(w, "Cannot add alias, merging "+name+" into "+e.Name+" would duplicate a scrobble", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding %s alias: %v\n", entityType, err)
+				http.Error(w, "Error adding alias", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		http.Redirect(w, r, e.Path, http.StatusSeeOther)
+	}
+}
+
+func deleteAliasHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, userId, ok := getOwnEntity(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "alias"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		err = db.DeleteAlias(userId, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error deleting %s alias: %v\n", entityType, err)
+			http.Error(w, "Error deleting alias", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, e.Path, http.StatusSeeOther)
+	}
+}
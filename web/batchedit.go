@@ -0,0 +1,181 @@
+package web
+
+// Functions used for editing a selection of history rows at once
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Changed rows listed on the preview page, the rest are only counted
+const historyEditPreviewRows = 100
+
+type HistoryEditData struct {
+	Username string
+	// Filters of the history page the edit started from
+	Query string
+	// "selected" for the rows in Ids, "filter" for every row matching Query
+	Scope     string
+	Ids       []int
+	NewArtist string
+	NewTitle  string
+	NewAlbum  string
+	Selected  int
+	Count     int
+	Changes   []db.HistoryEditChange
+	// Changed rows left out of Changes
+	More             int
+	Message          string
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// Reads the edit and its selection from the form. Writes an error and
+// returns false when the user can't edit this history or the form is
+// invalid.
+func parseHistoryEdit(w http.ResponseWriter, r *http.Request) (HistoryEditData, db.HistoryEdit, int, bool) {
+	username := chi.URLParam(r, "username")
+	loggedIn := getLoggedInUsername(r)
+	if loggedIn == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return HistoryEditData{}, db.HistoryEdit{}, 0, false
+	}
+	if loggedIn != username {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return HistoryEditData{}, db.HistoryEdit{}, 0, false
+	}
+	userId, err := getUserIdByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return HistoryEditData{}, db.HistoryEdit{}, 0, false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return HistoryEditData{}, db.HistoryEdit{}, 0, false
+	}
+
+	d := HistoryEditData{
+		Username:         username,
+		Query:            r.FormValue("filter"),
+		Scope:            r.FormValue("scope"),
+		NewArtist:        strings.TrimSpace(r.FormValue("new_artist")),
+		NewTitle:         strings.TrimSpace(r.FormValue("new_title")),
+		NewAlbum:         strings.TrimSpace(r.FormValue("new_album")),
+		Title:            "Edit Scrobbles",
+		LoggedInUsername: loggedIn,
+		TemplateName:     "history_edit",
+	}
+	edit := db.HistoryEdit{
+		Artist:   d.NewArtist,
+		SongName: d.NewTitle,
+		Album:    d.NewAlbum,
+	}
+
+	switch d.Scope {
+	case "filter":
+		// The rows are looked up again from the filters, so the edit covers
+		// every page and not only the one that was loaded
+		filtered := r.Clone(r.Context())
+		filtered.URL.RawQuery = d.Query
+		hd, f, ok := historyFilter(filtered, userId)
+		if !ok {
+			d.Message = hd.Message
+			return d, edit, userId, true
+		}
+		f.Cursor, f.Limit = nil, 0
+		d.Ids, err = db.GetHistoryIds(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get history ids: %v\n", err)
+			http.Error(w, "Error getting history", http.StatusInternalServerError)
+			return d, edit, userId, false
+		}
+	default:
+		d.Scope = "selected"
+		for _, v := range r.Form["id"] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid ID", http.StatusBadRequest)
+				return d, edit, userId, false
+			}
+			d.Ids = append(d.Ids, id)
+		}
+	}
+	d.Selected = len(d.Ids)
+
+	switch {
+	case edit.IsEmpty():
+		d.Message = "Enter a new artist, title or album."
+	case d.Selected == 0:
+		d.Message = "No scrobbles selected."
+	}
+	return d, edit, userId, true
+}
+
+func historyEditPreviewHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, edit, userId, ok := parseHistoryEdit(w, r)
+		if !ok {
+			return
+		}
+
+		if data.Message == "" {
+			changes, err := db.PreviewHistoryEdit(userId, data.Ids, edit)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot preview history edit: %v\n", err)
+				http.Error(w, "Error previewing edit", http.StatusInternalServerError)
+				return
+			}
+			data.Count = len(changes)
+			if len(changes) > historyEditPreviewRows {
+				data.More = len(changes) - historyEditPreviewRows
+				changes = changes[:historyEditPreviewRows]
+			}
+			data.Changes = changes
+		}
+
+		err := templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func historyEditApplyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, edit, userId, ok := parseHistoryEdit(w, r)
+		if !ok {
+			return
+		}
+
+		if data.Message == "" {
+			edited, err := db.ApplyHistoryEdit(userId, data.Ids, edit)
+			if err == nil {
+				back, _ := url.ParseQuery(data.Query)
+				back.Set("edited", strconv.Itoa(edited))
+				http.Redirect(w, r, "/profile/"+data.Username+"/history?"+back.Encode(), http.StatusSeeOther)
+				return
+			}
+			if !errors.Is(err, db.ErrEditConflict) {
+				fmt.Fprintf(os.Stderr, "Cannot apply history edit: %v\n", err)
+				http.Error(w, "Error applying edit", http.StatusInternalServerError)
+				return
+			}
+			data.Message = "Nothing was changed, " + err.Error() + "."
+		}
+
+		err := templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package web
+
+// Functions used for listing a user's recent edits and deletes and undoing
+// them
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+type ChangesData struct {
+	Username string
+	Changes  []db.Change
+	Message  string
+	// Id of the change last undone, to confirm it
+	Undone           int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+func renderChanges(w http.ResponseWriter, username string, userId int, data ChangesData) {
+	data.Username = username
+	data.Title = "muzi | Changes"
+	data.LoggedInUsername = username
+	data.TemplateName = "changes"
+
+	var err error
+	data.Changes, err = db.GetChanges(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get changes: %v\n", err)
+		http.Error(w, "Error getting changes", http.StatusInternalServerError)
+		return
+	}
+
+	err = templates.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func changesPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+		undone, _ := strconv.Atoi(r.URL.Query().Get("undone"))
+		renderChanges(w, username, userId, ChangesData{Undone: undone})
+	}
+}
+
+func undoChangeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		err = db.UndoChange(userId, id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Change not found", http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			http.Redirect(w, r, "/profile/"+username+"/changes?undone="+strconv.Itoa(id), http.StatusSeeOther)
+			return
+		}
+		if !errors.Is(err, db.ErrChangeUndone) && !errors.Is(err, db.ErrChangedSince) &&
+			!errors.Is(err, db.ErrEditConflict) {
+			fmt.Fprintf(os.Stderr, "Cannot undo change: %v\n", err)
+			http.Error(w, "Error undoing change", http.StatusInternalServerError)
+			return
+		}
+		renderChanges(w, username, userId, ChangesData{Message: "Nothing was changed, " + err.Error() + "."})
+	}
+}
@@ -0,0 +1,189 @@
+package web
+
+// Functions used for removing scrobbles of the same play recorded by more
+// than one platform
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultCleanupWindow     = 300
+	defaultCleanupSimilarity = 60
+	// Conflicts listed on the page, the rest are only counted
+	cleanupPreviewRows = 200
+)
+
+type ScrobbleCleanupData struct {
+	Username string
+	// Seconds between two scrobbles of the same play
+	Window int
+	// Percent similarity of the titles
+	Similarity int
+	Preferred  string
+	Platforms  []db.PlatformStat
+	Count      int
+	Conflicts  []db.ScrobbleConflict
+	// Conflicts left out of Conflicts
+	More     int
+	Cleanups []db.ScrobbleCleanup
+	// Set after a cleanup or undo, to confirm it
+	Removed          int
+	Restored         int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// Reads the cleanup options from the query or form, with defaults for
+// anything missing or out of range
+func parseCleanupOptions(r *http.Request) (ScrobbleCleanupData, db.ScrobbleCleanupOptions) {
+	d := ScrobbleCleanupData{
+		Window:     defaultCleanupWindow,
+		Similarity: defaultCleanupSimilarity,
+		Preferred:  r.FormValue("preferred"),
+	}
+	if v, err := strconv.Atoi(r.FormValue("window")); err == nil && v > 0 && v <= 3600 {
+		d.Window = v
+	}
+	if v, err := strconv.Atoi(r.FormValue("similarity")); err == nil && v > 0 && v <= 100 {
+		d.Similarity = v
+	}
+	return d, db.ScrobbleCleanupOptions{
+		Window:     time.Duration(d.Window) * time.Second,
+		Similarity: float64(d.Similarity) / 100,
+		Preferred:  d.Preferred,
+	}
+}
+
+func cleanupQuery(d ScrobbleCleanupData) string {
+	q := url.Values{}
+	q.Set("window", strconv.Itoa(d.Window))
+	q.Set("similarity", strconv.Itoa(d.Similarity))
+	q.Set("preferred", d.Preferred)
+	return q.Encode()
+}
+
+func scrobbleCleanupPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		data, options := parseCleanupOptions(r)
+		data.Username = username
+		data.Removed, _ = strconv.Atoi(r.URL.Query().Get("removed"))
+		data.Restored, _ = strconv.Atoi(r.URL.Query().Get("restored"))
+		data.Title = "muzi | Duplicate Scrobbles"
+		data.LoggedInUsername = username
+		data.TemplateName = "scrobble_cleanup"
+
+		var err error
+		data.Platforms, err = db.GetPlatformBreakdown(db.Filter{UserId: userId})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get platforms: %v\n", err)
+		}
+		data.Cleanups, err = db.GetScrobbleCleanups(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get scrobble cleanups: %v\n", err)
+		}
+
+		conflicts, err := db.FindScrobbleConflicts(userId, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find duplicate scrobbles: %v\n", err)
+			http.Error(w, "Error finding duplicate scrobbles", http.StatusInternalServerError)
+			return
+		}
+		data.Count = len(conflicts)
+		if len(conflicts) > cleanupPreviewRows {
+			data.More = len(conflicts) - cleanupPreviewRows
+			conflicts = conflicts[:cleanupPreviewRows]
+		}
+		data.Conflicts = conflicts
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Removes every conflict the options find, keeping them to undo
+func removeScrobbleConflictsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		data, options := parseCleanupOptions(r)
+		removed, err := db.RemoveScrobbleConflicts(userId, options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot remove duplicate scrobbles: %v\n", err)
+			http.Error(w, "Error removing duplicate scrobbles", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/duplicates/scrobbles?"+cleanupQuery(data)+
+			"&removed="+strconv.Itoa(removed), http.StatusSeeOther)
+	}
+}
+
+func undoScrobbleCleanupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		restored, err := db.UndoScrobbleCleanup(userId, id)
+		if errors.Is(err, db.ErrChangeUndone) || errors.Is(err, db.ErrChangedSince) {
+			http.Error(w, "Cannot undo cleanup, "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot undo scrobble cleanup: %v\n", err)
+			http.Error(w, "Error undoing cleanup", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/duplicates/scrobbles?restored="+strconv.Itoa(restored), http.StatusSeeOther)
+	}
+}
+
+// Deletes the scrobbles of a cleanup for good
+func purgeScrobbleCleanupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		err = db.PurgeScrobbleCleanup(userId, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot purge scrobble cleanup: %v\n", err)
+			http.Error(w, "Error purging cleanup", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/duplicates/scrobbles", http.StatusSeeOther)
+	}
+}
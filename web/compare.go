@@ -0,0 +1,74 @@
+package web
+
+// Functions used for comparing the listening of two users
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type CompareData struct {
+	UserA            string
+	UserB            string
+	Period           string
+	Start            string
+	End              string
+	Comparison       db.Comparison
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+func comparePageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userA := chi.URLParam(r, "userA")
+		userB := chi.URLParam(r, "userB")
+
+		userAId, err := getUserIdByUsername(r.Context(), userA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", userA, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		userBId, err := getUserIdByUsername(r.Context(), userB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", userB, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "all_time"
+		}
+
+		data := CompareData{
+			UserA:            userA,
+			UserB:            userB,
+			Period:           period,
+			Start:            r.URL.Query().Get("start"),
+			End:              r.URL.Query().Get("end"),
+			Title:            userA + " vs " + userB,
+			LoggedInUsername: getLoggedInUsername(r),
+			TemplateName:     "compare",
+		}
+
+		startDate, endDate := getPeriodRange(period, data.Start, data.End)
+		data.Comparison, err = db.CompareUsers(userAId, userBId, db.Filter{Start: startDate, End: endDate}, 20)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot compare %s and %s: %v\n", userA, userB, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
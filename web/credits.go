@@ -0,0 +1,122 @@
+package web
+
+// Functions used for managing the artist names that are never split into
+// several credits, and for crediting the existing history again
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type CreditsPreviewData struct {
+	Username string
+	// Scrobbles changed across all the changed artists and titles
+	Scrobbles        int
+	Count            int
+	Changes          []db.CreditChange
+	More             int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+func addCreditExceptionHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	err := db.AddCreditException(userId, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding credit exception: %v\n", err)
+		http.Error(w, "Error adding exception", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=rules", http.StatusSeeOther)
+}
+
+func deleteCreditExceptionHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	err = db.DeleteCreditException(userId, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error deleting credit exception: %v\n", err)
+		http.Error(w, "Error deleting exception", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=rules", http.StatusSeeOther)
+}
+
+// Shows which artists and titles would be credited differently
+func previewCreditsHandler(w http.ResponseWriter, r *http.Request) {
+	username, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	changes, err := db.PreviewCreditReparse(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot preview credit re-parse: %v\n", err)
+		http.Error(w, "Error previewing credits", http.StatusInternalServerError)
+		return
+	}
+
+	data := CreditsPreviewData{
+		Username:         username,
+		Count:            len(changes),
+		Title:            "muzi | Artist Credits",
+		LoggedInUsername: username,
+		TemplateName:     "credits_preview",
+	}
+	for _, c := range changes {
+		data.Scrobbles += c.Scrobbles
+	}
+	if len(changes) > historyEditPreviewRows {
+		data.More = len(changes) - historyEditPreviewRows
+		changes = changes[:historyEditPreviewRows]
+	}
+	data.Changes = changes
+
+	err = templates.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func applyCreditsHandler(w http.ResponseWriter, r *http.Request) {
+	username, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	edited, err := db.ApplyCreditReparse(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot re-parse credits: %v\n", err)
+		http.Error(w, "Error re-parsing credits", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/profile/"+username+"/history?edited="+strconv.Itoa(edited), http.StatusSeeOther)
+}
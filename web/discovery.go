@@ -0,0 +1,119 @@
+package web
+
+// Functions used for the discoveries page
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type DiscoveryData struct {
+	Username         string
+	Period           string
+	Start            string
+	End              string
+	Interval         string
+	NewArtists       []db.DiscoveredArtist
+	NewTracks        []db.DiscoveredTrack
+	Rate             []db.DiscoveryPoint
+	MaxRate          int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// Converts a period preset into a start and end time. Presets start at
+// midnight so the daily rollups can count them. Custom periods use the
+// given YYYY-MM-DD dates, with the end date being inclusive.
+func getPeriodRange(period, startStr, endStr string) (*time.Time, *time.Time) {
+	var startDate, endDate *time.Time
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch period {
+	case "week":
+		start := today.AddDate(0, 0, -7)
+		startDate = &start
+	case "month":
+		start := today.AddDate(0, -1, 0)
+		startDate = &start
+	case "year":
+		start := today.AddDate(-1, 0, 0)
+		startDate = &start
+	case "custom":
+		if startStr != "" {
+			if t, err := time.Parse("2006-01-02", startStr); err == nil {
+				startDate = &t
+			}
+		}
+		if endStr != "" {
+			if t, err := time.Parse("2006-01-02", endStr); err == nil {
+				t = t.AddDate(0, 0, 1)
+				endDate = &t
+			}
+		}
+	}
+	return startDate, endDate
+}
+
+func discoveriesPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", username, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "month"
+		}
+		interval := r.URL.Query().Get("interval")
+		if interval != "week" && interval != "year" {
+			interval = "month"
+		}
+
+		data := DiscoveryData{
+			Username:         username,
+			Period:           period,
+			Start:            r.URL.Query().Get("start"),
+			End:              r.URL.Query().Get("end"),
+			Interval:         interval,
+			Title:            username + "'s Discoveries",
+			LoggedInUsername: getLoggedInUsername(r),
+			TemplateName:     "discoveries",
+		}
+
+		startDate, endDate := getPeriodRange(period, data.Start, data.End)
+
+		data.NewArtists, err = db.GetNewArtists(userId, 30, startDate, endDate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get new artists: %v\n", err)
+		}
+
+		data.NewTracks, err = db.GetNewTracks(userId, 30, startDate, endDate)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get new tracks: %v\n", err)
+		}
+
+		data.Rate, err = db.GetDiscoveryRate(userId, interval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get discovery rate: %v\n", err)
+		}
+		for _, p := range data.Rate {
+			data.MaxRate = max(data.MaxRate, p.NewArtists, p.NewTracks)
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package web
+
+// Functions used for the listening diversity page
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type DiversityData struct {
+	Username         string
+	Period           string
+	Start            string
+	End              string
+	Interval         string
+	Overall          db.Diversity
+	Mainstream       int
+	GlobalUsers      int
+	Trend            []db.Diversity
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+func diversityPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", username, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "year"
+		}
+		interval := r.URL.Query().Get("interval")
+		if interval != "week" && interval != "year" {
+			interval = "month"
+		}
+
+		data := DiversityData{
+			Username:         username,
+			Period:           period,
+			Start:            r.URL.Query().Get("start"),
+			End:              r.URL.Query().Get("end"),
+			Interval:         interval,
+			Title:            username + "'s Listening Diversity",
+			LoggedInUsername: getLoggedInUsername(r),
+			TemplateName:     "diversity",
+		}
+
+		startDate, endDate := getPeriodRange(period, data.Start, data.End)
+		f := db.Filter{UserId: userId, Start: startDate, End: endDate, Platforms: parsePlatforms(r)}
+
+		data.Overall, err = db.GetDiversity(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get diversity: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		data.Mainstream, data.GlobalUsers, err = db.GetMainstreamShare(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get mainstream share: %v\n", err)
+		}
+
+		data.Trend, err = db.GetDiversityTrend(f, interval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get diversity trend: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
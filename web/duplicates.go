@@ -0,0 +1,187 @@
+package web
+
+// Functions used for the data quality page, listing likely duplicate
+// artists, albums and songs to merge or dismiss
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Pairs listed for each entity type
+const duplicatePairLimit = 50
+
+// Likely duplicates of one entity type
+type DuplicateSection struct {
+	Username string
+	Heading  string
+	Pairs    []db.DuplicatePair
+}
+
+type DuplicatesData struct {
+	Username  string
+	Sections  []DuplicateSection
+	Dismissed int
+	Message   string
+	// Type of the entities last merged, to confirm the merge
+	Merged           string
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// Returns the user in the URL when they are the one logged in, for pages
+// only the owner of a profile can see
+func getOwnProfileUser(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	username := chi.URLParam(r, "username")
+	loggedIn := getLoggedInUsername(r)
+	if loggedIn == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return "", 0, false
+	}
+	if loggedIn != username {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", 0, false
+	}
+	userId, err := getUserIdByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return "", 0, false
+	}
+	return username, userId, true
+}
+
+func renderDuplicates(w http.ResponseWriter, username string, userId int, data DuplicatesData) {
+	data.Username = username
+	data.Title = "muzi | Data Quality"
+	data.LoggedInUsername = username
+	data.TemplateName = "duplicates"
+
+	for _, entityType := range []string{db.EntityArtist, db.EntityAlbum, db.EntitySong} {
+		pairs, err := db.GetDuplicates(userId, entityType, duplicatePairLimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get duplicate %ss: %v\n", entityType, err)
+			http.Error(w, "Error finding duplicates", http.StatusInternalServerError)
+			return
+		}
+		data.Sections = append(data.Sections, DuplicateSection{
+			Username: username,
+			Heading:  strings.ToUpper(entityType[:1]) + entityType[1:] + "s",
+			Pairs:    pairs,
+		})
+	}
+	var err error
+	data.Dismissed, err = db.GetDismissedDuplicateCount(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot count dismissed duplicates: %v\n", err)
+	}
+
+	err = templates.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func duplicatesPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+		renderDuplicates(w, username, userId, DuplicatesData{Merged: r.URL.Query().Get("merged")})
+	}
+}
+
+// Reads the entity type and the two ids of a pair from the form
+func parseDuplicatePair(w http.ResponseWriter, r *http.Request) (string, int, int, bool) {
+	entityType := r.FormValue("type")
+	if entityType != db.EntityArtist && entityType != db.EntityAlbum && entityType != db.EntitySong {
+		http.Error(w, "Invalid type", http.StatusBadRequest)
+		return "", 0, 0, false
+	}
+	from, err := strconv.Atoi(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return "", 0, 0, false
+	}
+	to, err := strconv.Atoi(r.FormValue("to"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return "", 0, 0, false
+	}
+	return entityType, from, to, true
+}
+
+// Merges one entity of a pair into the other
+func mergeDuplicateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+		entityType, from, to, ok := parseDuplicatePair(w, r)
+		if !ok {
+			return
+		}
+
+		_, err := mergeEntities(entityType, userId, from, to, true)
+		if err == nil {
+			http.Redirect(w, r, "/profile/"+username+"/duplicates?merged="+entityType, http.StatusSeeOther)
+			return
+		}
+		if !errors.Is(err, db.ErrMergeSame) && !errors.Is(err, db.ErrEditConflict) {
+			fmt.Fprintf(os.Stderr, "Cannot merge duplicate %s: %v\n", entityType, err)
+			http.Error(w, "Error merging "+entityType, http.StatusInternalServerError)
+			return
+		}
+		renderDuplicates(w, username, userId, DuplicatesData{Message: "Nothing was changed, " + err.Error() + "."})
+	}
+}
+
+// Marks a pair as not duplicates so it isn't listed again
+func dismissDuplicateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+		entityType, from, to, ok := parseDuplicatePair(w, r)
+		if !ok {
+			return
+		}
+
+		err := db.DismissDuplicate(userId, entityType, from, to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot dismiss duplicate %s: %v\n", entityType, err)
+			http.Error(w, "Error dismissing duplicate", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/duplicates", http.StatusSeeOther)
+	}
+}
+
+// Lists the dismissed pairs again
+func clearDismissedDuplicatesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		err := db.ClearDuplicateDismissals(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot clear dismissed duplicates: %v\n", err)
+			http.Error(w, "Error clearing dismissals", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/duplicates", http.StatusSeeOther)
+	}
+}
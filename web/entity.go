@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"time"
 
 	"muzi/db"
 
@@ -23,6 +24,14 @@ type ArtistData struct {
 	Username         string
 	Artist           db.Artist
 	ListenCount      int
+	FirstListen      time.Time
+	LastListen       time.Time
+	ChartRun         db.ChartRun
+	Skips            db.SkipStat
+	Tags             TagList
+	Aliases          AliasList
+	Streak           db.Streak
+	Milestones       []db.Milestone
 	Songs            []string
 	Titles           []string
 	Times            []db.ScrobbleEntry
@@ -39,6 +48,12 @@ type SongData struct {
 	ArtistNames      []string
 	Albums           []db.Album
 	ListenCount      int
+	FirstListen      time.Time
+	LastListen       time.Time
+	ChartRun         db.ChartRun
+	Skips            db.SkipStat
+	Tags             TagList
+	Aliases          AliasList
 	Times            []db.ScrobbleEntry
 	Page             int
 	Title            string
@@ -52,6 +67,12 @@ type AlbumData struct {
 	Artist           db.Artist
 	ArtistNames      []string
 	ListenCount      int
+	FirstListen      time.Time
+	LastListen       time.Time
+	ChartRun         db.ChartRun
+	Completion       db.AlbumCompletion
+	Tags             TagList
+	Aliases          AliasList
 	Times            []db.ScrobbleEntry
 	Page             int
 	Title            string
@@ -77,6 +98,11 @@ func artistPageHandler() http.HandlerFunc {
 
 		artist, err := db.GetArtistByName(userId, artistName)
 		if err != nil {
+			// Another name of the artist leads to its page
+			if aliased, aliasErr := db.GetArtistByAlias(userId, artistName); aliasErr == nil {
+				http.Redirect(w, r, "/profile/"+username+"/artist/"+url.QueryEscape(aliased.Name), http.StatusSeeOther)
+				return
+			}
 			fmt.Fprintf(os.Stderr, "Cannot find artist %s: %v\n", artistName, err)
 			http.Error(w, "Artist not found", http.StatusNotFound)
 			return
@@ -96,22 +122,55 @@ func artistPageHandler() http.HandlerFunc {
 		lim := 15
 		off := (pageInt - 1) * lim
 
-		listenCount, err := db.GetArtistStats(userId, artist.Id)
+		listenCount, err := db.GetListenCount(db.Filter{UserId: userId, ArtistId: artist.Id})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get artist stats: %v\n", err)
 		}
 
-		entries, err := db.GetHistoryForArtist(userId, artist.Id, lim, off)
+		skips, err := db.GetSkipRate(db.Filter{UserId: userId, ArtistId: artist.Id})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist skip rate: %v\n", err)
+		}
+
+		entries, err := db.GetHistory(db.Filter{UserId: userId, ArtistId: artist.Id, Platforms: parsePlatforms(r), Limit: lim, Offset: off})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get history for artist: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		listens, err := db.GetArtistListenRange(userId, artist.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist listen range: %v\n", err)
+		}
+
+		chartRun, err := db.GetChartRun(userId, db.ChartArtist, artist.Name, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist chart run: %v\n", err)
+		}
+
+		streak, err := db.GetArtistListeningStreak(userId, artist.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist streak: %v\n", err)
+		}
+
+		milestones, err := db.GetArtistMilestones(userId, artist.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist milestones: %v\n", err)
+		}
+
 		artistData := ArtistData{
 			Username:         username,
 			Artist:           artist,
 			ListenCount:      listenCount,
+			FirstListen:      listens.First,
+			LastListen:       listens.Last,
+			ChartRun:         chartRun,
+			Skips:            skips,
+			Tags:             loadTagList(r, username, userId, db.EntityArtist, artist.Id),
+			Aliases:          loadAliasList(r, username, db.EntityArtist, artist.Id),
+			Streak:           streak,
+			Milestones:       milestones,
 			Times:            entries,
 			Page:             pageInt,
 			Title:            artistName + " - " + username,
@@ -190,7 +249,7 @@ func songPageHandler() http.HandlerFunc {
 		var artistNames []string
 		seenArtistIdsMap := make(map[int]bool)
 		rows, err := db.Pool.Query(context.Background(),
-			`SELECT DISTINCT artist_ids FROM history WHERE song_id = ANY($1)`,
+			`SELECT DISTINCT artist_ids FROM history WHERE song_id = ANY($1) AND deleted_at IS NULL`,
 			songIds)
 		if err == nil {
 			defer rows.Close()
@@ -224,18 +283,33 @@ func songPageHandler() http.HandlerFunc {
 		lim := 15
 		off := (pageInt - 1) * lim
 
-		listenCount, err := db.GetSongStatsForSongs(userId, songIds)
+		listenCount, err := db.GetListenCount(db.Filter{UserId: userId, SongIds: songIds})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get song stats: %v\n", err)
 		}
 
-		entries, err := db.GetHistoryForSongs(userId, songIds, lim, off)
+		skips, err := db.GetSkipRate(db.Filter{UserId: userId, SongIds: songIds})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get song skip rate: %v\n", err)
+		}
+
+		entries, err := db.GetHistory(db.Filter{UserId: userId, SongIds: songIds, Platforms: parsePlatforms(r), Limit: lim, Offset: off})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get history for song: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		listens, err := db.GetSongsListenRange(userId, songIds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get song listen range: %v\n", err)
+		}
+
+		chartRun, err := db.GetChartRun(userId, db.ChartTrack, songTitle, artistName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get song chart run: %v\n", err)
+		}
+
 		songData := SongData{
 			Username:         username,
 			Song:             song,
@@ -243,6 +317,12 @@ func songPageHandler() http.HandlerFunc {
 			ArtistNames:      artistNames,
 			Albums:           albums,
 			ListenCount:      listenCount,
+			FirstListen:      listens.First,
+			LastListen:       listens.Last,
+			ChartRun:         chartRun,
+			Skips:            skips,
+			Tags:             loadTagList(r, username, userId, db.EntitySong, song.Id),
+			Aliases:          loadAliasList(r, username, db.EntitySong, song.Id),
 			Times:            entries,
 			Page:             pageInt,
 			Title:            songTitle + " - " + username,
@@ -265,6 +345,12 @@ func editArtistHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		artistIdStr := chi.URLParam(r, "id")
 		artistId, err := strconv.Atoi(artistIdStr)
 		if err != nil {
@@ -279,7 +365,7 @@ func editArtistHandler() http.HandlerFunc {
 		spotifyId := r.Form.Get("spotify_id")
 		musicbrainzId := r.Form.Get("musicbrainz_id")
 
-		err = db.UpdateArtist(artistId, name, imageUrl, bio, spotifyId, musicbrainzId)
+		err = db.UpdateArtist(userId, artistId, name, imageUrl, bio, spotifyId, musicbrainzId)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error updating artist: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -298,6 +384,12 @@ func editSongHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		r.ParseForm()
 		title := r.Form.Get("title")
 		spotifyId := r.Form.Get("spotify_id")
@@ -310,7 +402,7 @@ func editSongHandler() http.HandlerFunc {
 			return
 		}
 
-		err = db.UpdateSong(songId, title, 0, spotifyId, musicbrainzId)
+		err = db.UpdateSong(userId, songId, title, 0, spotifyId, musicbrainzId)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error updating song: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -396,18 +488,33 @@ func albumPageHandler() http.HandlerFunc {
 		lim := 15
 		off := (pageInt - 1) * lim
 
-		listenCount, err := db.GetAlbumStats(userId, album.Id)
+		listenCount, err := db.GetListenCount(db.Filter{UserId: userId, AlbumId: album.Id})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get album stats: %v\n", err)
 		}
 
-		entries, err := db.GetHistoryForAlbum(userId, album.Id, lim, off)
+		entries, err := db.GetHistory(db.Filter{UserId: userId, AlbumId: album.Id, Platforms: parsePlatforms(r), Limit: lim, Offset: off})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get history for album: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		listens, err := db.GetAlbumListenRange(userId, album.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get album listen range: %v\n", err)
+		}
+
+		chartRun, err := db.GetChartRun(userId, db.ChartAlbum, albumTitle, artistName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get album chart run: %v\n", err)
+		}
+
+		completion, err := db.GetAlbumCompletion(userId, album.Id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get album completion: %v\n", err)
+		}
+
 		var artistNames []string
 		seenArtistIds := make(map[int]bool)
 		for _, e := range entries {
@@ -428,6 +535,12 @@ func albumPageHandler() http.HandlerFunc {
 			Artist:           artist,
 			ArtistNames:      artistNames,
 			ListenCount:      listenCount,
+			FirstListen:      listens.First,
+			LastListen:       listens.Last,
+			ChartRun:         chartRun,
+			Completion:       completion,
+			Tags:             loadTagList(r, username, userId, db.EntityAlbum, album.Id),
+			Aliases:          loadAliasList(r, username, db.EntityAlbum, album.Id),
 			Times:            entries,
 			Page:             pageInt,
 			Title:            albumTitle + " - " + username,
@@ -450,6 +563,12 @@ func editAlbumHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		r.ParseForm()
 		title := r.Form.Get("title")
 		coverUrl := r.Form.Get("cover_url")
@@ -463,7 +582,7 @@ func editAlbumHandler() http.HandlerFunc {
 			return
 		}
 
-		err = db.UpdateAlbum(albumId, title, coverUrl, spotifyId, musicbrainzId)
+		err = db.UpdateAlbum(userId, albumId, title, coverUrl, spotifyId, musicbrainzId)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error updating album: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -516,6 +635,12 @@ func artistInlineEditHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		artistIdStr := chi.URLParam(r, "id")
 		artistId, err := strconv.Atoi(artistIdStr)
 		if err != nil {
@@ -540,6 +665,7 @@ func artistInlineEditHandler() http.HandlerFunc {
 		case "name":
 			artist, _ := db.GetArtistById(artistId)
 			updateErr = db.UpdateArtist(
+				userId,
 				artistId,
 				req.Value,
 				artist.ImageUrl,
@@ -550,6 +676,7 @@ func artistInlineEditHandler() http.HandlerFunc {
 		case "bio":
 			artist, _ := db.GetArtistById(artistId)
 			updateErr = db.UpdateArtist(
+				userId,
 				artistId,
 				artist.Name,
 				artist.ImageUrl,
@@ -560,6 +687,7 @@ func artistInlineEditHandler() http.HandlerFunc {
 		case "image_url":
 			artist, _ := db.GetArtistById(artistId)
 			updateErr = db.UpdateArtist(
+				userId,
 				artistId,
 				artist.Name,
 				req.Value,
@@ -591,6 +719,12 @@ func artistBatchEditHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		artistIdStr := chi.URLParam(r, "id")
 		artistId, err := strconv.Atoi(artistIdStr)
 		if err != nil {
@@ -628,7 +762,7 @@ func artistBatchEditHandler() http.HandlerFunc {
 			musicbrainzId = req.MusicbrainzId
 		}
 
-		updateErr := db.UpdateArtist(artistId, name, imageUrl, bio, spotifyId, musicbrainzId)
+		updateErr := db.UpdateArtist(userId, artistId, name, imageUrl, bio, spotifyId, musicbrainzId)
 		if updateErr != nil {
 			fmt.Fprintf(os.Stderr, "Error updating artist: %v\n", updateErr)
 			http.Error(w, updateErr.Error(), http.StatusInternalServerError)
@@ -648,6 +782,12 @@ func songInlineEditHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		songIdStr := chi.URLParam(r, "id")
 		songId, err := strconv.Atoi(songIdStr)
 		if err != nil {
@@ -669,6 +809,7 @@ func songInlineEditHandler() http.HandlerFunc {
 
 		song, _ := db.GetSongById(songId)
 		updateErr := db.UpdateSong(
+			userId,
 			songId,
 			req.Value,
 			song.AlbumId,
@@ -695,6 +836,12 @@ func songBatchEditHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		songIdStr := chi.URLParam(r, "id")
 		songId, err := strconv.Atoi(songIdStr)
 		if err != nil {
@@ -728,7 +875,7 @@ func songBatchEditHandler() http.HandlerFunc {
 			musicbrainzId = req.MusicbrainzId
 		}
 
-		updateErr := db.UpdateSong(songId, title, albumId, spotifyId, musicbrainzId)
+		updateErr := db.UpdateSong(userId, songId, title, albumId, spotifyId, musicbrainzId)
 		if updateErr != nil {
 			fmt.Fprintf(os.Stderr, "Error updating song: %v\n", updateErr)
 			http.Error(w, updateErr.Error(), http.StatusInternalServerError)
@@ -755,6 +902,12 @@ func albumInlineEditHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		albumIdStr := chi.URLParam(r, "id")
 		albumId, err := strconv.Atoi(albumIdStr)
 		if err != nil {
@@ -774,7 +927,7 @@ func albumInlineEditHandler() http.HandlerFunc {
 			return
 		}
 
-		updateErr := db.UpdateAlbumField(albumId, field, req.Value)
+		updateErr := db.UpdateAlbumField(userId, albumId, field, req.Value)
 
 		if updateErr != nil {
 			fmt.Fprintf(os.Stderr, "Error updating album: %v\n", updateErr)
@@ -795,6 +948,12 @@ func albumBatchEditHandler() http.HandlerFunc {
 			return
 		}
 
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
 		albumIdStr := chi.URLParam(r, "id")
 		albumId, err := strconv.Atoi(albumIdStr)
 		if err != nil {
@@ -828,7 +987,7 @@ func albumBatchEditHandler() http.HandlerFunc {
 			musicbrainzId = req.MusicbrainzId
 		}
 
-		updateErr := db.UpdateAlbum(albumId, title, coverUrl, spotifyId, musicbrainzId)
+		updateErr := db.UpdateAlbum(userId, albumId, title, coverUrl, spotifyId, musicbrainzId)
 		if updateErr != nil {
 			fmt.Fprintf(os.Stderr, "Error updating album: %v\n", updateErr)
 			http.Error(w, updateErr.Error(), http.StatusInternalServerError)
@@ -875,7 +1034,7 @@ func searchHandler() http.HandlerFunc {
 		artists, artistSim, err := db.SearchArtists(userId, query)
 		if err == nil {
 			for _, a := range artists {
-				count, _ := db.GetArtistStats(userId, a.Id)
+				count, _ := db.GetListenCount(db.Filter{UserId: userId, ArtistId: a.Id})
 				results = append(results, SearchResult{
 					Type:  "artist",
 					Name:  a.Name,
@@ -889,7 +1048,7 @@ func searchHandler() http.HandlerFunc {
 		songs, songSim, err := db.SearchSongs(userId, query)
 		if err == nil {
 			for _, s := range songs {
-				count, _ := db.GetSongStats(userId, s.Id)
+				count, _ := db.GetListenCount(db.Filter{UserId: userId, SongIds: []int{s.Id}})
 				artist, _ := db.GetArtistById(s.ArtistId)
 				results = append(results, SearchResult{
 					Type:   "song",
@@ -909,7 +1068,7 @@ func searchHandler() http.HandlerFunc {
 		albums, albumSim, err := db.SearchAlbums(userId, query)
 		if err == nil {
 			for _, al := range albums {
-				count, _ := db.GetAlbumStats(userId, al.Id)
+				count, _ := db.GetListenCount(db.Filter{UserId: userId, AlbumId: al.Id})
 				artist, _ := db.GetArtistById(al.ArtistId)
 				results = append(results, SearchResult{
 					Type:   "album",
@@ -0,0 +1,81 @@
+package web
+
+// Functions used for the scrobble pace and forecasts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	forecastChartWidth  = 600
+	forecastChartHeight = 150
+)
+
+// SVG polylines for the year so far and its projection to the year end
+type ForecastChart struct {
+	Width     int
+	Height    int
+	Actual    string
+	Projected string
+}
+
+type forecastResponse struct {
+	Username string              `json:"username"`
+	Forecast db.Forecast         `json:"forecast"`
+	Artists  []db.ArtistForecast `json:"artists"`
+}
+
+func newForecastChart(f db.Forecast) ForecastChart {
+	c := ForecastChart{Width: forecastChartWidth, Height: forecastChartHeight}
+	top := max(f.ProjectedYear, f.YearScrobbles, 1)
+	point := func(day, count int) string {
+		x := float64(day) * forecastChartWidth / float64(f.DaysInYear)
+		y := forecastChartHeight - float64(count)*forecastChartHeight/float64(top)
+		return fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+
+	points := []string{point(0, 0)}
+	for i, d := range f.Days {
+		points = append(points, point(i+1, d.Cumulative))
+	}
+	c.Actual = strings.Join(points, " ")
+	c.Projected = point(f.DaysElapsed, f.YearScrobbles) + " " + point(f.DaysInYear, f.ProjectedYear)
+	return c
+}
+
+func forecastAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		resp := forecastResponse{Username: username}
+		resp.Forecast, err = db.GetForecast(userId, time.Now())
+		if err == nil {
+			resp.Artists, err = db.GetArtistForecasts(userId, time.Now(), 20)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get forecast: %v\n", err)
+			http.Error(w, "Error getting forecast", http.StatusInternalServerError)
+			return
+		}
+		if resp.Artists == nil {
+			resp.Artists = []db.ArtistForecast{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,103 @@
+package web
+
+// Functions used for the server wide charts and now playing list
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"muzi/db"
+	"muzi/scrobble"
+)
+
+type GlobalNowPlaying struct {
+	Username string
+	SongName string
+	Artist   string
+	Album    string
+}
+
+type GlobalData struct {
+	Period           string
+	Start            string
+	End              string
+	UserCount        int
+	Artists          []db.GlobalArtist
+	Albums           []db.GlobalAlbum
+	Tracks           []db.GlobalTrack
+	NowPlaying       []GlobalNowPlaying
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+func globalPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "month"
+		}
+
+		data := GlobalData{
+			Period:           period,
+			Start:            r.URL.Query().Get("start"),
+			End:              r.URL.Query().Get("end"),
+			Title:            "muzi | Global Charts",
+			LoggedInUsername: getLoggedInUsername(r),
+			TemplateName:     "global",
+		}
+
+		var err error
+		data.UserCount, err = db.GetGlobalUserCount()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get global user count: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		startDate, endDate := getPeriodRange(period, data.Start, data.End)
+		f := db.Filter{Start: startDate, End: endDate, Limit: 25}
+
+		data.Artists, err = db.GetGlobalTopArtists(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get global top artists: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Albums, err = db.GetGlobalTopAlbums(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get global top albums: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Tracks, err = db.GetGlobalTopTracks(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get global top tracks: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sharers, err := db.GetNowPlayingSharers()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get now playing users: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, u := range sharers {
+			if np, ok := scrobble.GetNowPlaying(u.Id); ok {
+				data.NowPlaying = append(data.NowPlaying, GlobalNowPlaying{
+					Username: u.Username,
+					SongName: np.SongName,
+					Artist:   np.Artist,
+					Album:    np.Album,
+				})
+			}
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package web
+
+// Functions used for the filterable listening history page and its API
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var historyPageSizes = []int{25, 50, 100, 250}
+
+const defaultHistoryPageSize = 50
+
+type HistoryData struct {
+	Username   string
+	Search     string
+	Artist     string
+	Album      string
+	Start      string
+	End        string
+	Date       string
+	Platform   string
+	MinSeconds int
+	Size       int
+	Sort       string
+	HideSkips  bool
+	Sizes      []int
+	Platforms  []db.PlatformStat
+	Entries    []db.ScrobbleEntry
+	// Cursor of the last entry when there are more, and the URL of the
+	// next page
+	NextCursor string
+	NextURL    string
+	Message    string
+	// Set for the owner, who can select rows and edit them
+	CanEdit bool
+	// Filters of the page without its position, for editing every match
+	Query string
+	// Number of scrobbles changed by the edit that led back here
+	Edited           int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+type historyEntry struct {
+	db.ScrobbleEntry
+	Artists []string `json:"artists"`
+}
+
+type historyResponse struct {
+	Username   string         `json:"username"`
+	Entries    []historyEntry `json:"entries"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Message    string         `json:"message,omitempty"`
+}
+
+func formatHistoryCursor(e db.ScrobbleEntry) string {
+	return fmt.Sprintf("%d_%d", e.Timestamp.UnixMicro(), e.Id)
+}
+
+func parseHistoryCursor(s string) (*db.HistoryCursor, bool) {
+	ts, id, ok := strings.Cut(s, "_")
+	if !ok {
+		return nil, false
+	}
+	micros, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, false
+	}
+	return &db.HistoryCursor{Timestamp: time.UnixMicro(micros), Id: idInt}, true
+}
+
+// Query parameters that only position the page or report on the last edit
+var historyPositionParams = []string{"cursor", "date", "edited"}
+
+// Reads the filters, page size and position from the URL. Input that can't
+// match anything, like an unknown artist or a bad date, sets a message and
+// returns false.
+func historyFilter(r *http.Request, userId int) (HistoryData, db.Filter, bool) {
+	query := r.URL.Query()
+	d := HistoryData{
+		Search:    strings.TrimSpace(query.Get("q")),
+		Artist:    strings.TrimSpace(query.Get("artist")),
+		Album:     strings.TrimSpace(query.Get("album")),
+		Start:     query.Get("start"),
+		End:       query.Get("end"),
+		Date:      query.Get("date"),
+		Platform:  strings.Join(parsePlatforms(r), ","),
+		Size:      defaultHistoryPageSize,
+		Sort:      db.SortRecent,
+		HideSkips: query.Get("skips") == "hide",
+		Sizes:     historyPageSizes,
+	}
+	if size, err := strconv.Atoi(query.Get("size")); err == nil && slices.Contains(historyPageSizes, size) {
+		d.Size = size
+	}
+	if query.Get("sort") == db.SortOldest {
+		d.Sort = db.SortOldest
+	}
+	if secs, err := strconv.Atoi(query.Get("min_seconds")); err == nil && secs > 0 {
+		d.MinSeconds = secs
+	}
+	d.Edited, _ = strconv.Atoi(query.Get("edited"))
+
+	filters := url.Values{}
+	for k, v := range query {
+		if !slices.Contains(historyPositionParams, k) {
+			filters[k] = v
+		}
+	}
+	d.Query = filters.Encode()
+
+	f := db.Filter{
+		UserId:       userId,
+		Platforms:    parsePlatforms(r),
+		AlbumName:    d.Album,
+		Search:       d.Search,
+		MinMsPlayed:  d.MinSeconds * 1000,
+		IncludeSkips: !d.HideSkips,
+		Sort:         d.Sort,
+		Limit:        d.Size + 1,
+	}
+	start, end := getPeriodRange("custom", d.Start, d.End)
+	f.Start, f.End = start, end
+
+	if d.Artist != "" {
+		artist, err := db.GetArtistByName(userId, d.Artist)
+		if err != nil {
+			d.Message = "No artist named " + d.Artist + " in this history."
+			return d, f, false
+		}
+		f.ArtistId = artist.Id
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, ok := parseHistoryCursor(c)
+		if !ok {
+			d.Message = "Invalid page position."
+			return d, f, false
+		}
+		f.Cursor = cursor
+	} else if d.Date != "" {
+		// Jumping to a date starts at the end of that day, or at its start
+		// when going forwards in time
+		date, err := time.Parse("2006-01-02", d.Date)
+		if err != nil {
+			d.Message = "Invalid date " + d.Date + "."
+			return d, f, false
+		}
+		if d.Sort != db.SortOldest {
+			date = date.AddDate(0, 0, 1)
+		}
+		f.Cursor = &db.HistoryCursor{Timestamp: date}
+	}
+	return d, f, true
+}
+
+// Loads the page of history the URL asks for
+func loadHistory(r *http.Request, userId int) (HistoryData, error) {
+	d, f, ok := historyFilter(r, userId)
+	if !ok {
+		return d, nil
+	}
+
+	entries, err := db.GetHistory(f)
+	if err != nil {
+		return d, err
+	}
+	if len(entries) > d.Size {
+		entries = entries[:d.Size]
+		d.NextCursor = formatHistoryCursor(entries[len(entries)-1])
+
+		next, _ := url.ParseQuery(d.Query)
+		next.Set("cursor", d.NextCursor)
+		d.NextURL = "?" + next.Encode()
+	}
+	d.Entries = entries
+	return d, nil
+}
+
+func historyPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", username, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := loadHistory(r, userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get history: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Username = username
+		data.Title = username + "'s Listening History"
+		data.LoggedInUsername = getLoggedInUsername(r)
+		data.CanEdit = data.LoggedInUsername == username
+		data.TemplateName = "history"
+
+		data.Platforms, err = db.GetPlatformBreakdown(db.Filter{UserId: userId})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get platform breakdown: %v\n", err)
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func historyAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := loadHistory(r, userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get history: %v\n", err)
+			http.Error(w, "Error getting history", http.StatusInternalServerError)
+			return
+		}
+
+		resp := historyResponse{Username: username, Entries: []historyEntry{}, NextCursor: data.NextCursor, Message: data.Message}
+		for _, e := range data.Entries {
+			resp.Entries = append(resp.Entries, historyEntry{ScrobbleEntry: e, Artists: GetArtistNames(e.ArtistIds)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -131,6 +131,7 @@ func importSpotifyHandler(w http.ResponseWriter, r *http.Request) {
 	if allTracks == nil {
 		return
 	}
+	keepSkips := r.FormValue("keep_skips") == "on"
 
 	jobID, err := generateID()
 	if err != nil {
@@ -145,7 +146,7 @@ func importSpotifyHandler(w http.ResponseWriter, r *http.Request) {
 	jobsMu.Unlock()
 
 	go func() {
-		migrate.ImportSpotify(allTracks, userId, progressChan)
+		migrate.ImportSpotify(allTracks, userId, progressChan, keepSkips)
 
 		jobsMu.Lock()
 		delete(importJobs, jobID)
@@ -0,0 +1,182 @@
+package web
+
+// Functions used for merging an artist, album or song into another one
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"muzi/db"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type MergeData struct {
+	Username   string
+	EntityType string
+	From       taggedEntity
+	// The entity merged into, Id is 0 when it wasn't found
+	Target           taggedEntity
+	Result           db.MergeResult
+	Message          string
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// Returns the page of an artist, album or song
+func entityPath(username, entityType, name, artist string) string {
+	if entityType == db.EntityArtist {
+		return "/profile/" + username + "/artist/" + url.QueryEscape(name)
+	}
+	return "/profile/" + username + "/" + entityType + "/" + url.QueryEscape(artist) + "/" + url.QueryEscape(name)
+}
+
+// Reads the entity in the URL and the one the form names to merge it into.
+// The target is looked up by name, and albums and songs by their artist too.
+func parseMerge(w http.ResponseWriter, r *http.Request, entityType string) (MergeData, int, bool) {
+	from, userId, ok := getOwnEntity(w, r, entityType)
+	if !ok {
+		return MergeData{}, 0, false
+	}
+	username := getLoggedInUsername(r)
+
+	d := MergeData{
+		Username:   username,
+		EntityType: entityType,
+		From:       from,
+		Target: taggedEntity{
+			Name:   strings.TrimSpace(r.FormValue("target")),
+			Artist: strings.TrimSpace(r.FormValue("target_artist")),
+		},
+		Title:            "muzi | Merge",
+		LoggedInUsername: username,
+		TemplateName:     "merge",
+	}
+	if entityType == db.EntityArtist {
+		d.Target.Artist = ""
+	} else if d.Target.Artist == "" {
+		d.Target.Artist = from.Artist
+	}
+	if d.Target.Name == "" {
+		d.Message = "Enter the " + entityType + " to merge into."
+		return d, userId, true
+	}
+
+	var err error
+	switch entityType {
+	case db.EntityArtist:
+		var artist db.Artist
+		artist, err = db.GetArtistByName(userId, d.Target.Name)
+		d.Target.Id = artist.Id
+	default:
+		var artist db.Artist
+		artist, err = db.GetArtistByName(userId, d.Target.Artist)
+		if err != nil {
+			break
+		}
+		if entityType == db.EntityAlbum {
+			var album db.Album
+			album, err = db.GetAlbumByName(userId, d.Target.Name, artist.Id)
+			d.Target.Id = album.Id
+		} else {
+			var song db.Song
+			song, err = db.GetSongByName(userId, d.Target.Name, artist.Id)
+			d.Target.Id = song.Id
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			fmt.Fprintf(os.Stderr, "Error getting %s: %v\n", entityType, err)
+			http.Error(w, "Error getting "+entityType, http.StatusInternalServerError)
+			return d, userId, false
+		}
+		d.Target.Id = 0
+		d.Message = "No " + entityType + " named " + d.Target.Name
+		if d.Target.Artist != "" {
+			d.Message += " by " + d.Target.Artist
+		}
+		d.Message += "."
+		return d, userId, true
+	}
+	d.Target.Path = entityPath(username, entityType, d.Target.Name, d.Target.Artist)
+	return d, userId, true
+}
+
+func mergeEntities(entityType string, userId, fromId, toId int, apply bool) (db.MergeResult, error) {
+	switch {
+	case entityType == db.EntityArtist && apply:
+		return db.MergeArtists(userId, fromId, toId)
+	case entityType == db.EntityArtist:
+		return db.PreviewMergeArtists(userId, fromId, toId)
+	case entityType == db.EntityAlbum && apply:
+		return db.MergeAlbums(userId, fromId, toId)
+	case entityType == db.EntityAlbum:
+		return db.PreviewMergeAlbums(userId, fromId, toId)
+	case apply:
+		return db.MergeSongs(userId, fromId, toId)
+	default:
+		return db.PreviewMergeSongs(userId, fromId, toId)
+	}
+}
+
+// Shows what merging the entity into the one in the form would change
+func mergePreviewHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, userId, ok := parseMerge(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		if data.Message == "" {
+			result, err := mergeEntities(entityType, userId, data.From.Id, data.Target.Id, false)
+			switch {
+			case err == nil:
+				data.Result = result
+			case errors.Is(err, db.ErrMergeSame) || errors.Is(err, db.ErrEditConflict):
+				data.Message = "The " + entityType + " can't be merged, " + err.Error() + "."
+			default:
+				fmt.Fprintf(os.Stderr, "Cannot preview %s merge: %v\n", entityType, err)
+				http.Error(w, "Error previewing merge", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err := templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func mergeApplyHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, userId, ok := parseMerge(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		if data.Message == "" {
+			_, err := mergeEntities(entityType, userId, data.From.Id, data.Target.Id, true)
+			if err == nil {
+				http.Redirect(w, r, data.Target.Path, http.StatusSeeOther)
+				return
+			}
+			if !errors.Is(err, db.ErrMergeSame) && !errors.Is(err, db.ErrEditConflict) {
+				fmt.Fprintf(os.Stderr, "Cannot merge %s: %v\n", entityType, err)
+				http.Error(w, "Error merging "+entityType, http.StatusInternalServerError)
+				return
+			}
+			data.Message = "Nothing was changed, " + err.Error() + "."
+		}
+
+		err := templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package web
+
+// Functions used for listening streaks and milestones
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type milestonesResponse struct {
+	Username   string         `json:"username"`
+	Streak     db.Streak      `json:"streak"`
+	Milestones []db.Milestone `json:"milestones"`
+}
+
+// Serves a user's streak and milestones as JSON. An optional artist_id query
+// param scopes both to a single artist.
+func milestonesAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		resp := milestonesResponse{Username: username}
+
+		artistIdStr := r.URL.Query().Get("artist_id")
+		if artistIdStr != "" {
+			artistId, err := strconv.Atoi(artistIdStr)
+			if err != nil {
+				http.Error(w, "Invalid artist ID", http.StatusBadRequest)
+				return
+			}
+			resp.Streak, err = db.GetArtistListeningStreak(userId, artistId)
+			if err == nil {
+				resp.Milestones, err = db.GetArtistMilestones(userId, artistId)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot get artist milestones: %v\n", err)
+				http.Error(w, "Error getting milestones", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			resp.Streak, err = db.GetListeningStreak(userId)
+			if err == nil {
+				resp.Milestones, err = db.GetMilestones(userId, 0)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot get milestones: %v\n", err)
+				http.Error(w, "Error getting milestones", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if resp.Milestones == nil {
+			resp.Milestones = []db.Milestone{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// Describes a milestone for display, e.g. "10,000th scrobble"
+func milestoneLabel(m db.Milestone) string {
+	switch m.Kind {
+	case db.MilestoneScrobble:
+		if m.Count == 1 {
+			return "First scrobble"
+		}
+		return formatInt(m.Count) + ordinalSuffix(m.Count) + " scrobble"
+	case db.MilestoneArtistFirst:
+		return "First listen of " + m.Artist
+	case db.MilestoneArtistPlays:
+		return m.Artist + " reached " + formatInt(m.Count) + " plays"
+	}
+	return ""
+}
+
+func ordinalSuffix(n int) string {
+	if n%100 >= 11 && n%100 <= 13 {
+		return "th"
+	}
+	switch n % 10 {
+	case 1:
+		return "st"
+	case 2:
+		return "nd"
+	case 3:
+		return "rd"
+	}
+	return "th"
+}
@@ -7,13 +7,13 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"muzi/db"
 	"muzi/scrobble"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgtype"
 )
 
 type ProfileData struct {
@@ -28,6 +28,9 @@ type ProfileData struct {
 	ArtistIdsList       [][]int
 	Titles              []string
 	Times               []time.Time
+	Platforms           []string
+	Clients             []string
+	Skipped             []bool
 	Page                int
 	Title               string
 	LoggedInUsername    string
@@ -45,6 +48,35 @@ type ProfileData struct {
 	TopTracks           []db.TopTrack
 	TopTracksPeriod     string
 	TopTracksLimit      int
+	ArtistMovements     db.ChartMovements
+	AlbumMovements      db.ChartMovements
+	TrackMovements      db.ChartMovements
+	Streak              db.Streak
+	ArtistStreaks       []db.ArtistStreak
+	Milestones          []db.Milestone
+	Forecast            db.Forecast
+	ForecastChart       ForecastChart
+	ArtistForecasts     []db.ArtistForecast
+	OnThisDay           []db.OnThisDay
+	CompletedAlbums     []db.CompletedAlbum
+	SkippedTracks       []db.SkipStat
+	SkippedArtists      []db.SkipStat
+	Platform            string
+	Tag                 string
+	UserTags            []string
+	PlatformStats       []db.PlatformStat
+	ClientStats         []db.ClientStat
+}
+
+// Reads the platform filter from the URL, given as ?platform=a,b
+func parsePlatforms(r *http.Request) []string {
+	var platforms []string
+	for _, p := range strings.Split(r.URL.Query().Get("platform"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			platforms = append(platforms, p)
+		}
+	}
+	return platforms
 }
 
 // Render a page of the profile in the URL
@@ -84,9 +116,9 @@ func profilePageHandler() http.HandlerFunc {
 		err = db.Pool.QueryRow(
 			r.Context(),
 			`SELECT bio, pfp, allow_duplicate_edits,
-				(SELECT COUNT(*) FROM history WHERE user_id = $1) as scrobble_count,
+				(SELECT COUNT(*) FROM history WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL) as scrobble_count,
 				(SELECT COUNT(*) FROM songs WHERE user_id = $1) as track_count,
-				(SELECT COUNT(DISTINCT artist) FROM history WHERE user_id = $1) as artist_count
+				(SELECT COUNT(DISTINCT artist) FROM history WHERE user_id = $1 AND NOT skipped AND deleted_at IS NULL) as artist_count
 			FROM users WHERE pk = $1;`,
 			userId,
 		).Scan(&profileData.Bio, &profileData.Pfp, &profileData.AllowDuplicateEdits, &profileData.ScrobbleCount, &profileData.TrackCount, &profileData.ArtistCount)
@@ -123,39 +155,23 @@ func profilePageHandler() http.HandlerFunc {
 			}
 		}
 
+		platforms := parsePlatforms(r)
+		profileData.Platform = strings.Join(platforms, ",")
+
+		tag := db.NormalizeTag(r.URL.Query().Get("tag"))
+		profileData.Tag = tag
+		profileData.UserTags, err = db.GetUserTags(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get user tags: %v\n", err)
+		}
+
 		profileData.TopArtistsPeriod = period
 		profileData.TopArtistsLimit = limit
 		profileData.TopArtistsView = view
 
-		var startDate, endDate *time.Time
-		now := time.Now()
-		switch period {
-		case "week":
-			start := now.AddDate(0, 0, -7)
-			startDate = &start
-		case "month":
-			start := now.AddDate(0, -1, 0)
-			startDate = &start
-		case "year":
-			start := now.AddDate(-1, 0, 0)
-			startDate = &start
-		case "custom":
-			startStr := r.URL.Query().Get("start")
-			endStr := r.URL.Query().Get("end")
-			if startStr != "" {
-				if t, err := time.Parse("2006-01-02", startStr); err == nil {
-					startDate = &t
-				}
-			}
-			if endStr != "" {
-				if t, err := time.Parse("2006-01-02", endStr); err == nil {
-					t = t.AddDate(0, 0, 1)
-					endDate = &t
-				}
-			}
-		}
+		startDate, endDate := getPeriodRange(period, r.URL.Query().Get("start"), r.URL.Query().Get("end"))
 
-		topArtists, err := db.GetTopArtists(userId, limit, startDate, endDate)
+		topArtists, err := db.GetTopArtists(db.Filter{UserId: userId, Start: startDate, End: endDate, Platforms: platforms, Tag: tag, Limit: limit})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get top artists: %v\n", err)
 		} else {
@@ -167,33 +183,8 @@ func profilePageHandler() http.HandlerFunc {
 			albumPeriod = "all_time"
 		}
 
-		var albumStartDate, albumEndDate *time.Time
-		albumNow := time.Now()
-		switch albumPeriod {
-		case "week":
-			start := albumNow.AddDate(0, 0, -7)
-			albumStartDate = &start
-		case "month":
-			start := albumNow.AddDate(0, -1, 0)
-			albumStartDate = &start
-		case "year":
-			start := albumNow.AddDate(-1, 0, 0)
-			albumStartDate = &start
-		case "custom":
-			albumStartStr := r.URL.Query().Get("album_start")
-			albumEndStr := r.URL.Query().Get("album_end")
-			if albumStartStr != "" {
-				if t, err := time.Parse("2006-01-02", albumStartStr); err == nil {
-					albumStartDate = &t
-				}
-			}
-			if albumEndStr != "" {
-				if t, err := time.Parse("2006-01-02", albumEndStr); err == nil {
-					t = t.AddDate(0, 0, 1)
-					albumEndDate = &t
-				}
-			}
-		}
+		albumStartDate, albumEndDate := getPeriodRange(albumPeriod,
+			r.URL.Query().Get("album_start"), r.URL.Query().Get("album_end"))
 
 		albumLimitStr := r.URL.Query().Get("album_limit")
 		albumLimit := 10
@@ -223,7 +214,7 @@ func profilePageHandler() http.HandlerFunc {
 		profileData.TopAlbumsLimit = albumLimit
 		profileData.TopAlbumsView = albumView
 
-		topAlbums, err := db.GetTopAlbums(userId, albumLimit, albumStartDate, albumEndDate)
+		topAlbums, err := db.GetTopAlbums(db.Filter{UserId: userId, Start: albumStartDate, End: albumEndDate, Platforms: platforms, Tag: tag, Limit: albumLimit})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get top albums: %v\n", err)
 		} else {
@@ -235,33 +226,8 @@ func profilePageHandler() http.HandlerFunc {
 			trackPeriod = "all_time"
 		}
 
-		var trackStartDate, trackEndDate *time.Time
-		trackNow := time.Now()
-		switch trackPeriod {
-		case "week":
-			start := trackNow.AddDate(0, 0, -7)
-			trackStartDate = &start
-		case "month":
-			start := trackNow.AddDate(0, -1, 0)
-			trackStartDate = &start
-		case "year":
-			start := trackNow.AddDate(-1, 0, 0)
-			trackStartDate = &start
-		case "custom":
-			trackStartStr := r.URL.Query().Get("track_start")
-			trackEndStr := r.URL.Query().Get("track_end")
-			if trackStartStr != "" {
-				if t, err := time.Parse("2006-01-02", trackStartStr); err == nil {
-					trackStartDate = &t
-				}
-			}
-			if trackEndStr != "" {
-				if t, err := time.Parse("2006-01-02", trackEndStr); err == nil {
-					t = t.AddDate(0, 0, 1)
-					trackEndDate = &t
-				}
-			}
-		}
+		trackStartDate, trackEndDate := getPeriodRange(trackPeriod,
+			r.URL.Query().Get("track_start"), r.URL.Query().Get("track_end"))
 
 		trackLimitStr := r.URL.Query().Get("track_limit")
 		trackLimit := 10
@@ -278,13 +244,65 @@ func profilePageHandler() http.HandlerFunc {
 		profileData.TopTracksPeriod = trackPeriod
 		profileData.TopTracksLimit = trackLimit
 
-		topTracks, err := db.GetTopTracks(userId, trackLimit, trackStartDate, trackEndDate)
+		topTracks, err := db.GetTopTracks(db.Filter{UserId: userId, Start: trackStartDate, End: trackEndDate, Platforms: platforms, Tag: tag, Limit: trackLimit})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Cannot get top tracks: %v\n", err)
 		} else {
 			profileData.TopTracks = topTracks
 		}
 
+		profileData.ArtistMovements, err = db.GetChartMovements(userId, db.ChartArtist)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist chart movements: %v\n", err)
+		}
+
+		profileData.AlbumMovements, err = db.GetChartMovements(userId, db.ChartAlbum)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get album chart movements: %v\n", err)
+		}
+
+		profileData.TrackMovements, err = db.GetChartMovements(userId, db.ChartTrack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get track chart movements: %v\n", err)
+		}
+
+		profileData.Streak, err = db.GetListeningStreak(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get listening streak: %v\n", err)
+		}
+
+		artistStreaks, err := db.GetTopArtistStreaks(userId, 5)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist streaks: %v\n", err)
+		} else {
+			profileData.ArtistStreaks = artistStreaks
+		}
+
+		profileData.Forecast, err = db.GetForecast(userId, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get forecast: %v\n", err)
+		} else {
+			profileData.ForecastChart = newForecastChart(profileData.Forecast)
+		}
+
+		profileData.ArtistForecasts, err = db.GetArtistForecasts(userId, time.Now(), 5)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get artist forecasts: %v\n", err)
+		}
+
+		stats, err := db.GetProfileStats(userId, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get profile stats: %v\n", err)
+		} else {
+			profileData.Milestones = stats.Milestones
+			profileData.OnThisDay = stats.OnThisDay
+			profileData.PlatformStats = stats.PlatformStats
+			profileData.ClientStats = stats.ClientStats
+			profileData.SkippedTracks = stats.SkippedTracks
+			profileData.SkippedArtists = stats.SkippedArtists
+			profileData.CompletedAlbums = stats.CompletedAlbums
+		}
+
 		if pageInt == 1 {
 			if np, ok := scrobble.GetNowPlaying(userId); ok {
 				profileData.NowPlayingArtist = np.Artist
@@ -292,44 +310,21 @@ func profilePageHandler() http.HandlerFunc {
 			}
 		}
 
-		rows, err := db.Pool.Query(
-			r.Context(),
-			"SELECT artist_id, song_name, timestamp, artist_ids FROM history WHERE user_id = $1 ORDER BY timestamp DESC LIMIT $2 OFFSET $3;",
-			userId,
-			lim,
-			off,
-		)
+		entries, err := db.GetHistory(db.Filter{UserId: userId, Platforms: platforms, IncludeSkips: true, Limit: lim, Offset: off})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "SELECT history failed: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var artistId int
-			var title string
-			var time pgtype.Timestamptz
-			var artistIds []int
-			err = rows.Scan(&artistId, &title, &time, &artistIds)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Scanning history row failed: %v\n", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			var artistName string
-			if artistId > 0 {
-				artist, err := db.GetArtistById(artistId)
-				if err == nil {
-					artistName = artist.Name
-				}
-			}
 
-			profileData.Artists = append(profileData.Artists, artistName)
-			profileData.ArtistIdsList = append(profileData.ArtistIdsList, artistIds)
-			profileData.Titles = append(profileData.Titles, title)
-			profileData.Times = append(profileData.Times, time.Time)
+		for _, e := range entries {
+			profileData.Artists = append(profileData.Artists, e.ArtistName)
+			profileData.ArtistIdsList = append(profileData.ArtistIdsList, e.ArtistIds)
+			profileData.Titles = append(profileData.Titles, e.SongName)
+			profileData.Times = append(profileData.Times, e.Timestamp)
+			profileData.Platforms = append(profileData.Platforms, e.Platform)
+			profileData.Clients = append(profileData.Clients, e.Client)
+			profileData.Skipped = append(profileData.Skipped, e.Skipped)
 		}
 
 		err = templates.ExecuteTemplate(w, "base", profileData)
@@ -0,0 +1,255 @@
+package web
+
+// Functions used for managing rewrite rules and running them over the
+// existing history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type RulesPreviewData struct {
+	Username         string
+	Rules            int
+	Count            int
+	Changes          []db.HistoryEditChange
+	More             int
+	Message          string
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// Returns the logged in user, redirecting to the login page when there is
+// none
+func getRulesUser(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	username := getLoggedInUsername(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return "", 0, false
+	}
+
+	userId, err := getUserIdByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return "", 0, false
+	}
+	return username, userId, true
+}
+
+func addRuleHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	rule := db.RewriteRule{
+		Field:       r.FormValue("field"),
+		Match:       r.FormValue("match"),
+		Pattern:     r.FormValue("pattern"),
+		Replacement: strings.TrimSpace(r.FormValue("replacement")),
+		IgnoreCase:  r.FormValue("ignore_case") == "on",
+		Enabled:     true,
+	}
+	err := db.AddRewriteRule(userId, rule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error adding rewrite rule: %v\n", err)
+		http.Error(w, "Invalid rule: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=rules", http.StatusSeeOther)
+}
+
+func deleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	err = db.DeleteRewriteRule(userId, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error deleting rewrite rule: %v\n", err)
+		http.Error(w, "Error deleting rule", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=rules", http.StatusSeeOther)
+}
+
+func toggleRuleHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	err = db.SetRewriteRuleEnabled(userId, id, r.FormValue("enabled") == "true")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating rewrite rule: %v\n", err)
+		http.Error(w, "Error updating rule", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=rules", http.StatusSeeOther)
+}
+
+// Downloads the rules as JSON that can be imported again
+func exportRulesHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	rules, err := db.GetRewriteRules(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting rewrite rules: %v\n", err)
+		http.Error(w, "Error getting rules", http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []db.RewriteRule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="muzi-rules.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(rules)
+}
+
+// Reads rules from an uploaded file or pasted JSON
+func importRulesHandler(w http.ResponseWriter, r *http.Request) {
+	_, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseMultipartForm(1 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	var data []byte
+	if file, _, err := r.FormFile("rules_file"); err == nil {
+		defer file.Close()
+		data, err = io.ReadAll(io.LimitReader(file, 1<<20))
+		if err != nil {
+			http.Error(w, "Error reading file", http.StatusBadRequest)
+			return
+		}
+	} else {
+		data = []byte(r.FormValue("rules_json"))
+	}
+
+	// Rules written by hand are enabled unless they say otherwise
+	var imported []struct {
+		db.RewriteRule
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.Unmarshal(data, &imported); err != nil {
+		http.Error(w, "Invalid rules JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules := make([]db.RewriteRule, len(imported))
+	for i, rule := range imported {
+		rules[i] = rule.RewriteRule
+		rules[i].Enabled = rule.Enabled == nil || *rule.Enabled
+	}
+	err := db.ImportRewriteRules(userId, rules, r.FormValue("replace") == "on")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing rewrite rules: %v\n", err)
+		http.Error(w, "Error importing rules: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=rules", http.StatusSeeOther)
+}
+
+// Shows what the rules would change in the existing history
+func previewRulesHandler(w http.ResponseWriter, r *http.Request) {
+	username, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	data := RulesPreviewData{
+		Username:         username,
+		Title:            "muzi | Rewrite Rules",
+		LoggedInUsername: username,
+		TemplateName:     "rules_preview",
+	}
+	rules, err := db.GetRuleSet(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting rewrite rules: %v\n", err)
+		http.Error(w, "Error getting rules", http.StatusInternalServerError)
+		return
+	}
+	data.Rules = len(rules)
+
+	changes, err := db.PreviewRewriteRules(userId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot preview rewrite rules: %v\n", err)
+		http.Error(w, "Error previewing rules", http.StatusInternalServerError)
+		return
+	}
+	data.Count = len(changes)
+	if len(changes) > historyEditPreviewRows {
+		data.More = len(changes) - historyEditPreviewRows
+		changes = changes[:historyEditPreviewRows]
+	}
+	data.Changes = changes
+
+	err = templates.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func applyRulesHandler(w http.ResponseWriter, r *http.Request) {
+	username, userId, ok := getRulesUser(w, r)
+	if !ok {
+		return
+	}
+
+	edited, err := db.ApplyRewriteRules(userId)
+	if err == nil {
+		http.Redirect(w, r, "/profile/"+username+"/history?edited="+strconv.Itoa(edited), http.StatusSeeOther)
+		return
+	}
+	if !errors.Is(err, db.ErrEditConflict) {
+		fmt.Fprintf(os.Stderr, "Cannot apply rewrite rules: %v\n", err)
+		http.Error(w, "Error applying rules", http.StatusInternalServerError)
+		return
+	}
+
+	data := RulesPreviewData{
+		Username:         username,
+		Message:          "Nothing was changed, " + err.Error() + ".",
+		Title:            "muzi | Rewrite Rules",
+		LoggedInUsername: username,
+		TemplateName:     "rules_preview",
+	}
+	err = templates.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
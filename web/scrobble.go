@@ -1,12 +1,10 @@
 package web
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"muzi/db"
@@ -82,7 +80,7 @@ func scrobbleSubmitHandler() http.HandlerFunc {
 			return
 		}
 
-		count, err := insertScrobbles(r.Context(), userId, req.Tracks)
+		count, err := insertScrobbles(userId, req.Tracks)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error inserting scrobbles: %v\n", err)
 			http.Error(w, fmt.Sprintf("Error inserting scrobbles: %v", err), http.StatusInternalServerError)
@@ -97,7 +95,24 @@ func scrobbleSubmitHandler() http.HandlerFunc {
 	}
 }
 
-func insertScrobbles(ctx context.Context, userId int, tracks []ScrobbleTrack) (int, error) {
+func insertScrobbles(userId int, tracks []ScrobbleTrack) (int, error) {
+	rules, err := db.GetRuleSet(userId)
+	if err != nil {
+		return 0, err
+	}
+	parser, err := db.GetCreditParser(userId)
+	if err != nil {
+		return 0, err
+	}
+	aliases, err := db.GetArtistAliases(userId)
+	if err != nil {
+		return 0, err
+	}
+	for i, t := range tracks {
+		tracks[i].Artist, tracks[i].SongName, tracks[i].AlbumName = rules.Rewrite(t.Artist, t.SongName, t.AlbumName)
+		tracks[i].Artist = aliases.Canonical(parser, tracks[i].Artist)
+	}
+
 	artistIdMap := make(map[string][]int)
 
 	for _, track := range tracks {
@@ -105,7 +120,7 @@ func insertScrobbles(ctx context.Context, userId int, tracks []ScrobbleTrack) (i
 			continue
 		}
 
-		artistNames := parseArtistString(track.Artist)
+		artistNames := parser.Credits(track.Artist, track.SongName)
 		var artistIds []int
 		for _, name := range artistNames {
 			artistId, _, err := db.GetOrCreateArtist(userId, name)
@@ -145,21 +160,21 @@ func insertScrobbles(ctx context.Context, userId int, tracks []ScrobbleTrack) (i
 			songId, _, _ = db.GetOrCreateSong(userId, track.SongName, artistId, albumId)
 		}
 
-		var albumNamePg *string
-		if track.AlbumName != "" {
-			albumNamePg = &track.AlbumName
-		}
-
-		_, err = db.Pool.Exec(ctx,
-			`INSERT INTO history (user_id, timestamp, song_name, artist, album_name, ms_played, platform, artist_id, song_id, artist_ids)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-			ON CONFLICT (user_id, song_name, artist, timestamp) DO NOTHING`,
-			userId, timestamp, track.SongName, track.Artist, albumNamePg, track.MsPlayed, "manual", artistId, songId, artistIds,
-		)
+		// A deleted copy of the scrobble is purged and the scrobble saved anew
+		_, err = db.InsertScrobble(db.NewScrobble{
+			UserId:    userId,
+			Timestamp: timestamp,
+			SongName:  track.SongName,
+			Artist:    track.Artist,
+			Album:     track.AlbumName,
+			MsPlayed:  track.MsPlayed,
+			Platform:  "manual",
+			ArtistId:  artistId,
+			SongId:    songId,
+			ArtistIds: artistIds,
+		}, 0)
 		if err != nil {
-			if !strings.Contains(err.Error(), "duplicate") {
-				fmt.Fprintf(os.Stderr, "Error inserting scrobble: %v\n", err)
-			}
+			fmt.Fprintf(os.Stderr, "Error inserting scrobble: %v\n", err)
 			continue
 		}
 		imported++
@@ -167,17 +182,3 @@ func insertScrobbles(ctx context.Context, userId int, tracks []ScrobbleTrack) (i
 
 	return imported, nil
 }
-
-func parseArtistString(artist string) []string {
-	if artist == "" {
-		return nil
-	}
-	var artists []string
-	for _, a := range strings.Split(artist, ",") {
-		a = strings.TrimSpace(a)
-		if a != "" {
-			artists = append(artists, a)
-		}
-	}
-	return artists
-}
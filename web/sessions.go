@@ -0,0 +1,125 @@
+package web
+
+// Functions used for the listening session timeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"muzi/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const sessionsPerPage = 20
+
+type SessionsData struct {
+	Username         string
+	Period           string
+	Start            string
+	End              string
+	Gap              int
+	Page             int
+	Sessions         []db.ListeningSession
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+type sessionsResponse struct {
+	Username string                `json:"username"`
+	Gap      int                   `json:"gap_minutes"`
+	Page     int                   `json:"page"`
+	Sessions []db.ListeningSession `json:"sessions"`
+}
+
+// Reads the period, gap in minutes and page from the URL and loads that
+// page of sessions
+func loadSessions(r *http.Request, userId int) (SessionsData, error) {
+	d := SessionsData{
+		Period: r.URL.Query().Get("period"),
+		Start:  r.URL.Query().Get("start"),
+		End:    r.URL.Query().Get("end"),
+		Gap:    int(db.DefaultSessionGap.Minutes()),
+		Page:   1,
+	}
+	if d.Period == "" {
+		d.Period = "all_time"
+	}
+	if gap, err := strconv.Atoi(r.URL.Query().Get("gap")); err == nil && gap > 0 && gap <= 24*60 {
+		d.Gap = gap
+	}
+	if page, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && page > 0 {
+		d.Page = page
+	}
+
+	startDate, endDate := getPeriodRange(d.Period, d.Start, d.End)
+	var err error
+	d.Sessions, err = db.GetListeningSessions(db.Filter{
+		UserId:    userId,
+		Start:     startDate,
+		End:       endDate,
+		Platforms: parsePlatforms(r),
+		Limit:     sessionsPerPage,
+		Offset:    (d.Page - 1) * sessionsPerPage,
+	}, time.Duration(d.Gap)*time.Minute)
+	return d, err
+}
+
+func sessionsPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", username, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := loadSessions(r, userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get listening sessions: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Username = username
+		data.Title = username + "'s Listening Sessions"
+		data.LoggedInUsername = getLoggedInUsername(r)
+		data.TemplateName = "sessions"
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func sessionsAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := loadSessions(r, userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get listening sessions: %v\n", err)
+			http.Error(w, "Error getting sessions", http.StatusInternalServerError)
+			return
+		}
+
+		resp := sessionsResponse{Username: username, Gap: data.Gap, Page: data.Page, Sessions: data.Sessions}
+		if resp.Sessions == nil {
+			resp.Sessions = []db.ListeningSession{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
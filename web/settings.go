@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"os"
 
+	"muzi/credits"
+	"muzi/db"
 	"muzi/scrobble"
 )
 
@@ -16,6 +18,12 @@ type settingsData struct {
 	APISecret        string
 	SpotifyClientId  string
 	SpotifyConnected bool
+	ShareGlobal      bool
+	ShareNowPlaying  bool
+	Rules            []db.RewriteRule
+	CreditExceptions []db.CreditException
+	// Names never split for anyone
+	DefaultCreditExceptions []string
 }
 
 func settingsPageHandler() http.HandlerFunc {
@@ -58,6 +66,21 @@ func settingsPageHandler() http.HandlerFunc {
 			d.SpotifyClientId = *user.SpotifyClientId
 		}
 
+		d.ShareGlobal, d.ShareNowPlaying, err = db.GetUserPrivacy(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading privacy settings: %v\n", err)
+		}
+
+		d.Rules, err = db.GetRewriteRules(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading rewrite rules: %v\n", err)
+		}
+		d.CreditExceptions, err = db.GetCreditExceptions(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading credit exceptions: %v\n", err)
+		}
+		d.DefaultCreditExceptions = credits.DefaultExceptions
+
 		err = templates.ExecuteTemplate(w, "base", d)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -135,6 +158,31 @@ func updateSpotifyCredentialsHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/settings?tab=scrobble", http.StatusSeeOther)
 }
 
+func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	username := getLoggedInUsername(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	userId, err := getUserIdByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+
+	shareGlobal := r.FormValue("share_global") == "on"
+	shareNowPlaying := r.FormValue("share_now_playing") == "on"
+	err = db.UpdateUserPrivacy(userId, shareGlobal, shareNowPlaying)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving privacy settings: %v\n", err)
+		http.Error(w, "Error saving privacy settings", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/settings?tab=privacy", http.StatusSeeOther)
+}
+
 func spotifyConnectHandler(w http.ResponseWriter, r *http.Request) {
 	username := getLoggedInUsername(r)
 	if username == "" {
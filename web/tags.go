@@ -0,0 +1,319 @@
+package web
+
+// Functions used for tagging entities and for the tag pages and charts
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/config"
+	"muzi/db"
+	"muzi/metadata"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Tags shown on an artist, album or song page
+type TagList struct {
+	Username string
+	// Base URL of the tag forms, e.g. /profile/name/artist/1/tags
+	Action  string
+	CanEdit bool
+	Tags    []db.EntityTag
+}
+
+type TagData struct {
+	Username         string
+	Tag              string
+	Period           string
+	Start            string
+	End              string
+	ListenCount      int
+	Artists          []db.TopArtist
+	Albums           []db.TopAlbum
+	Tracks           []db.TopTrack
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+type TagsData struct {
+	Username         string
+	Period           string
+	Start            string
+	End              string
+	Tags             []db.TagStat
+	MaxCount         int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+// An entity being tagged, with what's needed to look it up elsewhere
+type taggedEntity struct {
+	Id            int
+	Name          string
+	Artist        string
+	MusicbrainzId string
+	Path          string
+}
+
+func loadTagList(r *http.Request, username string, userId int, entityType string, entityId int) TagList {
+	tags, err := db.GetEntityTags(userId, entityType, entityId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get %s tags: %v\n", entityType, err)
+	}
+	return TagList{
+		Username: username,
+		Action:   "/profile/" + username + "/" + entityType + "/" + strconv.Itoa(entityId) + "/tags",
+		CanEdit:  getLoggedInUsername(r) == username,
+		Tags:     tags,
+	}
+}
+
+// Loads the entity in the URL if it belongs to the logged in user
+func getOwnEntity(w http.ResponseWriter, r *http.Request, entityType string) (taggedEntity, int, bool) {
+	username := getLoggedInUsername(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return taggedEntity{}, 0, false
+	}
+
+	userId, err := getUserIdByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return taggedEntity{}, 0, false
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return taggedEntity{}, 0, false
+	}
+
+	e := taggedEntity{Id: id}
+	var ownerId, artistId int
+	switch entityType {
+	case db.EntityArtist:
+		var artist db.Artist
+		artist, err = db.GetArtistById(id)
+		e.Name, e.MusicbrainzId, ownerId = artist.Name, artist.MusicbrainzId, artist.UserId
+	case db.EntityAlbum:
+		var album db.Album
+		album, err = db.GetAlbumById(id)
+		e.Name, e.MusicbrainzId, ownerId, artistId = album.Title, album.MusicbrainzId, album.UserId, album.ArtistId
+	case db.EntitySong:
+		var song db.Song
+		song, err = db.GetSongById(id)
+		e.Name, e.MusicbrainzId, ownerId, artistId = song.Title, song.MusicbrainzId, song.UserId, song.ArtistId
+	}
+	if err != nil || ownerId != userId {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return taggedEntity{}, 0, false
+	}
+
+	if entityType != db.EntityArtist {
+		artist, err := db.GetArtistById(artistId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting artist: %v\n", err)
+		}
+		e.Artist = artist.Name
+	}
+	e.Path = entityPath(username, entityType, e.Name, e.Artist)
+	return e, userId, true
+}
+
+// Adds the comma separated tags in the form
+func addTagsHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, userId, ok := getOwnEntity(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		for name := range strings.SplitSeq(r.FormValue("tags"), ",") {
+			err := db.AddEntityTag(userId, entityType, e.Id, name, db.TagSourceUser, 100)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error adding tag: %v\n", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		http.Redirect(w, r, e.Path, http.StatusSeeOther)
+	}
+}
+
+func removeTagHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, userId, ok := getOwnEntity(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		err := db.RemoveEntityTag(userId, entityType, e.Id, r.FormValue("tag"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing tag: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, e.Path, http.StatusSeeOther)
+	}
+}
+
+// Replaces the entity's tags from Last.fm or MusicBrainz with fresh ones
+func importTagsHandler(entityType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e, userId, ok := getOwnEntity(w, r, entityType)
+		if !ok {
+			return
+		}
+
+		var tags []db.EntityTag
+		var err error
+		source := r.FormValue("source")
+		switch source {
+		case db.TagSourceLastFM:
+			apiKey := config.Get().LastFM.ApiKey
+			if apiKey == "" {
+				http.Error(w, "No Last.fm API key is configured", http.StatusBadRequest)
+				return
+			}
+			tags, err = metadata.GetLastFMTopTags(apiKey, entityType, e.Name, e.Artist)
+		case db.TagSourceMusicBrainz:
+			tags, err = metadata.GetMusicBrainzGenres(entityType, e.MusicbrainzId, e.Name, e.Artist)
+		default:
+			http.Error(w, "Unknown tag source", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get %s tags for %s: %v\n", source, e.Name, err)
+			http.Error(w, "Cannot get tags: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		err = db.SetImportedTags(userId, entityType, e.Id, source, tags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving tags: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, e.Path, http.StatusSeeOther)
+	}
+}
+
+func tagPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", username, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		tag, err := url.QueryUnescape(chi.URLParam(r, "tag"))
+		if err != nil {
+			http.Error(w, "Invalid tag", http.StatusBadRequest)
+			return
+		}
+		tag = db.NormalizeTag(tag)
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "all_time"
+		}
+
+		data := TagData{
+			Username:         username,
+			Tag:              tag,
+			Period:           period,
+			Start:            r.URL.Query().Get("start"),
+			End:              r.URL.Query().Get("end"),
+			Title:            tag + " - " + username,
+			LoggedInUsername: getLoggedInUsername(r),
+			TemplateName:     "tag",
+		}
+
+		startDate, endDate := getPeriodRange(period, data.Start, data.End)
+		f := db.Filter{UserId: userId, Start: startDate, End: endDate, Tag: tag, Limit: 20}
+
+		data.ListenCount, err = db.GetListenCount(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get tag listen count: %v\n", err)
+		}
+
+		data.Artists, err = db.GetTopArtists(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get top artists for tag: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Albums, err = db.GetTopAlbums(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get top albums for tag: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Tracks, err = db.GetTopTracks(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get top tracks for tag: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func tagsPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+		userId, err := getUserIdByUsername(r.Context(), username)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find user %s: %v\n", username, err)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		period := r.URL.Query().Get("period")
+		if period == "" {
+			period = "month"
+		}
+
+		data := TagsData{
+			Username:         username,
+			Period:           period,
+			Start:            r.URL.Query().Get("start"),
+			End:              r.URL.Query().Get("end"),
+			Title:            username + "'s Tags",
+			LoggedInUsername: getLoggedInUsername(r),
+			TemplateName:     "tags",
+		}
+
+		startDate, endDate := getPeriodRange(period, data.Start, data.End)
+		data.Tags, err = db.GetTopTags(db.Filter{UserId: userId, Start: startDate, End: endDate, Limit: 50})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get top tags: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, t := range data.Tags {
+			data.MaxCount = max(data.MaxCount, t.ListenCount)
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package web
+
+// Functions used for entering and fetching album tracklists
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"muzi/db"
+	"muzi/metadata"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Parses a tracklist entered by hand, one title per line. Tracks are
+// numbered in order, and a line like "Disc 2" starts the next disc.
+func parseTracklist(text string) []db.AlbumTrack {
+	var tracks []db.AlbumTrack
+	disc, track := 1, 0
+	for line := range strings.Lines(text) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(strings.ToLower(line), "disc "); ok {
+			if n, err := strconv.Atoi(strings.TrimSpace(rest)); err == nil {
+				disc, track = n, 0
+				continue
+			}
+		}
+		track++
+		tracks = append(tracks, db.AlbumTrack{DiscNumber: disc, TrackNumber: track, Title: line})
+	}
+	return tracks
+}
+
+// Loads the album in the URL if it belongs to the logged in user
+func getOwnAlbum(w http.ResponseWriter, r *http.Request) (db.Album, string, bool) {
+	username := getLoggedInUsername(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return db.Album{}, "", false
+	}
+
+	userId, err := getUserIdByUsername(r.Context(), username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return db.Album{}, "", false
+	}
+
+	albumId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid album ID", http.StatusBadRequest)
+		return db.Album{}, "", false
+	}
+
+	album, err := db.GetAlbumById(albumId)
+	if err != nil || album.UserId != userId {
+		http.Error(w, "Album not found", http.StatusNotFound)
+		return db.Album{}, "", false
+	}
+	return album, username, true
+}
+
+func redirectToAlbum(w http.ResponseWriter, r *http.Request, username string, album db.Album) {
+	artist, err := db.GetArtistById(album.ArtistId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting artist: %v\n", err)
+		http.Redirect(w, r, "/profile/"+username, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(
+		w,
+		r,
+		"/profile/"+username+"/album/"+url.QueryEscape(artist.Name)+"/"+url.QueryEscape(album.Title),
+		http.StatusSeeOther,
+	)
+}
+
+func updateTracklistHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, username, ok := getOwnAlbum(w, r)
+		if !ok {
+			return
+		}
+
+		err := db.SetAlbumTracklist(album.Id, parseTracklist(r.FormValue("tracklist")))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving tracklist: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirectToAlbum(w, r, username, album)
+	}
+}
+
+func fetchTracklistHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		album, username, ok := getOwnAlbum(w, r)
+		if !ok {
+			return
+		}
+
+		artist, err := db.GetArtistById(album.ArtistId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting artist: %v\n", err)
+		}
+
+		releaseId, err := metadata.FindRelease(album.MusicbrainzId, album.Title, artist.Name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find MusicBrainz release for %s: %v\n", album.Title, err)
+			http.Error(w, "Cannot find album on MusicBrainz: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		tracks, err := metadata.GetReleaseTracklist(releaseId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get MusicBrainz tracklist for %s: %v\n", releaseId, err)
+			http.Error(w, "Cannot get tracklist from MusicBrainz: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		err = db.SetAlbumTracklist(album.Id, tracks)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving tracklist: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		redirectToAlbum(w, r, username, album)
+	}
+}
@@ -0,0 +1,150 @@
+package web
+
+// Functions used for the trash of deleted scrobbles
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"muzi/db"
+)
+
+// Deleted scrobbles listed on the trash page, the rest are only counted
+const trashPageRows = 200
+
+type TrashData struct {
+	Username string
+	Entries  []db.TrashEntry
+	Count    int
+	More     int
+	// Days after which deleted scrobbles are purged, 0 for never
+	Days int
+	// Set after restoring or purging, to confirm it
+	Restored         int
+	Purged           int
+	Title            string
+	LoggedInUsername string
+	TemplateName     string
+}
+
+func trashPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		data := TrashData{
+			Username:         username,
+			Title:            "muzi | Trash",
+			LoggedInUsername: username,
+			TemplateName:     "trash",
+		}
+		data.Restored, _ = strconv.Atoi(r.URL.Query().Get("restored"))
+		data.Purged, _ = strconv.Atoi(r.URL.Query().Get("purged"))
+
+		var err error
+		data.Entries, data.Count, err = db.GetTrash(userId, trashPageRows)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get trash: %v\n", err)
+			http.Error(w, "Error getting trash", http.StatusInternalServerError)
+			return
+		}
+		data.More = data.Count - len(data.Entries)
+		data.Days, err = db.GetTrashDays(userId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get trash days: %v\n", err)
+		}
+
+		err = templates.ExecuteTemplate(w, "base", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Returns the ids selected in the form, or nil when the form applies to the
+// whole trash
+func parseTrashIds(w http.ResponseWriter, r *http.Request) ([]int, bool) {
+	r.ParseForm()
+	if r.Form.Get("scope") == "all" {
+		return nil, true
+	}
+	ids := []int{}
+	for _, v := range r.Form["id"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+func restoreTrashHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+		ids, ok := parseTrashIds(w, r)
+		if !ok {
+			return
+		}
+
+		restored, err := db.RestoreScrobbles(userId, ids)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot restore scrobbles: %v\n", err)
+			http.Error(w, "Error restoring scrobbles", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/trash?restored="+strconv.Itoa(restored), http.StatusSeeOther)
+	}
+}
+
+// Deletes scrobbles in the trash for good
+func purgeTrashHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+		ids, ok := parseTrashIds(w, r)
+		if !ok {
+			return
+		}
+
+		purged, err := db.PurgeScrobbles(userId, ids)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot purge scrobbles: %v\n", err)
+			http.Error(w, "Error purging scrobbles", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/trash?purged="+strconv.Itoa(purged), http.StatusSeeOther)
+	}
+}
+
+func trashSettingsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, userId, ok := getOwnProfileUser(w, r)
+		if !ok {
+			return
+		}
+
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 0 || days > 3650 {
+			http.Error(w, "Invalid number of days", http.StatusBadRequest)
+			return
+		}
+		err = db.SetTrashDays(userId, days)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot set trash days: %v\n", err)
+			http.Error(w, "Error saving settings", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profile/"+username+"/trash", http.StatusSeeOther)
+	}
+}
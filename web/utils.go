@@ -32,6 +32,14 @@ func mod(a int, b int) int {
 	return a % b
 }
 
+// Returns a as a percentage of b, used for bar widths
+func percent(a int, b int) int {
+	if b == 0 {
+		return 0
+	}
+	return a * 100 / b
+}
+
 // Returns a slice of a slice from start to end
 func slice(a []db.TopArtist, start int, end int) []db.TopArtist {
 	if start >= len(a) {
@@ -122,6 +130,49 @@ func formatTimestampFull(timestamp time.Time) string {
 	return timestamp.Format("Monday 2 Jan 2006, 3:04pm")
 }
 
+// Formats a play time in milliseconds as hours and minutes
+func formatDuration(ms int) string {
+	minutes := ms / 60000
+	if minutes < 60 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return formatInt(minutes/60) + "h " + fmt.Sprintf("%dm", minutes%60)
+}
+
+// Formats a track length in milliseconds as minutes and seconds
+func formatTrackLength(ms int) string {
+	seconds := ms / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// Human readable name for a history platform
+func platformLabel(platform string) string {
+	switch platform {
+	case "lastfm":
+		return "Last.fm import"
+	case "lastfm_api":
+		return "Last.fm API"
+	case "spotify":
+		return "Spotify"
+	case "listenbrainz":
+		return "ListenBrainz"
+	case "manual":
+		return "Manual"
+	case "":
+		return "Unknown"
+	default:
+		return platform
+	}
+}
+
+// Formats a date without a time, e.g. for streak start and end days
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format("2 Jan 2006")
+}
+
 // GetArtistNames takes artist IDs and returns a slice of artist names
 func GetArtistNames(artistIds []int) []string {
 	if artistIds == nil {
@@ -44,6 +44,12 @@ func init() {
 		"formatTimestampFull": formatTimestampFull,
 		"urlquery":            url.QueryEscape,
 		"getArtistNames":      GetArtistNames,
+		"milestoneLabel":      milestoneLabel,
+		"formatDate":          formatDate,
+		"percent":             percent,
+		"formatDuration":      formatDuration,
+		"platformLabel":       platformLabel,
+		"formatTrackLength":   formatTrackLength,
 	}
 	templates = template.Must(template.New("").Funcs(funcMap).ParseGlob("./templates/*.gohtml"))
 }
@@ -91,6 +97,30 @@ func Start() {
 	r.Get("/logout", logoutHandler())
 	r.Get("/createaccount", createAccountPageHandler())
 	r.Get("/profile/{username}", profilePageHandler())
+	r.Get("/profile/{username}/discoveries", discoveriesPageHandler())
+	r.Get("/profile/{username}/history", historyPageHandler())
+	r.Post("/profile/{username}/history/edit", historyEditPreviewHandler())
+	r.Post("/profile/{username}/history/edit/apply", historyEditApplyHandler())
+	r.Get("/profile/{username}/sessions", sessionsPageHandler())
+	r.Get("/profile/{username}/tags", tagsPageHandler())
+	r.Get("/profile/{username}/duplicates", duplicatesPageHandler())
+	r.Post("/profile/{username}/duplicates/merge", mergeDuplicateHandler())
+	r.Post("/profile/{username}/duplicates/dismiss", dismissDuplicateHandler())
+	r.Post("/profile/{username}/duplicates/dismissed/clear", clearDismissedDuplicatesHandler())
+	r.Get("/profile/{username}/duplicates/scrobbles", scrobbleCleanupPageHandler())
+	r.Post("/profile/{username}/duplicates/scrobbles/remove", removeScrobbleConflictsHandler())
+	r.Post("/profile/{username}/duplicates/scrobbles/cleanups/{id}/undo", undoScrobbleCleanupHandler())
+	r.Post("/profile/{username}/duplicates/scrobbles/cleanups/{id}/purge", purgeScrobbleCleanupHandler())
+	r.Get("/profile/{username}/changes", changesPageHandler())
+	r.Post("/profile/{username}/changes/{id}/undo", undoChangeHandler())
+	r.Get("/profile/{username}/trash", trashPageHandler())
+	r.Post("/profile/{username}/trash/restore", restoreTrashHandler())
+	r.Post("/profile/{username}/trash/purge", purgeTrashHandler())
+	r.Post("/profile/{username}/trash/settings", trashSettingsHandler())
+	r.Get("/profile/{username}/tag/{tag}", tagPageHandler())
+	r.Get("/profile/{username}/diversity", diversityPageHandler())
+	r.Get("/compare/{userA}/{userB}", comparePageHandler())
+	r.Get("/global", globalPageHandler())
 	r.Get("/profile/{username}/artist/{artist}", artistPageHandler())
 	r.Get("/profile/{username}/song/{artist}/{song}", songPageHandler())
 	r.Get("/profile/{username}/album/{artist}/{album}", albumPageHandler())
@@ -114,6 +144,17 @@ func Start() {
 	r.Post("/profile/{username}/artist/{id}/edit", editArtistHandler())
 	r.Post("/profile/{username}/song/{id}/edit", editSongHandler())
 	r.Post("/profile/{username}/album/{id}/edit", editAlbumHandler())
+	r.Post("/profile/{username}/album/{id}/tracklist", updateTracklistHandler())
+	r.Post("/profile/{username}/album/{id}/tracklist/fetch", fetchTracklistHandler())
+	for _, entity := range []string{db.EntityArtist, db.EntityAlbum, db.EntitySong} {
+		r.Post("/profile/{username}/"+entity+"/{id}/tags", addTagsHandler(entity))
+		r.Post("/profile/{username}/"+entity+"/{id}/tags/remove", removeTagHandler(entity))
+		r.Post("/profile/{username}/"+entity+"/{id}/tags/import", importTagsHandler(entity))
+		r.Post("/profile/{username}/"+entity+"/{id}/merge", mergePreviewHandler(entity))
+		r.Post("/profile/{username}/"+entity+"/{id}/merge/apply", mergeApplyHandler(entity))
+		r.Post("/profile/{username}/"+entity+"/{id}/aliases", addAliasHandler(entity))
+		r.Post("/profile/{username}/"+entity+"/{id}/aliases/{alias}/delete", deleteAliasHandler(entity))
+	}
 	r.Patch("/api/artist/{id}/edit", artistInlineEditHandler())
 	r.Patch("/api/song/{id}/edit", songInlineEditHandler())
 	r.Patch("/api/album/{id}/edit", albumInlineEditHandler())
@@ -121,6 +162,10 @@ func Start() {
 	r.Patch("/api/song/{id}/batch", songBatchEditHandler())
 	r.Patch("/api/album/{id}/batch", albumBatchEditHandler())
 	r.Post("/api/scrobble/delete", deleteScrobbleHandler())
+	r.Get("/api/profile/{username}/milestones", milestonesAPIHandler())
+	r.Get("/api/profile/{username}/sessions", sessionsAPIHandler())
+	r.Get("/api/profile/{username}/history", historyAPIHandler())
+	r.Get("/api/profile/{username}/forecast", forecastAPIHandler())
 	r.Post("/api/upload/image", imageUploadHandler())
 	r.Get("/search", searchHandler())
 	r.Get("/import", importPageHandler())
@@ -145,6 +190,18 @@ func Start() {
 	r.Get("/settings", settingsPageHandler())
 	r.Post("/settings/generate-apikey", generateAPIKeyHandler)
 	r.Post("/settings/update-spotify", updateSpotifyCredentialsHandler)
+	r.Post("/settings/update-privacy", updatePrivacyHandler)
+	r.Post("/settings/rules/add", addRuleHandler)
+	r.Post("/settings/rules/{id}/delete", deleteRuleHandler)
+	r.Post("/settings/rules/{id}/toggle", toggleRuleHandler)
+	r.Get("/settings/rules/export", exportRulesHandler)
+	r.Post("/settings/rules/import", importRulesHandler)
+	r.Post("/settings/rules/preview", previewRulesHandler)
+	r.Post("/settings/rules/apply", applyRulesHandler)
+	r.Post("/settings/credits/exceptions/add", addCreditExceptionHandler)
+	r.Post("/settings/credits/exceptions/{id}/delete", deleteCreditExceptionHandler)
+	r.Post("/settings/credits/preview", previewCreditsHandler)
+	r.Post("/settings/credits/apply", applyCreditsHandler)
 	fmt.Printf("WebUI starting on %s\n", addr)
 	prot := http.NewCrossOriginProtection()
 	http.ListenAndServe(addr, prot.Handler(r))